@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// An achievement and the category it's in, from the Game Data API. CategoryPath includes the parent
+// category, like "Quests/Battle for Azeroth".
+type AchievementDefinition struct {
+	ID           int64 `gorm:"primary_key;auto_increment:false"`
+	Name         string
+	CategoryID   int64
+	CategoryPath string
+}
+
+// An achievement a toon has completed or made progress on. CompletedAt is nil until it's completed.
+type ToonAchievement struct {
+	ID            int64
+	ToonID        uint
+	AchievementID int64
+	Name          string
+	CompletedAt   *time.Time
+}
+
+// Whether two rows for the same achievement say the same thing.
+func (a *ToonAchievement) same(other *ToonAchievement) bool {
+	if a.Name != other.Name || (a.CompletedAt == nil) != (other.CompletedAt == nil) {
+		return false
+	}
+	return a.CompletedAt == nil || a.CompletedAt.Equal(*other.CompletedAt)
+}
+
+// Progress on one criteria of an achievement the toon hasn't completed.
+type AchievementCriteria struct {
+	ID            int64
+	ToonID        uint
+	AchievementID int64
+	CriteriaID    int64
+	Amount        int64
+	IsCompleted   bool
+}
+
+func (AchievementCriteria) TableName() string {
+	return "achievement_criteria"
+}
+
+// How far a toon is through an achievement, by how many of its criteria are done.
+type AchievementProgress struct {
+	Achievement ToonAchievement
+	Category    string
+	Completed   int
+	Total       int
+}
+
+func (p *AchievementProgress) Percent() float64 {
+	return 100 * float64(p.Completed) / float64(p.Total)
+}
+
+// How many achievements the closest to completion report shows.
+const closestAchievements = 10
+
+// Get the achievements and the criteria progress of the incomplete ones from a character's achievements
+// document. An incomplete achievement's progress is its child criteria, or the criteria itself when it
+// doesn't have any.
+func ParseAchievements(myJson string) ([]ToonAchievement, []AchievementCriteria) {
+	var achievements []ToonAchievement
+	var criteria []AchievementCriteria
+
+	gjson.Get(myJson, "achievements").ForEach(func(_, a gjson.Result) bool {
+		achievement := ToonAchievement{AchievementID: a.Get("id").Int(), Name: a.Get("achievement.name").String()}
+		if completed := a.Get("completed_timestamp"); completed.Exists() {
+			at := time.Unix(0, completed.Int()*int64(time.Millisecond)).UTC()
+			achievement.CompletedAt = &at
+		}
+		achievements = append(achievements, achievement)
+		if achievement.CompletedAt != nil {
+			return true
+		}
+
+		children := a.Get("criteria.child_criteria").Array()
+		if len(children) == 0 && a.Get("criteria").Exists() {
+			children = []gjson.Result{a.Get("criteria")}
+		}
+		for _, c := range children {
+			criteria = append(criteria, AchievementCriteria{
+				AchievementID: achievement.AchievementID,
+				CriteriaID:    c.Get("id").Int(),
+				Amount:        c.Get("amount").Int(),
+				IsCompleted:   c.Get("is_completed").Bool(),
+			})
+		}
+		return true
+	})
+	return achievements, criteria
+}
+
+// Fetch and save a toon's achievements.
+func insertAchievements(ctx context.Context, t Toon, env *Env, blizzard Blizzard) {
+	myJson, err := blizzard.GetAchievements(ctx, t)
+	if err != nil {
+		reportToonFailure(t, "achievements", err)
+		return
+	}
+
+	achievements, criteria := ParseAchievements(myJson)
+	for i := range achievements {
+		achievements[i].ToonID = t.ID
+	}
+	for i := range criteria {
+		criteria[i].ToonID = t.ID
+	}
+	err = env.db.SaveToonAchievements(ctx, t.ID, achievements, criteria)
+	if err != nil {
+		reportToonFailure(t, "achievements", err)
+	}
+}
+
+// Load the achievement names and categories from Blizzard.
+func UpdateAchievementsFromBlizzard(ctx context.Context, env *Env, blizzard Blizzard) error {
+	definitions, err := blizzard.GetAchievementDefinitions(ctx)
+	if err != nil {
+		return err
+	}
+	return env.db.SaveAchievementDefinitions(ctx, definitions)
+}
+
+// Load the achievement definitions only if a toon has an achievement that isn't in them, which is the first
+// time and after a patch adds some. Achievements that aren't in any category, which some old ones aren't, get
+// a definition without a category so they don't cause a reload every run.
+func RefreshAchievementDefinitions(ctx context.Context, env *Env, blizzard Blizzard) error {
+	unknown, err := env.db.GetUnknownAchievements(ctx)
+	if err != nil || len(unknown) == 0 {
+		return err
+	}
+	log.Debugf("%v achievements without a definition, loading them from Blizzard", len(unknown))
+	err = UpdateAchievementsFromBlizzard(ctx, env, blizzard)
+	if err != nil {
+		return err
+	}
+
+	unknown, err = env.db.GetUnknownAchievements(ctx)
+	if err != nil {
+		return err
+	}
+	var definitions []AchievementDefinition
+	for i, a := range unknown {
+		if i == 0 || a.AchievementID != unknown[i-1].AchievementID {
+			definitions = append(definitions, AchievementDefinition{ID: a.AchievementID, Name: a.Name})
+		}
+	}
+	return env.db.SaveAchievementDefinitions(ctx, definitions)
+}
+
+// Work out how far through each incomplete achievement a toon is, closest to done first. Achievements with
+// a single criteria are left out, there's no telling how far through those they are.
+func achievementProgress(achievements []ToonAchievement, criteria []AchievementCriteria, categories map[int64]string) []AchievementProgress {
+	byAchievement := make(map[int64]*AchievementProgress)
+	for _, a := range achievements {
+		if a.CompletedAt == nil {
+			byAchievement[a.AchievementID] = &AchievementProgress{Achievement: a, Category: categories[a.AchievementID]}
+		}
+	}
+	for _, c := range criteria {
+		p, ok := byAchievement[c.AchievementID]
+		if !ok {
+			continue
+		}
+		p.Total++
+		if c.IsCompleted {
+			p.Completed++
+		}
+	}
+
+	var progress []AchievementProgress
+	for _, p := range byAchievement {
+		if p.Total > 1 {
+			progress = append(progress, *p)
+		}
+	}
+	sort.Slice(progress, func(i, j int) bool {
+		if progress[i].Percent() != progress[j].Percent() {
+			return progress[i].Percent() > progress[j].Percent()
+		}
+		return progress[i].Achievement.Name < progress[j].Achievement.Name
+	})
+	return progress
+}
+
+// Print a toon's completed achievements newest first, limited to from and to when they aren't zero, and the
+// incomplete achievements that are closest to done.
+func PrintAchievements(ctx context.Context, env *Env, toonName string, from time.Time, to time.Time, out io.Writer) error {
+	toon, err := FindToon(ctx, env, toonName)
+	if err != nil {
+		return err
+	}
+	achievements, err := env.db.GetToonAchievements(ctx, toon.ID)
+	if err != nil {
+		return err
+	}
+	criteria, err := env.db.GetAchievementCriteria(ctx, toon.ID)
+	if err != nil {
+		return err
+	}
+	definitions, err := env.db.GetAchievementDefinitions(ctx)
+	if err != nil {
+		return err
+	}
+	categories := make(map[int64]string)
+	for _, d := range definitions {
+		categories[d.ID] = d.CategoryPath
+	}
+
+	var completed []ToonAchievement
+	for _, a := range achievements {
+		if a.CompletedAt != nil {
+			completed = append(completed, a)
+		}
+	}
+	sort.Slice(completed, func(i, j int) bool {
+		return completed[i].CompletedAt.After(*completed[j].CompletedAt)
+	})
+
+	_, _ = fmt.Fprintf(out, "%v-%v: %v achievements completed\n\n", toon.Name, toon.Realm, len(completed))
+	w := tabwriter.NewWriter(out, 5, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "Date\tAchievement\tCategory\t")
+	for _, a := range completed {
+		day := truncateToDay(a.CompletedAt.Local())
+		if (!from.IsZero() && day.Before(from)) || (!to.IsZero() && day.After(to)) {
+			continue
+		}
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t\n", a.CompletedAt.Local().Format("2006-01-02 15:04"), a.Name, categories[a.AchievementID])
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	progress := achievementProgress(achievements, criteria, categories)
+	if len(progress) > closestAchievements {
+		progress = progress[:closestAchievements]
+	}
+	_, _ = fmt.Fprintln(out, "\nClosest to completion:")
+	w = tabwriter.NewWriter(out, 5, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "Achievement\tCategory\tCriteria\tPercent\t")
+	for _, p := range progress {
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v/%v\t%.0f%%\t\n", p.Achievement.Name, p.Category, p.Completed, p.Total, p.Percent())
+	}
+	return w.Flush()
+}
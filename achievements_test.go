@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAchievements(t *testing.T) {
+	jsonText, err := ioutil.ReadFile("test-json-achievements.json")
+	if err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	}
+
+	achievements, criteria := ParseAchievements(string(jsonText))
+	if len(achievements) != 6 || len(criteria) != 9 {
+		t.Fatalf("Want 6 achievements and 9 criteria, got %v and %v", len(achievements), len(criteria))
+	}
+	loremaster := achievements[2]
+	if loremaster.AchievementID != 12593 || loremaster.CompletedAt == nil || !loremaster.CompletedAt.Equal(time.Unix(1550372520, 0)) {
+		t.Errorf("Loremaster of Kul Tiras incorrect, got %+v", loremaster)
+	}
+	if achievements[3].CompletedAt != nil {
+		t.Errorf("Zandalar Forever! should not be completed, got %+v", achievements[3])
+	}
+}
+
+func TestAchievements(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeBlizzard(t)
+	defer fake.Close()
+	blizzard := newTestBlizzard(t, fake.Transport())
+	db, env, cleanup := newMigratedEnv(t)
+	defer cleanup()
+
+	toon := insertTestToon(t, db)
+	// Saving them twice doesn't add any rows.
+	insertAchievements(ctx, toon, env, blizzard)
+	insertAchievements(ctx, toon, env, blizzard)
+	achievements, _ := db.GetToonAchievements(ctx, toon.ID)
+	criteria, _ := db.GetAchievementCriteria(ctx, toon.ID)
+	if len(achievements) != 6 || len(criteria) != 9 {
+		t.Fatalf("Want 6 achievements and 9 criteria, got %v and %v", len(achievements), len(criteria))
+	}
+
+	if err := RefreshAchievementDefinitions(ctx, env, blizzard); err != nil {
+		t.Fatalf("RefreshAchievementDefinitions failed: %v", err)
+	}
+	// The fake doesn't have two of the achievements in any category, they still get definitions.
+	if unknown, _ := db.GetUnknownAchievements(ctx); len(unknown) != 0 {
+		t.Errorf("Want no unknown achievements after a refresh, got %+v", unknown)
+	}
+
+	// Completing an achievement drops its criteria.
+	completed := []ToonAchievement{{ToonID: toon.ID, AchievementID: 12479, Name: "Zandalar Forever!", CompletedAt: &time.Time{}}}
+	if err := db.SaveToonAchievements(ctx, toon.ID, completed, criteria[4:]); err != nil {
+		t.Fatalf("SaveToonAchievements failed: %v", err)
+	}
+	if criteria, _ := db.GetAchievementCriteria(ctx, toon.ID); len(criteria) != 5 {
+		t.Errorf("Want 5 criteria left, got %+v", criteria)
+	}
+	insertAchievements(ctx, toon, env, blizzard)
+
+	var out bytes.Buffer
+	err := PrintAchievements(ctx, env, "borvoh", time.Date(2008, 11, 10, 0, 0, 0, 0, time.UTC), time.Time{}, &out)
+	if err != nil {
+		t.Fatalf("PrintAchievements failed: %v", err)
+	}
+	report := out.String()
+	closest := strings.Index(report, "Closest to completion")
+	for _, s := range []string{"3 achievements completed", "Loremaster of Kul Tiras   Quests/Battle for Azeroth", "Level 20"} {
+		if !strings.Contains(report[:closest], s) {
+			t.Errorf("Timeline missing %q:\n%s", s, report)
+		}
+	}
+	if strings.Contains(report[:closest], "Level 10") {
+		t.Errorf("Timeline should start at --from:\n%s", report)
+	}
+	if !strings.Contains(report[closest:], "Zandalar Forever!") || strings.Index(report, "Zandalar") > strings.Index(report, "Master of Minerals") {
+		t.Errorf("Closest to completion incorrect:\n%s", report)
+	}
+	if strings.Contains(report[closest:], "Undersea Usurper") {
+		t.Errorf("An achievement with one criteria shouldn't be in closest to completion:\n%s", report)
+	}
+}
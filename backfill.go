@@ -0,0 +1,282 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// What to backfill. From and To limit the files to those dates, inclusive, and are ignored when zero. With
+// DryRun nothing is written, the report shows what would have been.
+type BackfillOptions struct {
+	Dir    string
+	From   time.Time
+	To     time.Time
+	DryRun bool
+}
+
+// What happened to one folder of the archive.
+type BackfillResult struct {
+	Folder    string
+	Files     int
+	Inserted  int
+	Updated   int
+	Identical int
+	Skipped   int
+	Failed    int
+	Err       error
+}
+
+const archiveDateFormat = "2006-01-02"
+
+// Rebuild stats from the JSON that GetAndInsertToonStats archived. Each Name-Realm folder is matched to a
+// toon and each Name-Realm-date.json.gz file in it becomes that day's Stat, inserted if the toon doesn't
+// have stats for the day and updated if the parsed stats are different from what's there.
+func Backfill(ctx context.Context, env *Env, options BackfillOptions) ([]BackfillResult, error) {
+	folders, err := ioutil.ReadDir(options.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	toons, err := env.db.GetAllToons(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byFolder := make(map[string][]Toon)
+	for _, t := range toons {
+		key := archiveFolderKey(t.Name, t.Realm)
+		byFolder[key] = append(byFolder[key], t)
+	}
+
+	var results []BackfillResult
+	for _, f := range folders {
+		if !f.IsDir() {
+			continue
+		}
+		if ctx.Err() != nil {
+			return results, ctx.Err()
+		}
+
+		result := BackfillResult{Folder: f.Name()}
+		// The folder doesn't have the region, so a name and realm that's in two regions can't be told apart.
+		name, realm := splitArchiveFolder(f.Name())
+		matches := byFolder[archiveFolderKey(name, realm)]
+		switch len(matches) {
+		case 0:
+			result.Err = fmt.Errorf("no toon matches the folder")
+		case 1:
+			backfillToon(ctx, env, options, matches[0], filepath.Join(options.Dir, f.Name()), &result)
+		default:
+			result.Err = fmt.Errorf("%d toons in different regions match the folder", len(matches))
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// How a toon and an archive folder are matched up. The realm goes by its slug without hyphens, so a toon whose
+// realm was renamed from Argent-Dawn to Argent Dawn still finds the folder it was archived in before.
+func archiveFolderKey(name string, realm string) string {
+	return strings.ToLower(name) + "-" + compactSlug(realm)
+}
+
+// The name and realm of a Name-Realm folder. Character names don't have hyphens, realms can.
+func splitArchiveFolder(folder string) (string, string) {
+	parts := strings.SplitN(folder, "-", 2)
+	if len(parts) < 2 {
+		return folder, ""
+	}
+	return parts[0], parts[1]
+}
+
+// The folder a toon's documents are archived in.
+func archiveFolder(dir string, t Toon) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%s", t.Name, t.Realm))
+}
+
+// Move a renamed toon's archive folder to its new name so backfill still finds it. Nothing is moved when
+// there's no folder or the new one is already there.
+func renameArchiveFolder(dir string, old Toon, renamed Toon) error {
+	from, to := archiveFolder(dir, old), archiveFolder(dir, renamed)
+	if from == to {
+		return nil
+	}
+	if _, err := os.Stat(from); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Stat(to); err == nil {
+		return fmt.Errorf("can't move %s, %s is already there", from, to)
+	}
+	return os.Rename(from, to)
+}
+
+// Backfill the files in one toon's folder.
+func backfillToon(ctx context.Context, env *Env, options BackfillOptions, t Toon, dir string, result *BackfillResult) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json.gz"))
+	if err != nil {
+		result.Err = err
+		return
+	}
+	sort.Strings(files)
+
+	current, err := env.db.GetStatsForToon(ctx, t.ID)
+	if err != nil {
+		result.Err = err
+		return
+	}
+	byDay := make(map[string]Stat)
+	for _, s := range current {
+		byDay[s.InsertDate.Format(archiveDateFormat)] = s
+	}
+
+	for _, file := range files {
+		result.Files++
+		day, err := archiveFileDate(filepath.Base(file))
+		if err != nil {
+			result.Failed++
+			result.setErr(err)
+			continue
+		}
+		if (!options.From.IsZero() && day.Before(options.From)) || (!options.To.IsZero() && day.After(options.To)) {
+			result.Skipped++
+			continue
+		}
+
+		myJson, err := readArchiveFile(file)
+		if err != nil {
+			result.Failed++
+			result.setErr(fmt.Errorf("%s: %v", filepath.Base(file), err))
+			continue
+		}
+
+		stats := ParseStatsFromJson(myJson)
+		stats.ToonID = t.ID
+		stats.InsertDate = day
+
+		existing, ok := byDay[day.Format(archiveDateFormat)]
+		switch {
+		case !ok:
+			if !options.DryRun {
+				err = env.db.InsertStats(ctx, &stats)
+			}
+			if err == nil {
+				result.Inserted++
+			}
+		case sameStats(existing, stats):
+			result.Identical++
+		default:
+			stats.Model = existing.Model
+			if !options.DryRun {
+				err = env.db.UpdateStats(ctx, &stats)
+			}
+			if err == nil {
+				result.Updated++
+			}
+		}
+		// The snapshot is saved even when the stats were already right, filling in a metric that was just
+		// added to the config is what a backfill is often for.
+		if err == nil && !options.DryRun {
+			if errors := recordSnapshot(ctx, env, t.ID, day, myJson); len(errors) > 0 {
+				err = errors[0]
+			}
+		}
+		if err != nil {
+			result.Failed++
+			result.setErr(fmt.Errorf("%s: %v", filepath.Base(file), err))
+		}
+	}
+}
+
+// Keep the first error, the rest are usually the same thing again.
+func (r *BackfillResult) setErr(err error) {
+	if r.Err == nil {
+		r.Err = err
+	}
+}
+
+// Get the date from an archive file name, the last part of Name-Realm-YYYY-MM-DD.json.gz.
+func archiveFileDate(name string) (time.Time, error) {
+	base := strings.TrimSuffix(name, ".json.gz")
+	if len(base) < len(archiveDateFormat) {
+		return time.Time{}, fmt.Errorf("no date in archive file name %s", name)
+	}
+	day, err := time.Parse(archiveDateFormat, base[len(base)-len(archiveDateFormat):])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("no date in archive file name %s", name)
+	}
+	return day, nil
+}
+
+func readArchiveFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	gzipReader, err := gzip.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadAll(gzipReader)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Whether two stats have the same values, ignoring the database fields and the date.
+func sameStats(a Stat, b Stat) bool {
+	b.Model = a.Model
+	b.Toon = a.Toon
+	b.ToonID = a.ToonID
+	b.InsertDate = a.InsertDate
+	b.Unchanged = a.Unchanged
+	return reflect.DeepEqual(a, b)
+}
+
+// Write what a backfill did, or would do with a dry run, for each folder and the totals.
+func PrintBackfillReport(results []BackfillResult, dryRun bool, out io.Writer) error {
+	if dryRun {
+		_, _ = fmt.Fprintln(out, "Dry run, nothing was written.")
+	}
+
+	w := tabwriter.NewWriter(out, 5, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "Folder\tFiles\tInserted\tUpdated\tIdentical\tOut of Range\tFailed\t")
+	var total BackfillResult
+	var errors []string
+	for _, r := range results {
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t\n", r.Folder, r.Files, r.Inserted, r.Updated, r.Identical, r.Skipped, r.Failed)
+		total.Files += r.Files
+		total.Inserted += r.Inserted
+		total.Updated += r.Updated
+		total.Identical += r.Identical
+		total.Skipped += r.Skipped
+		total.Failed += r.Failed
+		if r.Err != nil {
+			errors = append(errors, fmt.Sprintf("%v: %v", r.Folder, r.Err))
+		}
+	}
+	_, _ = fmt.Fprintf(w, "Total\t%v\t%v\t%v\t%v\t%v\t%v\t\n", total.Files, total.Inserted, total.Updated, total.Identical, total.Skipped, total.Failed)
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+
+	if len(errors) > 0 {
+		_, _ = fmt.Fprintln(out, "\nProblems:")
+		for _, e := range errors {
+			_, _ = fmt.Fprintf(out, "  %v\n", e)
+		}
+	}
+	return nil
+}
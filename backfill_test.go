@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeArchiveFile(t *testing.T, dir string, name string, source string) {
+	data, err := ioutil.ReadFile(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	_, _ = gzipWriter.Write(data)
+	_ = gzipWriter.Close()
+
+	err = os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, name), buffer.Bytes(), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	ctx := context.Background()
+	db, env, cleanup := newMigratedEnv(t)
+	defer cleanup()
+
+	archive, err := ioutil.TempDir("", "wowstats-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(archive)
+	toonDir := filepath.Join(archive, "Borvoh-Duskwood")
+	writeArchiveFile(t, toonDir, "Borvoh-Duskwood-2019-10-16.json.gz", "test-json.json")
+	writeArchiveFile(t, toonDir, "Borvoh-Duskwood-2019-10-17.json.gz", "test-json-profile.json")
+	writeArchiveFile(t, toonDir, "Borvoh-Duskwood-2019-10-18.json.gz", "test-json-profile.json")
+	writeArchiveFile(t, filepath.Join(archive, "Nobody-Duskwood"), "Nobody-Duskwood-2019-10-17.json.gz", "test-json-profile.json")
+
+	toon := insertTestToon(t, db)
+	stale := Stat{ToonID: toon.ID, Level: 110, InsertDate: time.Date(2019, 10, 17, 0, 0, 0, 0, time.UTC)}
+	if err := db.InsertStats(ctx, &stale); err != nil {
+		t.Fatal(err)
+	}
+
+	options := BackfillOptions{Dir: archive, To: time.Date(2019, 10, 17, 0, 0, 0, 0, time.UTC), DryRun: true}
+	results, err := Backfill(ctx, env, options)
+	if err != nil {
+		t.Fatalf("Backfill failed: %v", err)
+	}
+	if len(results) != 2 || results[0].Inserted != 1 || results[0].Updated != 1 || results[0].Skipped != 1 || results[1].Err == nil {
+		t.Fatalf("Backfill results incorrect: %+v", results)
+	}
+	if stats, _ := db.GetStatsForToon(ctx, toon.ID); len(stats) != 1 || stats[0].Level != 110 {
+		t.Fatalf("Dry run changed the database: %+v", stats)
+	}
+
+	options.DryRun = false
+	_, err = Backfill(ctx, env, options)
+	if err != nil {
+		t.Fatalf("Backfill failed: %v", err)
+	}
+	stats, _ := db.GetStatsForToon(ctx, toon.ID)
+	if len(stats) != 2 || stats[0].MountsCollected != 260 || stats[1].Level != 120 || stats[1].ItemLevel != 415 || stats[1].ID != stale.ID {
+		t.Errorf("Backfilled stats incorrect: %+v", stats)
+	}
+
+	// Running it again finds nothing to change.
+	results, _ = Backfill(ctx, env, options)
+	if results[0].Identical != 2 || results[0].Inserted != 0 || results[0].Updated != 0 {
+		t.Errorf("Second backfill should only find identical stats: %+v", results[0])
+	}
+}
+
+// Renaming a toon by hand or putting its realm right mustn't lose the documents archived under the old name.
+func TestBackfillAfterRename(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeBlizzard(t)
+	defer fake.Close()
+	blizzard := newTestBlizzard(t, fake.Transport())
+	db, env, cleanup := newMigratedEnv(t)
+	defer cleanup()
+	archive, err := ioutil.TempDir("", "wowstats-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(archive)
+	env.config = Config{ArchiveDir: archive}
+
+	writeArchiveFile(t, filepath.Join(archive, "Borvohh-Duskwood"), "Borvohh-Duskwood-2019-10-17.json.gz", "test-json-profile.json")
+	writeArchiveFile(t, filepath.Join(archive, "Aurelia-Argent-Dawn"), "Aurelia-Argent-Dawn-2019-10-17.json.gz", "test-json-profile.json")
+	borvoh := Toon{Name: "Borvohh", RaceID: 29, ClassID: 5, Realm: "Duskwood", Region: "us"}
+	aurelia := Toon{Name: "Aurelia", RaceID: 1, ClassID: 2, Realm: "Argent-Dawn", Region: "us"}
+	for _, toon := range []*Toon{&borvoh, &aurelia} {
+		if err := db.InsertToon(ctx, toon); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var rename ToonCommand
+	rename.Rename.Args.Toon, rename.Rename.Args.Name = "Borvohh", "borvoh"
+	var out bytes.Buffer
+	if err := RunToonCommand(ctx, env, blizzard, &rename, "rename", strings.NewReader(""), &out); err != nil {
+		t.Fatalf("toon rename failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(archive, "Borvoh-Duskwood")); err != nil {
+		t.Errorf("The archive folder should have been renamed: %v", err)
+	}
+	if err := db.RenameRealm(ctx, "us", "Argent-Dawn", "Argent Dawn"); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := Backfill(ctx, env, BackfillOptions{Dir: archive})
+	if err != nil {
+		t.Fatalf("Backfill failed: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Want 2 folders backfilled, got %+v", results)
+	}
+	for _, r := range results {
+		if r.Err != nil || r.Inserted != 1 {
+			t.Errorf("Folder %v should have been matched to its toon: %+v", r.Folder, r)
+		}
+	}
+}
@@ -1,86 +1,480 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	log "github.com/sirupsen/logrus"
 	"github.com/tidwall/gjson"
 	"gopkg.in/resty.v1"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Functions to interact with Blizzard.
 type Blizzard interface {
-	GetToonJson(toon Toon) (string, error)
-	GetClasses() ([]ToonClass, error)
-	GetRaces() ([]Race, error)
-	GetToon(toon *ToonDto) error
+	GetToonJson(ctx context.Context, toon Toon) (string, error)
+	GetClasses(ctx context.Context) ([]ToonClass, error)
+	GetRaces(ctx context.Context) ([]Race, error)
+	GetToon(ctx context.Context, toon *ToonDto) error
+	GetAchievements(ctx context.Context, toon Toon) (string, error)
+	GetAchievementDefinitions(ctx context.Context) ([]AchievementDefinition, error)
+	GetMythicKeystoneProfile(ctx context.Context, toon Toon) (string, error)
+	GetRaidEncounters(ctx context.Context, toon Toon) (string, error)
+	GetMount(ctx context.Context, id int64) (string, error)
+	GetGuildRoster(ctx context.Context, guild Guild) (string, error)
+	GetRealms(ctx context.Context, region string) ([]Realm, error)
 }
 
-// Configuration information for interacting with Blizzard.
+var _ Blizzard = (*BlizzardHttp)(nil)
+
+// Configuration information for interacting with Blizzard in a single region. AccessToken is refreshed as it
+// nears TokenExpiry, use token() rather than reading it directly since the stats goroutines share the client.
 type BlizzardHttp struct {
+	Region       Region
 	ClientId     string
 	ClientSecret string
 	AccessToken  string
+	TokenExpiry  time.Time
+	Locale       string
+	Limiter      *RateLimiter
+	Cache        *ResponseCache
+	Offline      bool
+	HttpClient   *resty.Client
+	tokenMutex   sync.Mutex
+}
+
+// Returned when Blizzard answers with a 404, which is what the Profile API does for characters that don't
+// exist or haven't logged in recently.
+var ErrNotFound = errors.New("not found")
+
+// Returned when running offline and the document isn't in the cache.
+var ErrOffline = errors.New("offline")
+
+// Returned by GetToonJson when the character hasn't changed since it was last fetched. Json is the document
+// from that fetch, for when there's nothing else to go on.
+type NotModifiedError struct {
+	Json string
+}
+
+func (e *NotModifiedError) Error() string {
+	return "character has not changed since it was last fetched"
 }
 
-func NewBlizzard(clientId string, clientSecret string) (*BlizzardHttp, error) {
-	url := "https://us.battle.net/oauth/token"
-	resp, err := resty.R().SetBasicAuth(clientId, clientSecret).SetQueryParam("grant_type", "client_credentials").Get(url)
+// The documents that hang off of the character profile. GetToonJson fetches each of these and stores it under
+// the key in the combined document so that everything for a character can be archived and parsed as one.
+var profileDocuments = []struct {
+	Key  string
+	Path string
+}{
+	{"achievement_statistics", "/achievements/statistics"},
+	{"equipment", "/equipment"},
+	{"mounts_collection", "/collections/mounts"},
+	{"pets_collection", "/collections/pets"},
+	{"pvp_summary", "/pvp-summary"},
+	{"reputations", "/reputations"},
+	{"professions", "/professions"},
+}
+
+// Name of the bracket in a PvP bracket link, like 3v3 or shuffle-priest-shadow.
+func pvpBracketName(href string) string {
+	i := strings.Index(href, "/pvp-bracket/")
+	if i < 0 {
+		return ""
+	}
+	name := href[i+len("/pvp-bracket/"):]
+	if q := strings.Index(name, "?"); q >= 0 {
+		name = name[:q]
+	}
+	return name
+}
+
+// Blizzard's slug for a guild name: lower case, spaces as hyphens and no apostrophes.
+func nameSlug(name string) string {
+	slug := strings.ToLower(strings.TrimSpace(name))
+	slug = strings.ReplaceAll(slug, "'", "")
+	return strings.ReplaceAll(slug, " ", "-")
+}
+
+// What Blizzard leaves out of realm slugs, and the accented letters it replaces.
+var realmSlugReplacer = strings.NewReplacer(
+	"'", "", "’", "", "-", "", "(", "", ")", "", ".", "",
+	"à", "a", "á", "a", "â", "a", "ã", "a", "ä", "a", "å", "a", "ç", "c",
+	"è", "e", "é", "e", "ê", "e", "ë", "e", "ì", "i", "í", "i", "î", "i", "ï", "i", "ñ", "n",
+	"ò", "o", "ó", "o", "ô", "o", "õ", "o", "ö", "o", "ø", "o", "ù", "u", "ú", "u", "û", "u", "ü", "u",
+	"ý", "y", "ÿ", "y", "ß", "ss",
+)
+
+// Blizzard's slug for a realm name: lower case without accents, apostrophes, hyphens or parentheses and words
+// joined with hyphens, so "Kael'thas" is kaelthas, "Azjol-Nerub" is azjolnerub and "Aggra (Português)" is
+// aggra-portugues. Realms with names in other alphabets have slugs that can't be worked out, those come from
+// the realms table.
+func realmSlug(name string) string {
+	slug := realmSlugReplacer.Replace(strings.ToLower(name))
+	return strings.Join(strings.Fields(slug), "-")
+}
+
+const defaultLocale = "en_US"
+
+// Retry settings for throttled and failed requests.
+const (
+	maxAttempts    = 5
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+)
+
+// How long before the token expires that it gets refreshed. Tokens are good for a day so this is just to
+// make sure a request doesn't go out with a token that expires on the way.
+const tokenRefreshMargin = 5 * time.Minute
+
+// Create a client for a region and get its first token. If httpClient is nil resty's default client is used.
+func NewBlizzard(ctx context.Context, region Region, clientId string, clientSecret string, locale string, httpClient *resty.Client) (*BlizzardHttp, error) {
+	if locale == "" {
+		locale = defaultLocale
+	}
+
+	blizzardHttp := &BlizzardHttp{Region: region, ClientId: clientId, ClientSecret: clientSecret, Locale: locale, HttpClient: httpClient}
+	err := blizzardHttp.refreshToken(ctx)
 	if err != nil {
 		return nil, err
 	}
+	return blizzardHttp, nil
+}
+
+// Get a new client credentials token and record when it expires. The caller must hold tokenMutex, except
+// in NewBlizzard where nothing else can see the client yet.
+func (blizzard *BlizzardHttp) refreshToken(ctx context.Context) error {
+	url := blizzard.Region.OAuthUrl
+	resp, err := blizzard.newRequest().SetContext(ctx).SetBasicAuth(blizzard.ClientId, blizzard.ClientSecret).SetQueryParam("grant_type", "client_credentials").Get(url)
+	if err != nil {
+		return err
+	}
 
 	body := resp.String()
 
 	if resp.StatusCode() != 200 {
 		errorDescription := gjson.Get(body, "error_description").String()
-		return nil, errors.New(fmt.Sprintf("Could not get auth token: %s", errorDescription))
+		return errors.New(fmt.Sprintf("Could not get auth token: %s", errorDescription))
 	}
 
-	accessToken := gjson.Get(body, "access_token").String()
+	blizzard.AccessToken = gjson.Get(body, "access_token").String()
+	expiresIn := time.Duration(gjson.Get(body, "expires_in").Int()) * time.Second
+	blizzard.TokenExpiry = time.Now().Add(expiresIn)
+	log.Debugf("Got new Blizzard token, expires at %v", blizzard.TokenExpiry)
+	return nil
+}
 
-	blizzardHttp := &BlizzardHttp{ClientId: clientId, ClientSecret: clientSecret, AccessToken: accessToken}
-	return blizzardHttp, nil
+// Start a request on the client's HttpClient, or on resty's default client if it doesn't have one.
+func (blizzard *BlizzardHttp) newRequest() *resty.Request {
+	if blizzard.HttpClient != nil {
+		return blizzard.HttpClient.R()
+	}
+	return resty.R()
+}
+
+// Get a usable access token, refreshing it first if it's missing or about to expire.
+func (blizzard *BlizzardHttp) token(ctx context.Context) (string, error) {
+	blizzard.tokenMutex.Lock()
+	defer blizzard.tokenMutex.Unlock()
+
+	if blizzard.AccessToken == "" || time.Now().Add(tokenRefreshMargin).After(blizzard.TokenExpiry) {
+		err := blizzard.refreshToken(ctx)
+		if err != nil {
+			return "", err
+		}
+	}
+	return blizzard.AccessToken, nil
 }
 
-func (blizzard *BlizzardHttp) GetToon(toon *ToonDto) error {
-	url := fmt.Sprintf("https://%s.api.blizzard.com/wow/character/%s/%s", toon.Region, toon.Realm, toon.Name)
+// Throw away a token that Blizzard rejected so the next call to token() gets a new one. If another goroutine
+// already replaced it then there is nothing to do, this keeps a burst of 401s from refreshing over and over.
+func (blizzard *BlizzardHttp) invalidateToken(rejected string) {
+	blizzard.tokenMutex.Lock()
+	defer blizzard.tokenMutex.Unlock()
+
+	if blizzard.AccessToken == rejected {
+		blizzard.AccessToken = ""
+	}
+}
+
+// Error from a request that didn't get a usable response, either because of a status code or because the
+// request itself failed. Attempts is how many times it was tried before giving up.
+type RequestError struct {
+	Url        string
+	StatusCode int
+	Attempts   int
+	Err        error
+}
+
+func (e *RequestError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("request to %s failed after %d attempts: %v", e.Url, e.Attempts, e.Err)
+	}
+	return fmt.Sprintf("request to %s failed with status code %d after %d attempts", e.Url, e.StatusCode, e.Attempts)
+}
+
+// Get a document from the Blizzard API. The namespace is something like "profile-us" or "static-us" and
+// tells Blizzard which set of data the request is for.
+func (blizzard *BlizzardHttp) getJson(ctx context.Context, url string, namespace string) (string, error) {
+	body, _, err := blizzard.fetch(ctx, url, namespace, true)
+	return body, err
+}
+
+// Get a document, going through the cache if there is one. When conditional is set and the document is
+// cached the request is sent with the cached validators, and if Blizzard answers 304 the cached body is
+// returned with notModified set. When offline the cache is all there is.
+func (blizzard *BlizzardHttp) fetch(ctx context.Context, url string, namespace string, conditional bool) (body string, notModified bool, err error) {
+	key := cacheKey(url, namespace, blizzard.Locale)
+
+	var cached *CacheEntry
+	if blizzard.Cache != nil {
+		cached, err = blizzard.Cache.Get(key)
+		if err != nil {
+			log.Warnf("Could not read cache entry for %s: %v", url, err)
+		}
+	}
+
+	if blizzard.Offline {
+		if cached == nil {
+			return "", false, fmt.Errorf("%s is not cached: %w", url, ErrOffline)
+		}
+		return cached.Body, false, nil
+	}
 
-	resp, err := resty.R().SetAuthToken(blizzard.AccessToken).SetHeader("Accept", "application/json").Get(url)
+	headers := map[string]string{}
+	if conditional && cached != nil {
+		if cached.ETag != "" {
+			headers["If-None-Match"] = cached.ETag
+		}
+		if cached.LastModified != "" {
+			headers["If-Modified-Since"] = cached.LastModified
+		}
+	}
 
+	resp, attempts, err := blizzard.request(ctx, url, namespace, headers)
 	if err != nil {
-		return err
+		return "", false, err
+	}
+
+	if resp.StatusCode() == 304 && cached != nil {
+		return cached.Body, true, nil
+	}
+
+	if resp.StatusCode() == 404 {
+		return "", false, ErrNotFound
 	}
 
 	if resp.StatusCode() != 200 {
-		return errors.New("could not find character, status code not 200")
+		return "", false, &RequestError{Url: url, StatusCode: resp.StatusCode(), Attempts: attempts}
 	}
 
-	body := resp.String()
+	body = resp.String()
+	if blizzard.Cache != nil {
+		err = blizzard.Cache.Put(key, &CacheEntry{
+			Url:          url,
+			ETag:         resp.Header().Get("ETag"),
+			LastModified: resp.Header().Get("Last-Modified"),
+			Body:         body,
+			FetchedAt:    time.Now(),
+		})
+		if err != nil {
+			log.Warnf("Could not write cache entry for %s: %v", url, err)
+		}
+	}
+	return body, false, nil
+}
+
+// Send a request, handling the retries. If Blizzard rejects the token the request is tried once more with a
+// new one. Throttled requests, server errors and failed connections are retried with backoff up to
+// maxAttempts times. Whatever response came back last is returned along with how many attempts it took, the
+// error is only set when no response could be had at all.
+func (blizzard *BlizzardHttp) request(ctx context.Context, url string, namespace string, headers map[string]string) (*resty.Response, int, error) {
+	var resp *resty.Response
+	var err error
+	var attempts int
+	tokenRetried := false
+
+	for {
+		attempts++
+		resp, err = blizzard.get(ctx, url, namespace, headers)
+
+		if err == nil && resp.StatusCode() == 401 && !tokenRetried {
+			log.Debugf("Token rejected for %s, refreshing and trying again", url)
+			tokenRetried = true
+			attempts--
+			continue
+		}
+
+		if ctx.Err() != nil || !shouldRetry(resp, err) || attempts >= maxAttempts {
+			break
+		}
+
+		wait := retryDelay(attempts, resp)
+		log.WithFields(log.Fields{"url": url, "attempt": attempts, "wait": wait}).Debug("Retrying Blizzard request")
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, attempts, &RequestError{Url: url, Attempts: attempts, Err: ctx.Err()}
+		}
+	}
+
+	if err != nil {
+		return nil, attempts, &RequestError{Url: url, Attempts: attempts, Err: err}
+	}
+	return resp, attempts, nil
+}
+
+// Do a single GET with the current token. A 401 invalidates the token that was used.
+func (blizzard *BlizzardHttp) get(ctx context.Context, url string, namespace string, headers map[string]string) (*resty.Response, error) {
+	accessToken, err := blizzard.token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if blizzard.Limiter != nil {
+		err = blizzard.Limiter.Wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := blizzard.newRequest().SetContext(ctx).SetQueryParams(map[string]string{
+		"namespace": namespace,
+		"locale":    blizzard.Locale,
+	}).SetHeaders(headers).SetAuthToken(accessToken).SetHeader("Accept", "application/json").Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode() == 401 {
+		blizzard.invalidateToken(accessToken)
+	}
+	return resp, nil
+}
+
+// Connection errors, throttling and server errors are worth another try, anything else won't change.
+func shouldRetry(resp *resty.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode() == 429 || resp.StatusCode() >= 500
+}
+
+// How long to wait before the next attempt. Blizzard's Retry-After is used when it sends one, up to
+// retryMaxDelay, otherwise it's exponential backoff with jitter so that a bunch of toons that failed together
+// don't all come back together.
+func retryDelay(attempt int, resp *resty.Response) time.Duration {
+	if resp != nil {
+		if wait, ok := parseRetryAfter(resp.Header().Get("Retry-After")); ok {
+			if wait > retryMaxDelay {
+				return retryMaxDelay
+			}
+			return wait
+		}
+	}
+
+	backoff := retryBaseDelay << uint(attempt-1)
+	if backoff > retryMaxDelay || backoff <= 0 {
+		backoff = retryMaxDelay
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
 
-	toon.ClassID = gjson.Get(body, "class").Int()
-	toon.RaceID = gjson.Get(body, "race").Int()
-	toon.Gender = gjson.Get(body, "gender").Int()
+// Retry-After is either a number of seconds or an HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(value); err == nil {
+		wait := time.Until(t)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
+
+// Full URL for an API path on this region's host.
+func (blizzard *BlizzardHttp) apiUrl(path string) string {
+	return "https://" + blizzard.Region.ApiHost + path
+}
+
+// Namespace for this region, kind is "profile", "static" or "dynamic".
+func (blizzard *BlizzardHttp) namespace(kind string) string {
+	return kind + "-" + blizzard.Region.Name
+}
+
+// Base URL of the Profile API for a character. The API wants the realm slug and the name in lower case.
+func (blizzard *BlizzardHttp) characterUrl(realm string, name string) string {
+	return blizzard.apiUrl(fmt.Sprintf("/profile/wow/character/%s/%s", realmSlug(realm), strings.ToLower(name)))
+}
+
+func (blizzard *BlizzardHttp) GetToon(ctx context.Context, toon *ToonDto) error {
+	body, err := blizzard.getJson(ctx, blizzard.characterUrl(toon.Realm, toon.Name), blizzard.namespace("profile"))
+	if err == ErrNotFound {
+		return fmt.Errorf("no character %v on %v in %v: %w", toon.Name, toon.Realm, blizzard.Region.Name, ErrNotFound)
+	}
+	if err != nil {
+		return err
+	}
+
+	toon.ClassID = gjson.Get(body, "character_class.id").Int()
+	toon.RaceID = gjson.Get(body, "race.id").Int()
+	toon.Gender = genderId(gjson.Get(body, "gender.type").String())
 	toon.Name = gjson.Get(body, "name").String()
 
 	return nil
 }
 
-func (blizzard *BlizzardHttp) GetClasses() ([]ToonClass, error) {
-	resp, err := resty.R().SetAuthToken(blizzard.AccessToken).SetHeader("Accept", "application/json").Get("https://us.api.blizzard.com/wow/data/character/classes")
+// The Community API used 0 for male and 1 for female, the Profile API uses a type string. Keep storing the
+// number so the existing rows still mean the same thing.
+func genderId(genderType string) int64 {
+	if genderType == "FEMALE" {
+		return 1
+	}
+	return 0
+}
+
+// The Game Data API dropped the mask that the Community API returned, but it was always just a bit
+// for each ID so compute it the same way.
+func idMask(id int64) int64 {
+	return 1 << uint(id-1)
+}
+
+func (blizzard *BlizzardHttp) GetClasses(ctx context.Context) ([]ToonClass, error) {
+	respJson, err := blizzard.getJson(ctx, blizzard.apiUrl("/data/wow/playable-class/index"), blizzard.namespace("static"))
 	if err != nil {
 		return nil, err
 	}
-	respJson := resp.String()
 	result := gjson.Get(respJson, "classes")
 	var classes []ToonClass
 	for _, r := range result.Array() {
-		id := gjson.Get(r.String(), "id").Int()
-		mask := gjson.Get(r.String(), "mask").Int()
-		powerType := gjson.Get(r.String(), "powerType").String()
-		name := gjson.Get(r.String(), "name").String()
+		id := r.Get("id").Int()
+		name := r.Get("name").String()
+
+		// Power type isn't part of the index, it's only on the class itself.
+		classJson, err := blizzard.getJson(ctx, blizzard.apiUrl(fmt.Sprintf("/data/wow/playable-class/%d", id)), blizzard.namespace("static"))
+		if err != nil {
+			return nil, err
+		}
+		powerType := gjson.Get(classJson, "power_type.name").String()
+
 		tmpClass := ToonClass{
 			ID:        id,
-			Mask:      mask,
+			Mask:      idMask(id),
 			PowerType: powerType,
 			Name:      name,
 		}
@@ -89,39 +483,108 @@ func (blizzard *BlizzardHttp) GetClasses() ([]ToonClass, error) {
 	return classes, nil
 }
 
-func (blizzard *BlizzardHttp) GetToonJson(toon Toon) (string, error) {
-	url := fmt.Sprintf("https://%s.api.blizzard.com/wow/character/%s/%s", toon.Region, toon.Realm, toon.Name)
-	resp, err := resty.R().SetQueryParams(map[string]string{
-		"fields": "statistics,items,pets,mounts",
-	}).SetAuthToken(blizzard.AccessToken).SetHeader("Accept", "application/json").Get(url)
+// Get the character profile along with the documents in profileDocuments and combine them into one JSON
+// document. The profile fields are at the top level and each other document is under its key, the PvP
+// brackets are under pvp_brackets by bracket name.
+// If there is a cache and Blizzard says the profile hasn't changed, a *NotModifiedError is returned
+// without fetching the other documents.
+func (blizzard *BlizzardHttp) GetToonJson(ctx context.Context, toon Toon) (string, error) {
+	url := blizzard.characterUrl(toon.Realm, toon.Name)
+	namespace := blizzard.namespace("profile")
+	toonKey := cacheKey("toon", url, namespace, blizzard.Locale)
+
+	profile, notModified, err := blizzard.fetch(ctx, url, namespace, true)
+	if err != nil {
+		return "", err
+	}
+
+	if notModified {
+		entry, err := blizzard.Cache.Get(toonKey)
+		if err == nil && entry != nil {
+			return "", &NotModifiedError{Json: entry.Body}
+		}
+		// The combined document never got saved, carry on and build it from the cached profile.
+	}
+
+	var combined map[string]json.RawMessage
+	err = json.Unmarshal([]byte(profile), &combined)
+	if err != nil {
+		return "", err
+	}
+
+	for _, d := range profileDocuments {
+		doc, err := blizzard.getJson(ctx, url+d.Path, namespace)
+		if err == ErrNotFound {
+			// Not every character has every document, pvp-summary for instance is missing for low level toons.
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		combined[d.Key] = json.RawMessage(doc)
+	}
+
+	// The brackets the character has played are links in the PvP summary, solo shuffle has one for each spec.
+	brackets := make(map[string]json.RawMessage)
+	for _, href := range gjson.GetBytes(combined["pvp_summary"], "brackets.#.href").Array() {
+		name := pvpBracketName(href.String())
+		if name == "" {
+			continue
+		}
+		doc, err := blizzard.getJson(ctx, url+"/pvp-bracket/"+name, namespace)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		brackets[name] = json.RawMessage(doc)
+	}
+	if len(brackets) > 0 {
+		combined["pvp_brackets"], err = json.Marshal(brackets)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	myJson, err := json.Marshal(combined)
 	if err != nil {
 		return "", err
 	}
 
-	myJson := resp.String()
-	return myJson, nil
+	if blizzard.Cache != nil && !blizzard.Offline {
+		err = blizzard.Cache.Put(toonKey, &CacheEntry{Url: url, Body: string(myJson), FetchedAt: time.Now()})
+		if err != nil {
+			log.Warnf("Could not write cache entry for %s: %v", toon.Name, err)
+		}
+	}
+	return string(myJson), nil
 }
 
-func (blizzard *BlizzardHttp) GetRaces() ([]Race, error) {
-	resp, err := resty.R().SetAuthToken(blizzard.AccessToken).SetHeader("Accept", "application/json").Get("https://us.api.blizzard.com/wow/data/character/races")
+func (blizzard *BlizzardHttp) GetRaces(ctx context.Context) ([]Race, error) {
+	respJson, err := blizzard.getJson(ctx, blizzard.apiUrl("/data/wow/playable-race/index"), blizzard.namespace("static"))
 	if err != nil {
 		return nil, err
 	}
 
-	respJson := resp.String()
 	result := gjson.Get(respJson, "races")
 	var races []Race
 
 	for _, r := range result.Array() {
-		id := gjson.Get(r.String(), "id").Int()
-		mask := gjson.Get(r.String(), "mask").Int()
-		side := gjson.Get(r.String(), "side").String()
-		name := gjson.Get(r.String(), "name").String()
+		id := r.Get("id").Int()
+		name := r.Get("name").String()
+
+		// Faction isn't part of the index, it's only on the race itself.
+		raceJson, err := blizzard.getJson(ctx, blizzard.apiUrl(fmt.Sprintf("/data/wow/playable-race/%d", id)), blizzard.namespace("static"))
+		if err != nil {
+			return nil, err
+		}
+		side := strings.ToLower(gjson.Get(raceJson, "faction.type").String())
 
 		race := Race{
 			ID:   id,
 			Name: name,
-			Mask: mask,
+			Mask: idMask(id),
 			Side: side,
 		}
 		races = append(races, race)
@@ -130,3 +593,140 @@ func (blizzard *BlizzardHttp) GetRaces() ([]Race, error) {
 	return races, nil
 }
 
+// Get the character's achievements document, which has every achievement the character has made progress on
+// with its criteria and, once done, when it was completed.
+func (blizzard *BlizzardHttp) GetAchievements(ctx context.Context, toon Toon) (string, error) {
+	return blizzard.getJson(ctx, blizzard.characterUrl(toon.Realm, toon.Name)+"/achievements", blizzard.namespace("profile"))
+}
+
+// Get the name and category of every achievement. The character document doesn't have the categories, they
+// come from walking the achievement categories.
+func (blizzard *BlizzardHttp) GetAchievementDefinitions(ctx context.Context) ([]AchievementDefinition, error) {
+	respJson, err := blizzard.getJson(ctx, blizzard.apiUrl("/data/wow/achievement-category/index"), blizzard.namespace("static"))
+	if err != nil {
+		return nil, err
+	}
+
+	var definitions []AchievementDefinition
+	for _, c := range gjson.Get(respJson, "categories").Array() {
+		categoryJson, err := blizzard.getJson(ctx, blizzard.apiUrl(fmt.Sprintf("/data/wow/achievement-category/%d", c.Get("id").Int())), blizzard.namespace("static"))
+		if err != nil {
+			return nil, err
+		}
+		category := gjson.Get(categoryJson, "name").String()
+		if parent := gjson.Get(categoryJson, "parent_category.name"); parent.Exists() {
+			category = parent.String() + "/" + category
+		}
+
+		for _, a := range gjson.Get(categoryJson, "achievements").Array() {
+			definitions = append(definitions, AchievementDefinition{
+				ID:           a.Get("id").Int(),
+				Name:         a.Get("name").String(),
+				CategoryID:   gjson.Get(categoryJson, "id").Int(),
+				CategoryPath: category,
+			})
+		}
+	}
+	return definitions, nil
+}
+
+// Get the character's Mythic+ profile, which has the current rating and this week's best runs, with the
+// latest season's document added under current_season for the best run in each dungeon. Characters that
+// have never done a keystone get ErrNotFound.
+func (blizzard *BlizzardHttp) GetMythicKeystoneProfile(ctx context.Context, toon Toon) (string, error) {
+	url := blizzard.characterUrl(toon.Realm, toon.Name) + "/mythic-keystone-profile"
+	namespace := blizzard.namespace("profile")
+	profile, err := blizzard.getJson(ctx, url, namespace)
+	if err != nil {
+		return "", err
+	}
+
+	var season int64
+	for _, s := range gjson.Get(profile, "seasons.#.id").Array() {
+		if s.Int() > season {
+			season = s.Int()
+		}
+	}
+	if season == 0 {
+		return profile, nil
+	}
+
+	var combined map[string]json.RawMessage
+	err = json.Unmarshal([]byte(profile), &combined)
+	if err != nil {
+		return "", err
+	}
+	doc, err := blizzard.getJson(ctx, fmt.Sprintf("%s/season/%d", url, season), namespace)
+	if err == ErrNotFound {
+		return profile, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	combined["current_season"] = json.RawMessage(doc)
+
+	myJson, err := json.Marshal(combined)
+	if err != nil {
+		return "", err
+	}
+	return string(myJson), nil
+}
+
+// Get the character's raid encounters document, which has the bosses it has killed on each difficulty of
+// every raid, grouped by expansion and instance.
+func (blizzard *BlizzardHttp) GetRaidEncounters(ctx context.Context, toon Toon) (string, error) {
+	return blizzard.getJson(ctx, blizzard.characterUrl(toon.Realm, toon.Name)+"/encounters/raids", blizzard.namespace("profile"))
+}
+
+// Get a mount from the Game Data API, which has where it comes from and the faction that can use it.
+func (blizzard *BlizzardHttp) GetMount(ctx context.Context, id int64) (string, error) {
+	return blizzard.getJson(ctx, blizzard.apiUrl(fmt.Sprintf("/data/wow/mount/%d", id)), blizzard.namespace("static"))
+}
+
+// Get a guild's roster, which has every member's name, realm, level, class, race and rank.
+func (blizzard *BlizzardHttp) GetGuildRoster(ctx context.Context, guild Guild) (string, error) {
+	url := blizzard.apiUrl(fmt.Sprintf("/data/wow/guild/%s/%s/roster", realmSlug(guild.Realm), nameSlug(guild.Name)))
+	return blizzard.getJson(ctx, url, blizzard.namespace("profile"))
+}
+
+// Get every realm in the region, which has to be the client's own. The realm index only has names and slugs,
+// so they come from the connected realms, which also have the locale and timezone.
+func (blizzard *BlizzardHttp) GetRealms(ctx context.Context, region string) ([]Realm, error) {
+	if !strings.EqualFold(region, blizzard.Region.Name) {
+		return nil, fmt.Errorf("the %v client can't get the realms in %q", blizzard.Region.Name, region)
+	}
+	respJson, err := blizzard.getJson(ctx, blizzard.apiUrl("/data/wow/connected-realm/index"), blizzard.namespace("dynamic"))
+	if err != nil {
+		return nil, err
+	}
+
+	var realms []Realm
+	for _, c := range gjson.Get(respJson, "connected_realms.#.href").Array() {
+		// The index only links to each connected realm, the ID is the last part of the link's path.
+		link, err := url.Parse(c.String())
+		if err != nil {
+			return nil, err
+		}
+		id, err := strconv.ParseInt(path.Base(link.Path), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("connected realm link %q: %v", c.String(), err)
+		}
+
+		connectedJson, err := blizzard.getJson(ctx, blizzard.apiUrl(fmt.Sprintf("/data/wow/connected-realm/%d", id)), blizzard.namespace("dynamic"))
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range gjson.Get(connectedJson, "realms").Array() {
+			realms = append(realms, Realm{
+				Region:           blizzard.Region.Name,
+				RealmID:          r.Get("id").Int(),
+				Slug:             r.Get("slug").String(),
+				Name:             r.Get("name").String(),
+				Locale:           r.Get("locale").String(),
+				Timezone:         r.Get("timezone").String(),
+				ConnectedRealmID: id,
+			})
+		}
+	}
+	return realms, nil
+}
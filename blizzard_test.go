@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"gopkg.in/resty.v1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Fake Blizzard API backed by httptest.Server. It serves a token, a few classes, races and achievement
+// categories and the character in test-json-profile.json, split back up into the documents GetToonJson
+// fetches, with its achievements from test-json-achievements.json, its Mythic+ profile and season from
+// test-json-mythic-keystone.json and its raid encounters from test-json-raid-encounters.json. Its guild's
+// roster is test-json-guild-roster.json and the realms of every region are in test-json-connected-realms.json.
+type fakeBlizzard struct {
+	server    *httptest.Server
+	documents map[string]string
+}
+
+const fakeToken = "fake-token"
+
+var fakeClasses = map[int64]string{1: "Warrior", 2: "Paladin", 3: "Hunter", 4: "Rogue", 5: "Priest", 6: "Death Knight",
+	7: "Shaman", 8: "Mage", 9: "Warlock", 10: "Monk", 11: "Druid", 12: "Demon Hunter"}
+var fakeRaces = map[int64]string{1: "Human", 2: "Orc", 29: "Void Elf"}
+
+// Achievement categories by ID, the Battle for Azeroth one is a child of Quests.
+var fakeAchievementCategories = map[int64]string{
+	92:    `{"id":92,"name":"General","achievements":[{"id":6,"name":"Level 10"},{"id":7,"name":"Level 20"}]}`,
+	96:    `{"id":96,"name":"Quests","achievements":[],"subcategories":[{"id":15164,"name":"Battle for Azeroth"}]}`,
+	15164: `{"id":15164,"name":"Battle for Azeroth","parent_category":{"id":96,"name":"Quests"},"achievements":[{"id":12593,"name":"Loremaster of Kul Tiras"},{"id":12479,"name":"Zandalar Forever!"}]}`,
+}
+
+// Mounts by ID, the ones in test-json-profile.json except Ivory Raptor.
+var fakeMounts = map[int64]string{
+	6:    `{"id":6,"name":"Brown Horse","source":{"type":"VENDOR","name":"Vendor"},"faction":{"type":"ALLIANCE","name":"Alliance"}}`,
+	363:  `{"id":363,"name":"Invincible","source":{"type":"DROP","name":"Drop"}}`,
+	1025: `{"id":1025,"name":"The Hivemind","source":{"type":"ACHIEVEMENT","name":"Achievement"}}`,
+}
+
+func newFakeBlizzard(t *testing.T) *fakeBlizzard {
+	jsonText, err := ioutil.ReadFile("test-json-profile.json")
+	if err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	}
+
+	var combined map[string]json.RawMessage
+	err = json.Unmarshal(jsonText, &combined)
+	if err != nil {
+		t.Fatalf("Could not parse test-json-profile.json: %v", err)
+	}
+
+	characterPath := "/profile/wow/character/duskwood/borvoh"
+	documents := make(map[string]string)
+	for _, d := range profileDocuments {
+		if doc, ok := combined[d.Key]; ok {
+			documents[characterPath+d.Path] = string(doc)
+			delete(combined, d.Key)
+		}
+	}
+	var brackets map[string]json.RawMessage
+	_ = json.Unmarshal(combined["pvp_brackets"], &brackets)
+	for name, doc := range brackets {
+		documents[characterPath+"/pvp-bracket/"+name] = string(doc)
+	}
+	delete(combined, "pvp_brackets")
+	profile, _ := json.Marshal(combined)
+	documents[characterPath] = string(profile)
+
+	achievements, err := ioutil.ReadFile("test-json-achievements.json")
+	if err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	}
+	documents[characterPath+"/achievements"] = string(achievements)
+
+	mythicText, err := ioutil.ReadFile("test-json-mythic-keystone.json")
+	if err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	}
+	var mythic map[string]json.RawMessage
+	err = json.Unmarshal(mythicText, &mythic)
+	if err != nil {
+		t.Fatalf("Could not parse test-json-mythic-keystone.json: %v", err)
+	}
+	documents[characterPath+"/mythic-keystone-profile/season/3"] = string(mythic["current_season"])
+	delete(mythic, "current_season")
+	mythicProfile, _ := json.Marshal(mythic)
+	documents[characterPath+"/mythic-keystone-profile"] = string(mythicProfile)
+
+	raids, err := ioutil.ReadFile("test-json-raid-encounters.json")
+	if err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	}
+	documents[characterPath+"/encounters/raids"] = string(raids)
+
+	roster, err := ioutil.ReadFile("test-json-guild-roster.json")
+	if err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	}
+	documents["/data/wow/guild/duskwood/hand-of-azeroth/roster"] = string(roster)
+
+	realmsText, err := ioutil.ReadFile("test-json-connected-realms.json")
+	if err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	}
+	var links []string
+	for _, c := range gjson.GetBytes(realmsText, "connected_realms").Array() {
+		path := fmt.Sprintf("/data/wow/connected-realm/%d", c.Get("id").Int())
+		documents[path] = c.Raw
+		links = append(links, fmt.Sprintf(`{"href":"https://us.api.blizzard.com%s?namespace=dynamic-us"}`, path))
+	}
+	documents["/data/wow/connected-realm/index"] = fmt.Sprintf(`{"connected_realms":[%s]}`, strings.Join(links, ","))
+
+	f := &fakeBlizzard{documents: documents}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeBlizzard) Close() {
+	f.server.Close()
+}
+
+func (f *fakeBlizzard) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.URL.Path == "/oauth/token" {
+		_, _ = fmt.Fprintf(w, `{"access_token":"%s","token_type":"bearer","expires_in":86399}`, fakeToken)
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer "+fakeToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var id int64
+	switch {
+	case r.URL.Path == "/data/wow/playable-class/index":
+		_, _ = fmt.Fprint(w, fakeIndex("classes", fakeClasses))
+	case r.URL.Path == "/data/wow/playable-race/index":
+		_, _ = fmt.Fprint(w, fakeIndex("races", fakeRaces))
+	case scan(r.URL.Path, "/data/wow/playable-class/%d", &id):
+		_, _ = fmt.Fprintf(w, `{"id":%d,"name":"%s","power_type":{"name":"Mana","id":0}}`, id, fakeClasses[id])
+	case scan(r.URL.Path, "/data/wow/playable-race/%d", &id):
+		_, _ = fmt.Fprintf(w, `{"id":%d,"name":"%s","faction":{"type":"ALLIANCE","name":"Alliance"}}`, id, fakeRaces[id])
+	case r.URL.Path == "/data/wow/achievement-category/index":
+		names := map[int64]string{92: "General", 96: "Quests", 15164: "Battle for Azeroth"}
+		_, _ = fmt.Fprint(w, fakeIndex("categories", names))
+	case scan(r.URL.Path, "/data/wow/achievement-category/%d", &id):
+		_, _ = fmt.Fprint(w, fakeAchievementCategories[id])
+	case scan(r.URL.Path, "/data/wow/mount/%d", &id) && fakeMounts[id] != "":
+		_, _ = fmt.Fprint(w, fakeMounts[id])
+	default:
+		doc, ok := f.documents[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = fmt.Fprint(w, doc)
+	}
+}
+
+func scan(path string, format string, id *int64) bool {
+	_, err := fmt.Sscanf(path, format, id)
+	return err == nil
+}
+
+func fakeIndex(key string, names map[int64]string) string {
+	var entries []string
+	for id, name := range names {
+		entries = append(entries, fmt.Sprintf(`{"id":%d,"name":"%s"}`, id, name))
+	}
+	return fmt.Sprintf(`{"%s":[%s]}`, key, strings.Join(entries, ","))
+}
+
+// Transport that sends every request to the fake, whatever host it was meant for.
+func (f *fakeBlizzard) Transport() http.RoundTripper {
+	target, _ := url.Parse(f.server.URL)
+	return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		req = req.Clone(req.Context())
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = target.Host
+		req.Host = target.Host
+		return http.DefaultTransport.RoundTrip(req)
+	})
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (fn roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return fn(req)
+}
+
+// Registry of clients that talk to the fake through transport.
+func newTestBlizzard(t *testing.T, transport http.RoundTripper) *BlizzardRegions {
+	blizzard := NewBlizzardRegions("us", "id", "secret", "en_US", nil)
+	blizzard.Transport = transport
+	err := blizzard.Connect(context.Background())
+	if err != nil {
+		t.Fatalf("Could not connect to fake Blizzard: %v", err)
+	}
+	return blizzard
+}
+
+func TestGetToon(t *testing.T) {
+	fake := newFakeBlizzard(t)
+	defer fake.Close()
+	blizzard := newTestBlizzard(t, fake.Transport())
+
+	toon := NewToon("Borvoh", 0, 0, 0, "Duskwood", "us")
+	err := blizzard.GetToon(context.Background(), toon)
+	if err != nil {
+		t.Fatalf("GetToon failed: %v", err)
+	}
+
+	if toon.ClassID != 5 || toon.RaceID != 29 || toon.Gender != 0 {
+		t.Errorf("GetToon incorrect, want class 5 race 29 gender 0 got class %v race %v gender %v", toon.ClassID, toon.RaceID, toon.Gender)
+	}
+
+	missing := NewToon("Nobody", 0, 0, 0, "Duskwood", "us")
+	err = blizzard.GetToon(context.Background(), missing)
+	if err == nil {
+		t.Errorf("GetToon for a missing character should fail")
+	}
+}
+
+func TestGetClassesAndRaces(t *testing.T) {
+	fake := newFakeBlizzard(t)
+	defer fake.Close()
+	blizzard := newTestBlizzard(t, fake.Transport())
+
+	classes, err := blizzard.GetClasses(context.Background())
+	if err != nil {
+		t.Fatalf("GetClasses failed: %v", err)
+	}
+	if len(classes) != len(fakeClasses) {
+		t.Errorf("GetClasses returned %v classes, want %v", len(classes), len(fakeClasses))
+	}
+	for _, c := range classes {
+		if c.Name != fakeClasses[c.ID] || c.PowerType != "Mana" || c.Mask != idMask(c.ID) {
+			t.Errorf("GetClasses returned unexpected class %+v", c)
+		}
+	}
+
+	races, err := blizzard.GetRaces(context.Background())
+	if err != nil {
+		t.Fatalf("GetRaces failed: %v", err)
+	}
+	if len(races) != len(fakeRaces) {
+		t.Errorf("GetRaces returned %v races, want %v", len(races), len(fakeRaces))
+	}
+	for _, r := range races {
+		if r.Name != fakeRaces[r.ID] || r.Side != "alliance" {
+			t.Errorf("GetRaces returned unexpected race %+v", r)
+		}
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wowstats-fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fake := newFakeBlizzard(t)
+	recorder := newTestBlizzard(t, &RecordingTransport{Dir: dir, Next: fake.Transport()})
+	toon := Toon{Name: "Borvoh", Realm: "Duskwood", Region: "us"}
+	recorded, err := recorder.GetToonJson(context.Background(), toon)
+	if err != nil {
+		t.Fatalf("GetToonJson while recording failed: %v", err)
+	}
+	fake.Close()
+
+	fixtures, _ := ioutil.ReadDir(dir)
+	for _, f := range fixtures {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if strings.Contains(string(data), fakeToken) {
+			t.Errorf("Fixture %s contains the access token", f.Name())
+		}
+	}
+
+	replayer := newTestBlizzard(t, &ReplayTransport{Dir: dir})
+	replayed, err := replayer.GetToonJson(context.Background(), toon)
+	if err != nil {
+		t.Fatalf("GetToonJson while replaying failed: %v", err)
+	}
+
+	if replayed != recorded {
+		t.Errorf("Replayed document differs from the recorded one")
+	}
+
+	stats := ParseStatsFromJson(replayed)
+	if stats.AchievementPoints != 21835 || stats.ItemLevel != 415 {
+		t.Errorf("Replayed stats incorrect, got achievement points %v item level %v", stats.AchievementPoints, stats.ItemLevel)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	retryAfter := func(value string) *resty.Response {
+		return &resty.Response{RawResponse: &http.Response{Header: http.Header{"Retry-After": []string{value}}}}
+	}
+
+	if wait := retryDelay(1, retryAfter("5")); wait != 5*time.Second {
+		t.Errorf("Retry-After should be used as is, got %v", wait)
+	}
+	// A Retry-After of an hour would hold up the whole run, it's capped like the backoff.
+	if wait := retryDelay(1, retryAfter("3600")); wait != retryMaxDelay {
+		t.Errorf("Retry-After should be capped at %v, got %v", retryMaxDelay, wait)
+	}
+	later := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if wait := retryDelay(1, retryAfter(later)); wait != retryMaxDelay {
+		t.Errorf("A Retry-After date should be capped at %v, got %v", retryMaxDelay, wait)
+	}
+	if wait := retryDelay(20, nil); wait < retryMaxDelay/2 || wait > retryMaxDelay {
+		t.Errorf("Backoff should be capped at %v, got %v", retryMaxDelay, wait)
+	}
+}
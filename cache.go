@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A cached Blizzard response along with the validators Blizzard sent so it can be checked with a conditional
+// request the next time.
+type CacheEntry struct {
+	Url          string
+	ETag         string
+	LastModified string
+	Body         string
+	FetchedAt    time.Time
+}
+
+// Cache of Blizzard responses on disk, one JSON file per entry. Besides saving downloads when nothing has
+// changed this is what lets the client run offline.
+type ResponseCache struct {
+	Dir string
+}
+
+func NewResponseCache(dir string) (*ResponseCache, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &ResponseCache{Dir: dir}, nil
+}
+
+// Key for an entry. The parts are whatever makes the response different, the URL, namespace and locale
+// for an API request.
+func cacheKey(parts ...string) string {
+	hash := sha1.New()
+	for _, p := range parts {
+		hash.Write([]byte(p))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (c *ResponseCache) path(key string) string {
+	return filepath.Join(c.Dir, key+".json")
+}
+
+// Get an entry, returns nil if there isn't one.
+func (c *ResponseCache) Get(key string) (*CacheEntry, error) {
+	data, err := ioutil.ReadFile(c.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entry CacheEntry
+	err = json.Unmarshal(data, &entry)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Save an entry. It's written to a temporary file and renamed so that another worker never reads half of it.
+func (c *ResponseCache) Put(key string, entry *CacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(c.Dir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path(key))
+}
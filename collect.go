@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	defaultConcurrency = 4
+	defaultToonTimeout = 2 * time.Minute
+)
+
+// Get and insert the stats for every toon using a pool of env.config.Concurrency workers. Each toon gets
+// env.config.ToonTimeout to finish. If ctx is cancelled the toons that haven't started are skipped and the
+// ones in flight are cancelled, either way this returns once the workers are done.
+func CollectStats(ctx context.Context, env *Env, blizzard Blizzard, toons []Toon) {
+	workers := env.config.Concurrency
+	if workers <= 0 {
+		workers = defaultConcurrency
+	}
+	timeout := env.config.ToonTimeout
+	if timeout <= 0 {
+		timeout = defaultToonTimeout
+	}
+
+	jobs := make(chan Toon)
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range jobs {
+				toonCtx, cancel := context.WithTimeout(ctx, timeout)
+				GetAndInsertToonStats(toonCtx, t, env, blizzard)
+				cancel()
+			}
+		}()
+	}
+
+	skipped := 0
+feed:
+	for i, t := range toons {
+		select {
+		case jobs <- t:
+		case <-ctx.Done():
+			skipped = len(toons) - i
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if skipped > 0 {
+		log.WithField("skipped", skipped).Warn("Stats run cancelled before all toons were started")
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Exit codes, so that scripts can tell why a command failed. Anything not covered is exitFailure.
+const (
+	exitFailure      = 1
+	exitUsage        = 2
+	exitNotFound     = 3
+	exitConflict     = 4
+	exitNotConfirmed = 5
+)
+
+// The exit code for an error from a command.
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, ErrUnknownRegion), errors.Is(err, ErrUnknownRealm):
+		return exitUsage
+	case errors.Is(err, ErrNoToon), errors.Is(err, ErrNotFound):
+		return exitNotFound
+	case errors.Is(err, ErrAmbiguousToon), errors.Is(err, ErrToonExists):
+		return exitConflict
+	case errors.Is(err, ErrNotConfirmed):
+		return exitNotConfirmed
+	}
+	return exitFailure
+}
+
+// The toon subcommands. Everything they need comes from flags and arguments rather than questions, so they can
+// be scripted.
+type ToonCommand struct {
+	Json       bool              `long:"json" description:"Write the output as JSON"`
+	Add        ToonAddCommand    `command:"add" description:"Look a character up on Blizzard and add it as a toon"`
+	List       struct{}          `command:"list" description:"List the toons"`
+	Remove     ToonNameCommand   `command:"remove" description:"Remove a toon, its history stays in the database"`
+	Deactivate ToonNameCommand   `command:"deactivate" description:"Stop fetching a toon"`
+	Activate   ToonNameCommand   `command:"activate" description:"Fetch a deactivated toon again"`
+	Rename     ToonRenameCommand `command:"rename" description:"Change a toon's name, and realm, after a name change or transfer"`
+	Import     ToonImportCommand `command:"import" description:"Add the characters in a CSV file of name, realm and region"`
+}
+
+type ToonAddCommand struct {
+	Name   string `long:"name" required:"yes" description:"Character name"`
+	Realm  string `long:"realm" required:"yes" description:"Character realm"`
+	Region string `long:"region" description:"Character region, the configured region unless given"`
+	Yes    bool   `long:"yes" short:"y" description:"Add without asking to confirm"`
+}
+
+type ToonNameCommand struct {
+	Args struct {
+		Toon string `positional-arg-name:"NAME[-REALM]" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+type ToonRenameCommand struct {
+	Realm string `long:"realm" description:"New realm, the toon's realm unless given"`
+	Args  struct {
+		Toon string `positional-arg-name:"NAME[-REALM]" required:"yes"`
+		Name string `positional-arg-name:"NEW-NAME" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+type ToonImportCommand struct {
+	Args struct {
+		File string `positional-arg-name:"FILE" required:"yes" description:"CSV file, - for stdin"`
+	} `positional-args:"yes"`
+}
+
+// A toon the way the toon commands write it as JSON.
+type ToonJson struct {
+	ID            uint   `json:"id"`
+	Name          string `json:"name"`
+	Realm         string `json:"realm"`
+	Region        string `json:"region"`
+	Race          string `json:"race"`
+	Class         string `json:"class"`
+	Added         string `json:"added"`
+	Active        bool   `json:"active"`
+	InactiveSince string `json:"inactive_since,omitempty"`
+}
+
+// What happened to one row of a CSV import. Result is added, exists or failed.
+type ImportResult struct {
+	Line   int    `json:"line"`
+	Name   string `json:"name"`
+	Realm  string `json:"realm"`
+	Region string `json:"region"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+	err    error
+}
+
+// Run the toon subcommand called name. Add asks for confirmation on in unless --yes is given.
+func RunToonCommand(ctx context.Context, env *Env, blizzard Blizzard, cmd *ToonCommand, name string, in io.Reader, out io.Writer) error {
+	switch name {
+	case "add":
+		return toonAdd(ctx, env, blizzard, cmd, in, out)
+	case "list":
+		return toonList(ctx, env, cmd.Json, out)
+	case "remove":
+		return toonChange(ctx, env, cmd.Remove.Args.Toon, cmd.Json, out, "Removed", func(t *Toon) error {
+			return env.db.RemoveToon(ctx, t.ID)
+		})
+	case "deactivate":
+		return toonChange(ctx, env, cmd.Deactivate.Args.Toon, cmd.Json, out, "Deactivated", func(t *Toon) error {
+			return env.db.SetToonInactive(ctx, InactiveToon{ToonID: t.ID, Since: time.Now()})
+		})
+	case "activate":
+		return toonChange(ctx, env, cmd.Activate.Args.Toon, cmd.Json, out, "Activated", func(t *Toon) error {
+			return env.db.SetToonActive(ctx, t.ID)
+		})
+	case "rename":
+		return toonRename(ctx, env, blizzard, cmd, out)
+	case "import":
+		return toonImport(ctx, env, blizzard, cmd, in, out)
+	}
+	return fmt.Errorf("unknown toon command %q", name)
+}
+
+func toonAdd(ctx context.Context, env *Env, blizzard Blizzard, cmd *ToonCommand, in io.Reader, out io.Writer) error {
+	region := cmd.Add.Region
+	if region == "" {
+		region = env.config.Region
+	}
+	toon, err := lookupToon(ctx, env, blizzard, cmd.Add.Name, cmd.Add.Realm, region, 0)
+	if err != nil {
+		return err
+	}
+	if !cmd.Add.Yes {
+		err = confirmToon(bufio.NewScanner(in), out, toon)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = env.db.InsertToon(ctx, toon)
+	if err != nil {
+		return fmt.Errorf("could not insert toon into database: %v", err)
+	}
+	return writeToon(ctx, env, *toon, cmd.Json, out, "Added")
+}
+
+// Find a toon, change it and write what it is now.
+func toonChange(ctx context.Context, env *Env, name string, asJson bool, out io.Writer, verb string, change func(t *Toon) error) error {
+	toon, err := FindToon(ctx, env, name)
+	if err != nil {
+		return err
+	}
+	err = change(toon)
+	if err != nil {
+		return err
+	}
+	return writeToon(ctx, env, *toon, asJson, out, verb)
+}
+
+// Rename a toon. The new name has to be a character on Blizzard, the race and class are taken from it too in
+// case they changed along with the name. Its archive folder is renamed along with it.
+func toonRename(ctx context.Context, env *Env, blizzard Blizzard, cmd *ToonCommand, out io.Writer) error {
+	toon, err := FindToon(ctx, env, cmd.Rename.Args.Toon)
+	if err != nil {
+		return err
+	}
+	realm := cmd.Rename.Realm
+	if realm == "" {
+		realm = toon.Realm
+	}
+	renamed, err := lookupToon(ctx, env, blizzard, cmd.Rename.Args.Name, realm, toon.Region, toon.ID)
+	if err != nil {
+		return err
+	}
+
+	renamed.Model = toon.Model
+	err = env.db.UpdateToon(ctx, renamed)
+	if err != nil {
+		return fmt.Errorf("could not update toon: %v", err)
+	}
+	if env.config.ArchiveDir != "" {
+		err = renameArchiveFolder(env.config.ArchiveDir, *toon, *renamed)
+		if err != nil {
+			log.WithFields(log.Fields{"toon": renamed.Name}).Warnf("Could not rename the archive folder: %v", err)
+		}
+	}
+	return writeToon(ctx, env, *renamed, cmd.Json, out, fmt.Sprintf("Renamed %v-%v to", toon.Name, toon.Realm))
+}
+
+// Add every character in a CSV file. Each row is a name, a realm and optionally a region, a header row is
+// skipped. A row that fails doesn't stop the rest, characters that are already toons are left as they are.
+// The import only fails when a row did.
+func toonImport(ctx context.Context, env *Env, blizzard Blizzard, cmd *ToonCommand, in io.Reader, out io.Writer) error {
+	file := in
+	if cmd.Import.Args.File != "-" {
+		f, err := os.Open(cmd.Import.Args.File)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		file = f
+	}
+
+	results, err := ImportToons(ctx, env, blizzard, file)
+	if err != nil {
+		return err
+	}
+
+	if cmd.Json {
+		err = writeJson(out, results)
+	} else {
+		w := tabwriter.NewWriter(out, 5, 0, 3, ' ', 0)
+		_, _ = fmt.Fprintln(w, "Line\tName\tRealm\tRegion\tResult\t")
+		for _, r := range results {
+			result := r.Result
+			if r.Error != "" {
+				result += ": " + r.Error
+			}
+			_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t\n", r.Line, r.Name, r.Realm, r.Region, result)
+		}
+		err = w.Flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%v of %v toons could not be added", failed, len(results))
+	}
+	return nil
+}
+
+// Add the characters in CSV read from in, see toonImport.
+func ImportToons(ctx context.Context, env *Env, blizzard Blizzard, in io.Reader) ([]ImportResult, error) {
+	lines := &lineReader{r: bufio.NewReader(in)}
+	reader := csv.NewReader(lines)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var results []ImportResult
+	for first := true; ; first = false {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return results, err
+		}
+		if first && strings.EqualFold(strings.TrimSpace(record[0]), "name") {
+			continue
+		}
+
+		r := ImportResult{Line: lines.recordStart(record), Name: strings.TrimSpace(record[0]), Region: strings.ToLower(env.config.Region)}
+		if len(record) > 1 {
+			r.Realm = strings.TrimSpace(record[1])
+		}
+		if len(record) > 2 && strings.TrimSpace(record[2]) != "" {
+			r.Region = strings.ToLower(strings.TrimSpace(record[2]))
+		}
+
+		var toon *Toon
+		if r.Name == "" || r.Realm == "" {
+			r.err = errors.New("need a name and a realm")
+		} else {
+			toon, r.err = lookupToon(ctx, env, blizzard, r.Name, r.Realm, r.Region, 0)
+		}
+		if r.err == nil {
+			r.err = env.db.InsertToon(ctx, toon)
+		}
+
+		switch {
+		case r.err == nil:
+			r.Result = "added"
+			r.Name, r.Realm = toon.Name, toon.Realm
+		case errors.Is(r.err, ErrToonExists):
+			r.Result, r.err = "exists", nil
+		default:
+			r.Result, r.Error = "failed", r.err.Error()
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// Hands the CSV reader one line at a time so that it has read exactly as far as the record it returned, which
+// gives the line a record started on without csv.Reader.FieldPos.
+type lineReader struct {
+	r       *bufio.Reader
+	lines   int
+	partial bool
+}
+
+func (l *lineReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	var n int
+	for n < len(p) {
+		c, err := l.r.ReadByte()
+		if err != nil && n == 0 {
+			return 0, err
+		}
+		if err != nil {
+			break
+		}
+		p[n] = c
+		n++
+		if c == '\n' {
+			l.lines++
+			break
+		}
+	}
+	l.partial = p[n-1] != '\n'
+	return n, nil
+}
+
+// The line record started on, counting back from the line it ended on by the line breaks in its fields.
+func (l *lineReader) recordStart(record []string) int {
+	end := l.lines
+	if l.partial {
+		end++
+	}
+	for _, field := range record {
+		end -= strings.Count(field, "\n")
+	}
+	return end
+}
+
+// List every toon with whether it's still fetched.
+func toonList(ctx context.Context, env *Env, asJson bool, out io.Writer) error {
+	toons, err := env.db.GetAllToons(ctx)
+	if err != nil {
+		return err
+	}
+	list, err := toonJsons(ctx, env, toons)
+	if err != nil {
+		return err
+	}
+	if asJson {
+		return writeJson(out, list)
+	}
+
+	w := tabwriter.NewWriter(out, 5, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "Name\tRealm\tRegion\tRace\tClass\tAdded\tStatus\t")
+	for _, t := range list {
+		status := "active"
+		if !t.Active {
+			status = "inactive since " + t.InactiveSince
+		}
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t\n", t.Name, t.Realm, t.Region, t.Race, t.Class, t.Added, status)
+	}
+	return w.Flush()
+}
+
+// Write a toon after a command changed it, either as JSON or as a line starting with verb.
+func writeToon(ctx context.Context, env *Env, toon Toon, asJson bool, out io.Writer, verb string) error {
+	if !asJson {
+		_, err := fmt.Fprintf(out, "%v %v-%v (%v)\n", verb, toon.Name, toon.Realm, toon.Region)
+		return err
+	}
+	list, err := toonJsons(ctx, env, []Toon{toon})
+	if err != nil {
+		return err
+	}
+	return writeJson(out, list[0])
+}
+
+// Fill in the race and class names and whether each toon is active.
+func toonJsons(ctx context.Context, env *Env, toons []Toon) ([]ToonJson, error) {
+	inactive, err := env.db.GetInactiveToons(ctx)
+	if err != nil {
+		return nil, err
+	}
+	since := make(map[uint]string)
+	for _, i := range inactive {
+		since[i.ToonID] = i.Since.Format("2006-01-02")
+	}
+
+	races := make(map[int64]string)
+	classes := make(map[int64]string)
+	list := make([]ToonJson, 0, len(toons))
+	for _, t := range toons {
+		if _, ok := races[t.RaceID]; !ok {
+			race, err := env.db.GetRaceById(ctx, t.RaceID)
+			if err == nil {
+				races[t.RaceID] = race.Name
+			}
+		}
+		if _, ok := classes[t.ClassID]; !ok {
+			class, err := env.db.GetToonClassById(ctx, t.ClassID)
+			if err == nil {
+				classes[t.ClassID] = class.Name
+			}
+		}
+
+		_, isInactive := since[t.ID]
+		list = append(list, ToonJson{
+			ID:            t.ID,
+			Name:          t.Name,
+			Realm:         t.Realm,
+			Region:        t.Region,
+			Race:          races[t.RaceID],
+			Class:         classes[t.ClassID],
+			Added:         t.CreatedAt.Local().Format("2006-01-02"),
+			Active:        !isInactive,
+			InactiveSince: since[t.ID],
+		})
+	}
+	return list, nil
+}
+
+func writeJson(out io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
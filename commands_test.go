@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jessevdk/go-flags"
+	"strings"
+	"testing"
+)
+
+func TestParseToonCommands(t *testing.T) {
+	// Parse into a copy of opts so the other tests don't see the options.
+	parsed := opts
+	parse := func(args ...string) (*flags.Parser, error) {
+		parsed = opts
+		parser := flags.NewParser(&parsed, flags.None)
+		parser.SubcommandsOptional = true
+		_, err := parser.ParseArgs(args)
+		return parser, err
+	}
+
+	parser, err := parse("--summary")
+	if err != nil || parser.Active != nil {
+		t.Errorf("Options should parse without a command being active, got %v", err)
+	}
+
+	parser, err = parse("toon", "add", "--name", "borvoh", "--realm", "duskwood", "--region", "eu", "--yes", "--json")
+	if err != nil {
+		t.Fatalf("Parsing toon add failed: %v", err)
+	}
+	if parser.Active.Name != "toon" || parser.Active.Active.Name != "add" {
+		t.Errorf("Want toon add to be active, got %v", parser.Active.Name)
+	}
+	add := parsed.ToonCommand.Add
+	if add.Name != "borvoh" || add.Realm != "duskwood" || add.Region != "eu" || !add.Yes || !parsed.ToonCommand.Json {
+		t.Errorf("toon add options incorrect, got %+v", add)
+	}
+	if parsed.Realm != "" || parsed.Region != "" {
+		t.Errorf("toon add --realm and --region should not set the --add-guild ones, got %q and %q", parsed.Realm, parsed.Region)
+	}
+
+	_, err = parse("toon", "rename", "Borvoh-Duskwood", "Borvoka", "--realm", "Stormrage")
+	if err != nil {
+		t.Fatalf("Parsing toon rename failed: %v", err)
+	}
+	rename := parsed.ToonCommand.Rename
+	if rename.Args.Toon != "Borvoh-Duskwood" || rename.Args.Name != "Borvoka" || rename.Realm != "Stormrage" {
+		t.Errorf("toon rename arguments incorrect, got %+v", rename)
+	}
+
+	_, err = parse("toon", "add", "--name", "borvoh")
+	if flagsErr, ok := err.(*flags.Error); !ok || flagsErr.Type != flags.ErrRequired {
+		t.Errorf("toon add without --realm should fail as required, got %v", err)
+	}
+	_, err = parse("toon")
+	if flagsErr, ok := err.(*flags.Error); !ok || flagsErr.Type != flags.ErrCommandRequired {
+		t.Errorf("toon without a command should fail, got %v", err)
+	}
+}
+
+func TestToonCommands(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeBlizzard(t)
+	defer fake.Close()
+	blizzard := newTestBlizzard(t, fake.Transport())
+	db, env, cleanup := newMigratedEnv(t)
+	defer cleanup()
+	env.config = Config{Region: "us"}
+
+	run := func(cmd ToonCommand, name string, in string) (string, error) {
+		var out bytes.Buffer
+		err := RunToonCommand(ctx, env, blizzard, &cmd, name, strings.NewReader(in), &out)
+		return out.String(), err
+	}
+
+	var add ToonCommand
+	add.Add.Name, add.Add.Realm = "borvoh", "duskwood"
+	_, err := run(add, "add", "n\n")
+	if !errors.Is(err, ErrNotConfirmed) || exitCode(err) != exitNotConfirmed {
+		t.Errorf("Declining should fail with ErrNotConfirmed, got %v", err)
+	}
+	_, err = run(add, "add", "")
+	if !errors.Is(err, ErrNotConfirmed) {
+		t.Errorf("No answer should decline, got %v", err)
+	}
+
+	add.Add.Yes, add.Json = true, true
+	out, err := run(add, "add", "")
+	if err != nil {
+		t.Fatalf("toon add failed: %v", err)
+	}
+	var added ToonJson
+	if err := json.Unmarshal([]byte(out), &added); err != nil {
+		t.Fatalf("toon add --json output is not JSON: %v\n%s", err, out)
+	}
+	if added.Name != "Borvoh" || added.Realm != "Duskwood" || added.Region != "us" || added.Race != "Void Elf" ||
+		added.Class != "Priest" || !added.Active {
+		t.Errorf("Added toon incorrect, got %+v", added)
+	}
+
+	_, err = run(add, "add", "")
+	if !errors.Is(err, ErrToonExists) || exitCode(err) != exitConflict {
+		t.Errorf("Adding Borvoh again should conflict, got %v", err)
+	}
+	add.Add.Name = "nobody"
+	_, err = run(add, "add", "")
+	if exitCode(err) != exitNotFound {
+		t.Errorf("Adding a missing character should exit with %v, got %v: %v", exitNotFound, exitCode(err), err)
+	}
+	add.Add.Region = "xx"
+	_, err = run(add, "add", "")
+	if exitCode(err) != exitUsage {
+		t.Errorf("Adding in an unknown region should exit with %v, got %v: %v", exitUsage, exitCode(err), err)
+	}
+
+	var deactivate ToonCommand
+	deactivate.Deactivate.Args.Toon = "borvoh-duskwood"
+	out, err = run(deactivate, "deactivate", "")
+	if err != nil || out != "Deactivated Borvoh-Duskwood (us)\n" {
+		t.Errorf("toon deactivate incorrect, got %q: %v", out, err)
+	}
+	if names := activeToonNames(t, db); names != "" {
+		t.Errorf("Borvoh should not be fetched any more, got %v", names)
+	}
+
+	list := ToonCommand{Json: true}
+	out, err = run(list, "list", "")
+	if err != nil {
+		t.Fatalf("toon list failed: %v", err)
+	}
+	var toons []ToonJson
+	if err := json.Unmarshal([]byte(out), &toons); err != nil {
+		t.Fatalf("toon list --json output is not JSON: %v\n%s", err, out)
+	}
+	if len(toons) != 1 || toons[0].Active || toons[0].InactiveSince == "" {
+		t.Errorf("Want Borvoh listed as inactive, got %+v", toons)
+	}
+
+	var activate ToonCommand
+	activate.Activate.Args.Toon = "Borvoh"
+	if _, err = run(activate, "activate", ""); err != nil {
+		t.Errorf("toon activate failed: %v", err)
+	}
+	if names := activeToonNames(t, db); names != "Borvoh" {
+		t.Errorf("Borvoh should be fetched again, got %v", names)
+	}
+
+	var remove ToonCommand
+	remove.Remove.Args.Toon = "Borvoh"
+	if _, err = run(remove, "remove", ""); err != nil {
+		t.Errorf("toon remove failed: %v", err)
+	}
+	_, err = run(remove, "remove", "")
+	if !errors.Is(err, ErrNoToon) || exitCode(err) != exitNotFound {
+		t.Errorf("Removing Borvoh twice should not find it, got %v", err)
+	}
+}
+
+func TestToonRename(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeBlizzard(t)
+	defer fake.Close()
+	blizzard := newTestBlizzard(t, fake.Transport())
+	db, env, cleanup := newMigratedEnv(t)
+	defer cleanup()
+
+	old := Toon{Name: "Borvohh", RaceID: 1, ClassID: 1, Realm: "Duskwood", Region: "us"}
+	if err := db.InsertToon(ctx, &old); err != nil {
+		t.Fatal(err)
+	}
+
+	var rename ToonCommand
+	rename.Rename.Args.Toon, rename.Rename.Args.Name = "Borvohh", "borvoh"
+	var out bytes.Buffer
+	err := RunToonCommand(ctx, env, blizzard, &rename, "rename", strings.NewReader(""), &out)
+	if err != nil {
+		t.Fatalf("toon rename failed: %v", err)
+	}
+	if out.String() != "Renamed Borvohh-Duskwood to Borvoh-Duskwood (us)\n" {
+		t.Errorf("toon rename output incorrect, got %q", out.String())
+	}
+
+	renamed, err := db.GetToonById(ctx, int64(old.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renamed.Name != "Borvoh" || renamed.RaceID != 29 || renamed.ClassID != 5 {
+		t.Errorf("Renamed toon incorrect, got %+v", renamed)
+	}
+}
+
+func TestImportToons(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeBlizzard(t)
+	defer fake.Close()
+	blizzard := newTestBlizzard(t, fake.Transport())
+	_, env, cleanup := newMigratedEnv(t)
+	defer cleanup()
+	env.config = Config{Region: "US"}
+
+	csv := "name,realm,region\nborvoh,duskwood,us\nnobody,duskwood\nBorvoh, Duskwood, US\n,duskwood\nthrandor,duskwood,xx\n"
+	results, err := ImportToons(ctx, env, blizzard, strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("ImportToons failed: %v", err)
+	}
+
+	var got []string
+	for _, r := range results {
+		got = append(got, fmt.Sprintf("%v %v %v", r.Line, r.Name, r.Result))
+	}
+	want := "2 Borvoh added, 3 nobody failed, 4 Borvoh exists, 5  failed, 6 thrandor failed"
+	if strings.Join(got, ", ") != want {
+		t.Errorf("Import results incorrect, want %v got %v", want, strings.Join(got, ", "))
+	}
+
+	// Lines are counted from where each record starts, past blank lines and line breaks in quoted fields.
+	results, err = ImportToons(ctx, env, blizzard, strings.NewReader("\"nobody\nelse\",\n\nborvoh,duskwood"))
+	if err != nil || len(results) != 2 || results[0].Line != 1 || results[1].Line != 4 || results[1].Region != "us" {
+		t.Errorf("Import lines incorrect, got %+v, %v", results, err)
+	}
+
+	var cmd ToonCommand
+	cmd.Import.Args.File = "-"
+	var out bytes.Buffer
+	err = RunToonCommand(ctx, env, blizzard, &cmd, "import", strings.NewReader("borvoh,duskwood\n"), &out)
+	if err != nil {
+		t.Errorf("Importing only toons that exist should not fail, got %v", err)
+	}
+	err = RunToonCommand(ctx, env, blizzard, &cmd, "import", strings.NewReader(csv), &out)
+	if err == nil || err.Error() != "3 of 5 toons could not be added" {
+		t.Errorf("Import with failed rows should fail, got %v", err)
+	}
+}
@@ -1,22 +1,83 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"strings"
+	"time"
 )
 
 // Defines database functions.
 type Datastore interface {
-	InsertToon(toon *Toon) error
-	GetToonById(id int64) (*Toon, error)
-	GetAllToons() []Toon
-	InsertStats(stats *Stat) error
-	GetAllToonLatestQuickSummary() ([]Stat, error)
-	InsertRace(race *Race) error
-	GetRaceById(id int64) (*Race, error)
-	InsertToonClass(toonClass *ToonClass) error
-	GetToonClassById(id int64) (*ToonClass, error)
+	InsertToon(ctx context.Context, toon *Toon) error
+	UpdateToon(ctx context.Context, toon *Toon) error
+	RemoveToon(ctx context.Context, toonId uint) error
+	GetToonById(ctx context.Context, id int64) (*Toon, error)
+	GetAllToons(ctx context.Context) ([]Toon, error)
+	GetActiveToons(ctx context.Context) ([]Toon, error)
+	GetInactiveToons(ctx context.Context) ([]InactiveToon, error)
+	SetToonInactive(ctx context.Context, inactive InactiveToon) error
+	SetToonActive(ctx context.Context, toonId uint) error
+	InsertStats(ctx context.Context, stats *Stat) error
+	UpdateStats(ctx context.Context, stats *Stat) error
+	GetLatestStats(ctx context.Context, toonId uint) (*Stat, error)
+	GetStatsForToon(ctx context.Context, toonId uint) ([]Stat, error)
+	GetAllToonLatestQuickSummary(ctx context.Context) ([]Stat, error)
+	InsertRace(ctx context.Context, race *Race) error
+	GetRaceById(ctx context.Context, id int64) (*Race, error)
+	InsertToonClass(ctx context.Context, toonClass *ToonClass) error
+	SaveMetric(ctx context.Context, metric *Metric) error
+	SaveStatValues(ctx context.Context, values []StatValue) error
+	SaveStatistics(ctx context.Context, definitions []StatisticDefinition, values []StatisticValue) error
+	GetStatisticDefinition(ctx context.Context, id int64) (*StatisticDefinition, error)
+	FindStatisticDefinitions(ctx context.Context, name string) ([]StatisticDefinition, error)
+	GetStatisticHistory(ctx context.Context, toonId uint, statisticId int64) ([]StatisticValue, error)
+	SaveEquipment(ctx context.Context, toonId uint, day time.Time, equipment []EquipmentSnapshot) error
+	GetEquipmentHistory(ctx context.Context, toonId uint) ([]EquipmentSnapshot, error)
+	SaveMounts(ctx context.Context, toonId uint, mounts []MountCollection) error
+	GetMountCollection(ctx context.Context) ([]MountCollection, error)
+	SaveMountDefinitions(ctx context.Context, definitions []MountDefinition) error
+	GetMountDefinitions(ctx context.Context) ([]MountDefinition, error)
+	GetUnknownMounts(ctx context.Context) ([]MountCollection, error)
+	UpdatePetRoster(ctx context.Context, toonId uint, day time.Time, pets []Pet) error
+	GetPets(ctx context.Context) ([]Pet, error)
+	GetPetEvents(ctx context.Context, since time.Time) ([]PetEvent, error)
+	SaveReputations(ctx context.Context, toonId uint, day time.Time, reputations []ReputationValue) error
+	GetReputationHistory(ctx context.Context, toonId uint, since time.Time) ([]ReputationValue, error)
+	SaveToonAchievements(ctx context.Context, toonId uint, achievements []ToonAchievement, criteria []AchievementCriteria) error
+	GetToonAchievements(ctx context.Context, toonId uint) ([]ToonAchievement, error)
+	GetAchievementCriteria(ctx context.Context, toonId uint) ([]AchievementCriteria, error)
+	SaveAchievementDefinitions(ctx context.Context, definitions []AchievementDefinition) error
+	GetAchievementDefinitions(ctx context.Context) ([]AchievementDefinition, error)
+	GetUnknownAchievements(ctx context.Context) ([]ToonAchievement, error)
+	SaveMythicKeystone(ctx context.Context, toonId uint, day time.Time, rating *MythicRating, runs []MythicRun) error
+	GetLatestMythicRatings(ctx context.Context) ([]MythicRating, error)
+	GetMythicRatingHistory(ctx context.Context, toonId uint) ([]MythicRating, error)
+	GetMythicRuns(ctx context.Context, toonId uint) ([]MythicRun, error)
+	SavePvp(ctx context.Context, toonId uint, day time.Time, summary *PvpSummary, brackets []PvpBracket) error
+	GetLatestPvpSummary(ctx context.Context, toonId uint) (*PvpSummary, error)
+	GetPvpBracketHistory(ctx context.Context, toonId uint, since time.Time) ([]PvpBracket, error)
+	SaveRaidEncounters(ctx context.Context, toonId uint, day time.Time, progress []RaidProgress, kills []RaidKill) error
+	GetRaidProgress(ctx context.Context) ([]RaidProgress, error)
+	GetRaidKills(ctx context.Context, toonId uint) ([]RaidKill, error)
+	SaveProfessions(ctx context.Context, toonId uint, day time.Time, skills []ProfessionSkill, recipes []ToonRecipe) error
+	GetLatestProfessionSkills(ctx context.Context) ([]ProfessionSkill, error)
+	GetProfessionSkillHistory(ctx context.Context, since time.Time) ([]ProfessionSkill, error)
+	GetToonRecipes(ctx context.Context) ([]ToonRecipe, error)
+	InsertGuild(ctx context.Context, guild *Guild) error
+	GetGuilds(ctx context.Context) ([]Guild, error)
+	GetGuildMembers(ctx context.Context, guildId int64) ([]GuildMember, error)
+	GetCurrentMemberships(ctx context.Context, toonId uint) ([]GuildMember, error)
+	SaveGuildMembers(ctx context.Context, members []GuildMember) error
+	SaveRealms(ctx context.Context, region string, realms []Realm) error
+	GetRealms(ctx context.Context, region string) ([]Realm, error)
+	GetStoredRealms(ctx context.Context, region string) ([]string, error)
+	RenameRealm(ctx context.Context, region string, from string, to string) error
+	GetToonClassById(ctx context.Context, id int64) (*ToonClass, error)
 }
 
 // Database interface struct.
@@ -25,8 +86,19 @@ type WowDB struct {
 	dbDriver string
 }
 
+// The database drivers that can be used for dbDriver.
+var dbDrivers = []string{"postgres", "mysql", "sqlite"}
+
+// gorm's name for the dialect of a driver, which is only different for SQLite.
+func gormDialect(dbDriver string) string {
+	if dbDriver == "sqlite" {
+		return "sqlite3"
+	}
+	return dbDriver
+}
+
 func NewDB(dbDriver string, connStr string) (*WowDB, error) {
-	db, err := gorm.Open(dbDriver, connStr)
+	db, err := gorm.Open(gormDialect(dbDriver), connStr)
 	if err != nil {
 		return nil, err
 	}
@@ -36,65 +108,1045 @@ func NewDB(dbDriver string, connStr string) (*WowDB, error) {
 		return nil, err
 	}
 
+	if dbDriver == "sqlite" {
+		// SQLite only has one writer at a time, so keep everything on one connection rather than have the stats
+		// workers fail with "database is locked". That also keeps the foreign_keys pragma, which is per connection.
+		db.DB().SetMaxOpenConns(1)
+		err = db.Exec("PRAGMA foreign_keys = ON").Error
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	db.Set("gorm:auto_preload", true)
 	//db.LogMode(true)
 	return &WowDB{db, dbDriver}, nil
 }
 
+// Insert value unless a row with its primary key is already there, returning whether it was inserted. Unlike
+// checking first this holds up when another transaction inserts the same row in between.
+func (db *WowDB) createIfMissing(tx *gorm.DB, value interface{}) (bool, error) {
+	if db.dbDriver == "mysql" {
+		tx = tx.Set("gorm:insert_modifier", "IGNORE")
+	} else {
+		tx = tx.Set("gorm:insert_option", "ON CONFLICT DO NOTHING")
+	}
+	result := tx.Create(value)
+	if result.Error == sql.ErrNoRows {
+		// Postgres returns the new primary key, there isn't one when nothing was inserted.
+		return false, nil
+	}
+	return result.RowsAffected > 0, result.Error
+}
+
+// Run fn in a transaction that is tied to ctx, so that cancelling ctx also cancels the query. gorm doesn't
+// take a context on its own, going through BeginTx is the only way to hand one to database/sql.
+func (db *WowDB) withContext(ctx context.Context, fn func(tx *gorm.DB) error) error {
+	tx := db.BeginTx(ctx, nil)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	err := fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
 // Get a Toon from the database based on Id
-func (db *WowDB) GetToonById(id int64) (*Toon, error) {
+func (db *WowDB) GetToonById(ctx context.Context, id int64) (*Toon, error) {
 	var toon Toon
-	dbRet := db.First(&toon, id)
-	return &toon, dbRet.Error
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.First(&toon, id).Error
+	})
+	return &toon, err
 }
 
 // Get all Toons from the database
-func (db *WowDB) GetAllToons() []Toon {
+func (db *WowDB) GetAllToons(ctx context.Context) ([]Toon, error) {
 	var toons []Toon
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Find(&toons).Error
+	})
+	return toons, err
+}
 
-	db.Find(&toons)
+// Get the toons that haven't been deactivated, which are the ones that get fetched.
+func (db *WowDB) GetActiveToons(ctx context.Context) ([]Toon, error) {
+	var toons []Toon
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Where("id NOT IN (select toon_id from inactive_toons)").Find(&toons).Error
+	})
+	return toons, err
+}
 
-	return toons
+func (db *WowDB) GetInactiveToons(ctx context.Context) ([]InactiveToon, error) {
+	var inactive []InactiveToon
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Find(&inactive).Error
+	})
+	return inactive, err
+}
+
+// Stop fetching a toon. A toon that is already inactive keeps the day and reason it was deactivated with.
+func (db *WowDB) SetToonInactive(ctx context.Context, inactive InactiveToon) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		var count int
+		err := tx.Model(&InactiveToon{}).Where("toon_id = ?", inactive.ToonID).Count(&count).Error
+		if err != nil || count > 0 {
+			return err
+		}
+		return tx.Create(&inactive).Error
+	})
+}
+
+func (db *WowDB) SetToonActive(ctx context.Context, toonId uint) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Where("toon_id = ?", toonId).Delete(InactiveToon{}).Error
+	})
 }
 
 // Insert a new Toon into the database. Does not need an ID as the database should handle entering it.
-func (db *WowDB) InsertToon(toon *Toon) error {
-	return db.Create(toon).Error
+func (db *WowDB) InsertToon(ctx context.Context, toon *Toon) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Create(toon).Error
+	})
+}
+
+// Save changes to a toon's name, realm, race or class.
+func (db *WowDB) UpdateToon(ctx context.Context, toon *Toon) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Model(&Toon{}).Where("id = ?", toon.ID).Updates(map[string]interface{}{
+			"name":     toon.Name,
+			"realm":    toon.Realm,
+			"race_id":  toon.RaceID,
+			"class_id": toon.ClassID,
+			"gender":   toon.Gender,
+		}).Error
+	})
+}
+
+// Remove a toon. This is a soft delete, its stats and history stay in the database but it isn't fetched or
+// reported on any more.
+func (db *WowDB) RemoveToon(ctx context.Context, toonId uint) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Where("id = ?", toonId).Delete(&Toon{}).Error
+	})
 }
 
 // Insert a stats record. This doesn't check to see if a duplicate exists, it relies on the database's
 // constraints to handle that.
-func (db *WowDB) InsertStats(stats *Stat) error {
-	return db.Create(stats).Error
+func (db *WowDB) InsertStats(ctx context.Context, stats *Stat) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Create(stats).Error
+	})
+}
+
+// Update a stats record that's already in the database.
+func (db *WowDB) UpdateStats(ctx context.Context, stats *Stat) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Save(stats).Error
+	})
+}
+
+// Get the most recent Stat for a toon.
+func (db *WowDB) GetLatestStats(ctx context.Context, toonId uint) (*Stat, error) {
+	var stats Stat
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Where("toon_id = ?", toonId).Order("insert_date desc").First(&stats).Error
+	})
+	return &stats, err
+}
+
+// Get every Stat for a toon, oldest first.
+func (db *WowDB) GetStatsForToon(ctx context.Context, toonId uint) ([]Stat, error) {
+	var stats []Stat
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Where("toon_id = ?", toonId).Order("insert_date").Find(&stats).Error
+	})
+	return stats, err
 }
 
 // Get a list of the latest Stat for all toons. This will get just the latest day's stats which is useful
 // for email or CLI.
-func (db *WowDB) GetAllToonLatestQuickSummary() ([]Stat, error) {
+func (db *WowDB) GetAllToonLatestQuickSummary(ctx context.Context) ([]Stat, error) {
 	var stats []Stat
-	//db.LogMode(true)
-	dbRet := db.Preload("Toon").Where("insert_date = (select max(insert_date) from stats)").Order("level desc").Order("item_level desc").Find(&stats)
-	//db.LogMode(false)
-
-	return stats, dbRet.Error
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Preload("Toon").Where("insert_date = (select max(insert_date) from stats)").Order("level desc").Order("item_level desc").Find(&stats).Error
+	})
+	return stats, err
 }
 
-func (db *WowDB) InsertToonClass(toonClass *ToonClass) error {
-	return db.Create(toonClass).Error
+func (db *WowDB) InsertToonClass(ctx context.Context, toonClass *ToonClass) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Create(toonClass).Error
+	})
 }
 
-func (db *WowDB) GetToonClassById(id int64) (*ToonClass, error) {
+func (db *WowDB) GetToonClassById(ctx context.Context, id int64) (*ToonClass, error) {
 	var dbClass ToonClass
-	dbRet := db.First(&dbClass, id)
-	return &dbClass, dbRet.Error
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.First(&dbClass, id).Error
+	})
+	return &dbClass, err
 }
 
-func (db *WowDB) GetRaceById(id int64) (*Race, error) {
+func (db *WowDB) GetRaceById(ctx context.Context, id int64) (*Race, error) {
 	var dbRace Race
-	dbRet := db.First(&dbRace, id)
-	return &dbRace, dbRet.Error
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.First(&dbRace, id).Error
+	})
+	return &dbRace, err
+}
+
+func (db *WowDB) InsertRace(ctx context.Context, race *Race) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Create(race).Error
+	})
+}
+
+// Insert a metric or, if there's already one with the same name, update it. Either way metric.ID is set.
+func (db *WowDB) SaveMetric(ctx context.Context, metric *Metric) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		var existing Metric
+		err := tx.Where("name = ?", metric.Name).First(&existing).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return tx.Create(metric).Error
+		}
+		if err != nil {
+			return err
+		}
+		metric.ID = existing.ID
+		return tx.Save(metric).Error
+	})
+}
+
+// Save metric values, replacing the value for the same toon, day and metric if there is one.
+func (db *WowDB) SaveStatValues(ctx context.Context, values []StatValue) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		for i := range values {
+			v := &values[i]
+			_ = v.BeforeSave()
+			err := tx.Where("toon_id = ? AND insert_date = ? AND metric_id = ?", v.ToonID, v.InsertDate, v.MetricID).Delete(StatValue{}).Error
+			if err != nil {
+				return err
+			}
+			err = tx.Create(v).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Save a snapshot of statistics. Definitions that are new or have been renamed are saved and the values
+// replace whatever the toons already had for those days.
+func (db *WowDB) SaveStatistics(ctx context.Context, definitions []StatisticDefinition, values []StatisticValue) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		var existing []StatisticDefinition
+		err := tx.Find(&existing).Error
+		if err != nil {
+			return err
+		}
+		known := make(map[int64]StatisticDefinition)
+		for _, d := range existing {
+			known[d.ID] = d
+		}
+
+		for i := range definitions {
+			d := &definitions[i]
+			old, ok := known[d.ID]
+			switch {
+			case !ok:
+				err = tx.Create(d).Error
+			case old != *d:
+				err = tx.Save(d).Error
+			}
+			if err != nil {
+				return err
+			}
+			known[d.ID] = *d
+		}
+
+		days := make(map[uint]map[time.Time]bool)
+		for i := range values {
+			v := &values[i]
+			_ = v.BeforeSave()
+			if days[v.ToonID] == nil {
+				days[v.ToonID] = make(map[time.Time]bool)
+			}
+			if !days[v.ToonID][v.InsertDate] {
+				err = tx.Where("toon_id = ? AND insert_date = ?", v.ToonID, v.InsertDate).Delete(StatisticValue{}).Error
+				if err != nil {
+					return err
+				}
+				days[v.ToonID][v.InsertDate] = true
+			}
+			err = tx.Create(v).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *WowDB) GetStatisticDefinition(ctx context.Context, id int64) (*StatisticDefinition, error) {
+	var definition StatisticDefinition
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.First(&definition, id).Error
+	})
+	return &definition, err
+}
+
+// Get the statistic definitions with name in their name, case doesn't matter.
+func (db *WowDB) FindStatisticDefinitions(ctx context.Context, name string) ([]StatisticDefinition, error) {
+	var definitions []StatisticDefinition
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Where("LOWER(name) LIKE ?", "%"+strings.ToLower(name)+"%").Order("id").Find(&definitions).Error
+	})
+	return definitions, err
+}
+
+// Get the values of a statistic for a toon, oldest first.
+func (db *WowDB) GetStatisticHistory(ctx context.Context, toonId uint, statisticId int64) ([]StatisticValue, error) {
+	var values []StatisticValue
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Where("toon_id = ? AND statistic_id = ?", toonId, statisticId).Order("insert_date").Find(&values).Error
+	})
+	return values, err
+}
+
+// Replace what a toon had equipped on a day.
+func (db *WowDB) SaveEquipment(ctx context.Context, toonId uint, day time.Time, equipment []EquipmentSnapshot) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		err := tx.Where("toon_id = ? AND insert_date = ?", toonId, truncateToDay(day)).Delete(EquipmentSnapshot{}).Error
+		if err != nil {
+			return err
+		}
+		for i := range equipment {
+			err = tx.Create(&equipment[i]).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get everything a toon has had equipped, ordered by date and slot.
+func (db *WowDB) GetEquipmentHistory(ctx context.Context, toonId uint) ([]EquipmentSnapshot, error) {
+	var equipment []EquipmentSnapshot
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Where("toon_id = ?", toonId).Order("insert_date").Order("slot").Find(&equipment).Error
+	})
+	return equipment, err
+}
+
+// Add mounts to a toon's collection. A mount the toon already has keeps its FirstSeen unless this one is from
+// an earlier day, which happens when backfilling, and gets whatever details it was missing.
+func (db *WowDB) SaveMounts(ctx context.Context, toonId uint, mounts []MountCollection) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		var existing []MountCollection
+		err := tx.Where("toon_id = ?", toonId).Find(&existing).Error
+		if err != nil {
+			return err
+		}
+		known := make(map[string]MountCollection)
+		for _, m := range existing {
+			known[m.Name] = m
+		}
+
+		for i := range mounts {
+			m := &mounts[i]
+			_ = m.BeforeSave()
+			old, ok := known[m.Name]
+			if !ok {
+				err = tx.Create(m).Error
+			} else {
+				updated := old
+				if m.FirstSeen.Before(truncateToDay(old.FirstSeen)) {
+					updated.FirstSeen = m.FirstSeen
+				}
+				updated.merge(*m)
+				if updated != old {
+					err = tx.Save(&updated).Error
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get every toon's mounts, ordered by when they were first seen.
+func (db *WowDB) GetMountCollection(ctx context.Context) ([]MountCollection, error) {
+	var mounts []MountCollection
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Order("first_seen").Order("name").Find(&mounts).Error
+	})
+	return mounts, err
+}
+
+// Insert the mount definitions that are new and update the ones that changed.
+func (db *WowDB) SaveMountDefinitions(ctx context.Context, definitions []MountDefinition) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		var existing []MountDefinition
+		err := tx.Find(&existing).Error
+		if err != nil {
+			return err
+		}
+		known := make(map[int64]MountDefinition)
+		for _, d := range existing {
+			known[d.ID] = d
+		}
+
+		for i := range definitions {
+			d := &definitions[i]
+			old, ok := known[d.ID]
+			switch {
+			case !ok:
+				err = tx.Create(d).Error
+			case old != *d:
+				err = tx.Save(d).Error
+			}
+			if err != nil {
+				return err
+			}
+			known[d.ID] = *d
+		}
+		return nil
+	})
+}
+
+func (db *WowDB) GetMountDefinitions(ctx context.Context) ([]MountDefinition, error) {
+	var definitions []MountDefinition
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Find(&definitions).Error
+	})
+	return definitions, err
+}
+
+// Get one collected mount for each Profile API mount ID that isn't in mount_definitions.
+func (db *WowDB) GetUnknownMounts(ctx context.Context) ([]MountCollection, error) {
+	var mounts []MountCollection
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Select("DISTINCT mount_collection.mount_id, mount_collection.name").
+			Joins("LEFT JOIN mount_definitions ON mount_definitions.id = mount_collection.mount_id").
+			Where("mount_collection.mount_id <> 0 AND mount_definitions.id IS NULL").
+			Order("mount_collection.mount_id").Find(&mounts).Error
+	})
+	return mounts, err
+}
+
+// Update the pet roster with the pets in a toon's document for a day and record what changed. Toons on the
+// same account can be collected at the same time and both find a pet missing, so new pets are only inserted
+// when they still aren't there and the one that loses the race leaves the pet's events to the other.
+func (db *WowDB) UpdatePetRoster(ctx context.Context, toonId uint, day time.Time, pets []Pet) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		var roster []Pet
+		err := tx.Find(&roster).Error
+		if err != nil {
+			return err
+		}
+
+		added, changed, events := petChanges(roster, toonId, day, pets)
+		existing := make(map[string]bool)
+		for i := range added {
+			inserted, err := db.createIfMissing(tx, &added[i])
+			if err != nil {
+				return err
+			}
+			if !inserted {
+				existing[added[i].Guid] = true
+			}
+		}
+		for i := range changed {
+			err = tx.Save(&changed[i]).Error
+			if err != nil {
+				return err
+			}
+		}
+		for i := range events {
+			if existing[events[i].Guid] {
+				continue
+			}
+			err = tx.Create(&events[i]).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get every pet on the roster, released ones too.
+func (db *WowDB) GetPets(ctx context.Context) ([]Pet, error) {
+	var pets []Pet
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Order("name").Order("guid").Find(&pets).Error
+	})
+	return pets, err
 }
 
-func (db *WowDB) InsertRace(race *Race) error {
-	return db.Create(race).Error
+// Get the pet events on or after since, oldest first.
+func (db *WowDB) GetPetEvents(ctx context.Context, since time.Time) ([]PetEvent, error) {
+	var events []PetEvent
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Where("event_date >= ?", truncateToDay(since)).Order("event_date").Order("id").Find(&events).Error
+	})
+	return events, err
+}
+
+// Replace a toon's reputations for a day.
+func (db *WowDB) SaveReputations(ctx context.Context, toonId uint, day time.Time, reputations []ReputationValue) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		err := tx.Where("toon_id = ? AND insert_date = ?", toonId, truncateToDay(day)).Delete(ReputationValue{}).Error
+		if err != nil {
+			return err
+		}
+		for i := range reputations {
+			err = tx.Create(&reputations[i]).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get a toon's reputations on or after since, ordered by faction and then date.
+func (db *WowDB) GetReputationHistory(ctx context.Context, toonId uint, since time.Time) ([]ReputationValue, error) {
+	var reputations []ReputationValue
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Where("toon_id = ? AND insert_date >= ?", toonId, truncateToDay(since)).Order("faction_id").Order("insert_date").Find(&reputations).Error
+	})
+	return reputations, err
+}
+
+// Bring a toon's achievements and criteria progress up to what's given. Only the rows that changed are
+// written, most of a toon's achievements are the same from one day to the next.
+func (db *WowDB) SaveToonAchievements(ctx context.Context, toonId uint, achievements []ToonAchievement, criteria []AchievementCriteria) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		var existing []ToonAchievement
+		err := tx.Where("toon_id = ?", toonId).Find(&existing).Error
+		if err != nil {
+			return err
+		}
+		known := make(map[int64]ToonAchievement)
+		for _, a := range existing {
+			known[a.AchievementID] = a
+		}
+		for i := range achievements {
+			a := &achievements[i]
+			old, ok := known[a.AchievementID]
+			switch {
+			case !ok:
+				err = tx.Create(a).Error
+			case !old.same(a):
+				a.ID = old.ID
+				err = tx.Save(a).Error
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		var existingCriteria []AchievementCriteria
+		err = tx.Where("toon_id = ?", toonId).Find(&existingCriteria).Error
+		if err != nil {
+			return err
+		}
+		type criteriaKey struct{ achievement, criteria int64 }
+		knownCriteria := make(map[criteriaKey]AchievementCriteria)
+		for _, c := range existingCriteria {
+			knownCriteria[criteriaKey{c.AchievementID, c.CriteriaID}] = c
+		}
+		for i := range criteria {
+			c := &criteria[i]
+			key := criteriaKey{c.AchievementID, c.CriteriaID}
+			old, ok := knownCriteria[key]
+			delete(knownCriteria, key)
+			c.ID = old.ID
+			switch {
+			case !ok:
+				err = tx.Create(c).Error
+			case old != *c:
+				err = tx.Save(c).Error
+			}
+			if err != nil {
+				return err
+			}
+		}
+		// What's left is for achievements that have been completed since.
+		for _, c := range knownCriteria {
+			err = tx.Delete(&c).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *WowDB) GetToonAchievements(ctx context.Context, toonId uint) ([]ToonAchievement, error) {
+	var achievements []ToonAchievement
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Where("toon_id = ?", toonId).Order("achievement_id").Find(&achievements).Error
+	})
+	return achievements, err
+}
+
+func (db *WowDB) GetAchievementCriteria(ctx context.Context, toonId uint) ([]AchievementCriteria, error) {
+	var criteria []AchievementCriteria
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Where("toon_id = ?", toonId).Order("achievement_id").Order("criteria_id").Find(&criteria).Error
+	})
+	return criteria, err
+}
+
+// Insert the achievement definitions that are new and update the ones that changed.
+func (db *WowDB) SaveAchievementDefinitions(ctx context.Context, definitions []AchievementDefinition) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		var existing []AchievementDefinition
+		err := tx.Find(&existing).Error
+		if err != nil {
+			return err
+		}
+		known := make(map[int64]AchievementDefinition)
+		for _, d := range existing {
+			known[d.ID] = d
+		}
+
+		for i := range definitions {
+			d := &definitions[i]
+			old, ok := known[d.ID]
+			switch {
+			case !ok:
+				err = tx.Create(d).Error
+			case old != *d:
+				err = tx.Save(d).Error
+			}
+			if err != nil {
+				return err
+			}
+			known[d.ID] = *d
+		}
+		return nil
+	})
+}
+
+func (db *WowDB) GetAchievementDefinitions(ctx context.Context) ([]AchievementDefinition, error) {
+	var definitions []AchievementDefinition
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Find(&definitions).Error
+	})
+	return definitions, err
+}
+
+// Get the achievements toons have that aren't in achievement_definitions.
+func (db *WowDB) GetUnknownAchievements(ctx context.Context) ([]ToonAchievement, error) {
+	var achievements []ToonAchievement
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Select("toon_achievements.*").
+			Joins("LEFT JOIN achievement_definitions ON achievement_definitions.id = toon_achievements.achievement_id").
+			Where("achievement_definitions.id IS NULL").Order("toon_achievements.achievement_id").Find(&achievements).Error
+	})
+	return achievements, err
+}
+
+// Replace a toon's rating for the day and add the runs that are new. A run that was saved without a week
+// gets one if it has one now.
+func (db *WowDB) SaveMythicKeystone(ctx context.Context, toonId uint, day time.Time, rating *MythicRating, runs []MythicRun) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		if rating != nil {
+			err := tx.Where("toon_id = ? AND insert_date = ?", toonId, truncateToDay(day)).Delete(MythicRating{}).Error
+			if err != nil {
+				return err
+			}
+			err = tx.Create(rating).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		var existing []MythicRun
+		err := tx.Where("toon_id = ?", toonId).Find(&existing).Error
+		if err != nil {
+			return err
+		}
+		type runKey struct{ dungeon, completed int64 }
+		known := make(map[runKey]MythicRun)
+		for _, r := range existing {
+			known[runKey{r.DungeonID, r.CompletedAt.Unix()}] = r
+		}
+		for i := range runs {
+			r := &runs[i]
+			old, ok := known[runKey{r.DungeonID, r.CompletedAt.Unix()}]
+			switch {
+			case !ok:
+				err = tx.Create(r).Error
+			case old.PeriodID == 0 && r.PeriodID != 0:
+				err = tx.Model(&old).Update("period_id", r.PeriodID).Error
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get each toon's latest rating.
+func (db *WowDB) GetLatestMythicRatings(ctx context.Context) ([]MythicRating, error) {
+	var ratings []MythicRating
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Where("insert_date = (select max(insert_date) from mythic_ratings m where m.toon_id = mythic_ratings.toon_id)").Find(&ratings).Error
+	})
+	return ratings, err
+}
+
+func (db *WowDB) GetMythicRatingHistory(ctx context.Context, toonId uint) ([]MythicRating, error) {
+	var ratings []MythicRating
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Where("toon_id = ?", toonId).Order("insert_date").Find(&ratings).Error
+	})
+	return ratings, err
+}
+
+func (db *WowDB) GetMythicRuns(ctx context.Context, toonId uint) ([]MythicRun, error) {
+	var runs []MythicRun
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Where("toon_id = ?", toonId).Order("completed_at").Find(&runs).Error
+	})
+	return runs, err
+}
+
+// Replace a toon's PvP summary and brackets for a day.
+func (db *WowDB) SavePvp(ctx context.Context, toonId uint, day time.Time, summary *PvpSummary, brackets []PvpBracket) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		err := tx.Where("toon_id = ? AND insert_date = ?", toonId, truncateToDay(day)).Delete(PvpSummary{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("toon_id = ? AND insert_date = ?", toonId, truncateToDay(day)).Delete(PvpBracket{}).Error
+		if err != nil {
+			return err
+		}
+
+		if summary != nil {
+			err = tx.Create(summary).Error
+			if err != nil {
+				return err
+			}
+		}
+		for i := range brackets {
+			err = tx.Create(&brackets[i]).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get a toon's latest PvP summary, nil if it doesn't have one.
+func (db *WowDB) GetLatestPvpSummary(ctx context.Context, toonId uint) (*PvpSummary, error) {
+	var summaries []PvpSummary
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Where("toon_id = ?", toonId).Order("insert_date desc").Limit(1).Find(&summaries).Error
+	})
+	if err != nil || len(summaries) == 0 {
+		return nil, err
+	}
+	return &summaries[0], nil
+}
+
+// Get a toon's brackets on or after since, ordered by date.
+func (db *WowDB) GetPvpBracketHistory(ctx context.Context, toonId uint, since time.Time) ([]PvpBracket, error) {
+	var brackets []PvpBracket
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Where("toon_id = ? AND insert_date >= ?", toonId, truncateToDay(since)).Order("insert_date").Order("bracket").Find(&brackets).Error
+	})
+	return brackets, err
+}
+
+// Replace a toon's raid progress and boss kills for a day. A kill's FirstKill is the earliest seen on any day,
+// since the document only ever has the latest kill.
+func (db *WowDB) SaveRaidEncounters(ctx context.Context, toonId uint, day time.Time, progress []RaidProgress, kills []RaidKill) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		day = truncateToDay(day)
+		err := tx.Where("toon_id = ? AND insert_date = ?", toonId, day).Delete(RaidProgress{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("toon_id = ? AND insert_date = ?", toonId, day).Delete(RaidKill{}).Error
+		if err != nil {
+			return err
+		}
+		for i := range progress {
+			progress[i].InsertDate = day
+			err = tx.Create(&progress[i]).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		var earlier []RaidKill
+		err = tx.Where("toon_id = ?", toonId).Find(&earlier).Error
+		if err != nil {
+			return err
+		}
+		type killKey struct {
+			encounter  int64
+			difficulty string
+		}
+		first := make(map[killKey]time.Time)
+		for _, k := range earlier {
+			key := killKey{k.EncounterID, k.Difficulty}
+			if f, ok := first[key]; !ok || k.FirstKill.Before(f) {
+				first[key] = k.FirstKill
+			}
+		}
+		for i := range kills {
+			k := &kills[i]
+			if f, ok := first[killKey{k.EncounterID, k.Difficulty}]; ok && f.Before(k.FirstKill) {
+				k.FirstKill = f
+			}
+			k.InsertDate = day
+			err = tx.Create(k).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get every toon's raid progress from the last day it was fetched.
+func (db *WowDB) GetRaidProgress(ctx context.Context) ([]RaidProgress, error) {
+	var progress []RaidProgress
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Where("insert_date = (select max(insert_date) from raid_progress p where p.toon_id = raid_progress.toon_id)").
+			Order("toon_id").Order("instance_id").Find(&progress).Error
+	})
+	return progress, err
+}
+
+// Get a toon's boss kills from the last day it was fetched.
+func (db *WowDB) GetRaidKills(ctx context.Context, toonId uint) ([]RaidKill, error) {
+	var kills []RaidKill
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Where("toon_id = ? AND insert_date = (select max(insert_date) from raid_kills k where k.toon_id = ?)", toonId, toonId).
+			Order("first_kill").Find(&kills).Error
+	})
+	return kills, err
+}
+
+// Replace a toon's profession skills for a day and add the recipes it didn't know before. A recipe's FirstSeen
+// only ever moves back, for when older documents are backfilled.
+func (db *WowDB) SaveProfessions(ctx context.Context, toonId uint, day time.Time, skills []ProfessionSkill, recipes []ToonRecipe) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		err := tx.Where("toon_id = ? AND insert_date = ?", toonId, truncateToDay(day)).Delete(ProfessionSkill{}).Error
+		if err != nil {
+			return err
+		}
+		for i := range skills {
+			err = tx.Create(&skills[i]).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		var existing []ToonRecipe
+		err = tx.Where("toon_id = ?", toonId).Find(&existing).Error
+		if err != nil {
+			return err
+		}
+		known := make(map[int64]ToonRecipe)
+		for _, r := range existing {
+			known[r.RecipeID] = r
+		}
+		for i := range recipes {
+			r := &recipes[i]
+			_ = r.BeforeSave()
+			old, ok := known[r.RecipeID]
+			switch {
+			case !ok:
+				err = tx.Create(r).Error
+			case r.FirstSeen.Before(truncateToDay(old.FirstSeen)):
+				err = tx.Model(&old).Update("first_seen", r.FirstSeen).Error
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get each toon's profession skills from the latest day it has them, in the order they were saved.
+func (db *WowDB) GetLatestProfessionSkills(ctx context.Context) ([]ProfessionSkill, error) {
+	var skills []ProfessionSkill
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Where("insert_date = (select max(insert_date) from profession_skills p where p.toon_id = profession_skills.toon_id)").Order("id").Find(&skills).Error
+	})
+	return skills, err
+}
+
+// Get every toon's profession skills on or after since, ordered by toon, profession, tier and date.
+func (db *WowDB) GetProfessionSkillHistory(ctx context.Context, since time.Time) ([]ProfessionSkill, error) {
+	var skills []ProfessionSkill
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Where("insert_date >= ?", truncateToDay(since)).Order("toon_id").Order("profession_id").Order("tier_id").Order("insert_date").Find(&skills).Error
+	})
+	return skills, err
+}
+
+// Get every toon's recipes, ordered by when they were first seen.
+func (db *WowDB) GetToonRecipes(ctx context.Context) ([]ToonRecipe, error) {
+	var recipes []ToonRecipe
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Order("first_seen").Order("toon_id").Order("name").Find(&recipes).Error
+	})
+	return recipes, err
+}
+
+func (db *WowDB) InsertGuild(ctx context.Context, guild *Guild) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Create(guild).Error
+	})
+}
+
+func (db *WowDB) GetGuilds(ctx context.Context) ([]Guild, error) {
+	var guilds []Guild
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Order("name").Find(&guilds).Error
+	})
+	return guilds, err
+}
+
+// Get every membership of a guild, past and current, ordered by when they joined.
+func (db *WowDB) GetGuildMembers(ctx context.Context, guildId int64) ([]GuildMember, error) {
+	var members []GuildMember
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Where("guild_id = ?", guildId).Order("join_date").Order("name").Find(&members).Error
+	})
+	return members, err
+}
+
+// Get the guilds a toon is in now, as their memberships.
+func (db *WowDB) GetCurrentMemberships(ctx context.Context, toonId uint) ([]GuildMember, error) {
+	var members []GuildMember
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Where("toon_id = ? AND leave_date IS NULL", toonId).Find(&members).Error
+	})
+	return members, err
+}
+
+// Insert the new memberships and update the others.
+func (db *WowDB) SaveGuildMembers(ctx context.Context, members []GuildMember) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		for i := range members {
+			err := tx.Save(&members[i]).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Replace a region's realms.
+func (db *WowDB) SaveRealms(ctx context.Context, region string, realms []Realm) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		err := tx.Where("region = ?", region).Delete(Realm{}).Error
+		if err != nil {
+			return err
+		}
+		for i := range realms {
+			realms[i].ID = 0
+			realms[i].Region = region
+			err = tx.Create(&realms[i]).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get a region's realms ordered by name.
+func (db *WowDB) GetRealms(ctx context.Context, region string) ([]Realm, error) {
+	var realms []Realm
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		return tx.Where("region = ?", region).Order("name").Find(&realms).Error
+	})
+	return realms, err
+}
+
+// The realms the toons, guilds and guild members in a region are kept under, deleted toons too.
+func (db *WowDB) GetStoredRealms(ctx context.Context, region string) ([]string, error) {
+	var stored []string
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		region = strings.ToLower(region)
+		var toons, guilds, members []string
+		err := tx.Unscoped().Model(&Toon{}).Where("LOWER(region) = ?", region).Pluck("DISTINCT realm", &toons).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&Guild{}).Where("LOWER(region) = ?", region).Pluck("DISTINCT realm", &guilds).Error
+		if err != nil {
+			return err
+		}
+		ids := tx.Table("guilds").Select("id").Where("LOWER(region) = ?", region).SubQuery()
+		err = tx.Model(&GuildMember{}).Where("guild_id IN ?", ids).Pluck("DISTINCT realm", &members).Error
+		if err != nil {
+			return err
+		}
+
+		seen := make(map[string]bool)
+		for _, realm := range append(append(toons, guilds...), members...) {
+			if !seen[realm] {
+				seen[realm] = true
+				stored = append(stored, realm)
+			}
+		}
+		return nil
+	})
+	return stored, err
+}
+
+// Change a realm's name on the toons, guilds and guild members in a region, deleted toons too. A guild that's
+// also tracked under the new name keeps the old one, renaming it would break idx_guilds_name_realm_region.
+func (db *WowDB) RenameRealm(ctx context.Context, region string, from string, to string) error {
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		region = strings.ToLower(region)
+		err := tx.Unscoped().Model(&Toon{}).Where("LOWER(region) = ? AND realm = ?", region, from).Update("realm", to).Error
+		if err != nil {
+			return err
+		}
+		guilds := tx.Table("guilds").Select("id").Where("LOWER(region) = ?", region).SubQuery()
+		err = tx.Model(&GuildMember{}).Where("realm = ? AND guild_id IN ?", from, guilds).Update("realm", to).Error
+		if err != nil {
+			return err
+		}
+
+		// MySQL can't read guilds in a subquery of an update of guilds, so the names are looked up first.
+		var taken []string
+		err = tx.Model(&Guild{}).Where("LOWER(region) = ? AND realm = ?", region, to).Pluck("name", &taken).Error
+		if err != nil {
+			return err
+		}
+		rename := tx.Model(&Guild{}).Where("LOWER(region) = ? AND realm = ?", region, from)
+		if len(taken) > 0 {
+			rename = rename.Where("name NOT IN (?)", taken)
+		}
+		return rename.Update("realm", to).Error
+	})
 }
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Open a SQLite database in a temporary directory. Call the returned function to close it and remove the
+// directory.
+func newTestDB(t *testing.T) (*WowDB, func()) {
+	dir, err := ioutil.TempDir("", "wowstats-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDB("sqlite", filepath.Join(dir, "wowstats.db"))
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		t.Fatalf("Could not open SQLite database: %v", err)
+	}
+	return db, func() {
+		_ = db.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// A migrated test database and an Env on it, most tests start with this.
+func newMigratedEnv(t *testing.T) (*WowDB, *Env, func()) {
+	db, cleanup := newTestDB(t)
+	if _, err := db.MigrateUp(context.Background()); err != nil {
+		cleanup()
+		t.Fatalf("MigrateUp failed: %v", err)
+	}
+	return db, &Env{db: db}, cleanup
+}
+
+// Add the toon most tests use.
+func insertTestToon(t *testing.T, db *WowDB) Toon {
+	toon := Toon{Name: "Borvoh", RaceID: 29, ClassID: 5, Realm: "Duskwood", Region: "us"}
+	if err := db.InsertToon(context.Background(), &toon); err != nil {
+		t.Fatal(err)
+	}
+	return toon
+}
+
+// The lines of tabwriter output with the padding squeezed down to single spaces, for looking rows up.
+func tableLines(out string) map[string]bool {
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(out, "\n") {
+		lines[strings.Join(strings.Fields(line), " ")] = true
+	}
+	return lines
+}
+
+func TestSqliteMigrations(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeBlizzard(t)
+	defer fake.Close()
+	blizzard := newTestBlizzard(t, fake.Transport())
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	env := &Env{db: db}
+
+	if err := doDatabaseMigrations(ctx, db, env, blizzard); err != nil {
+		t.Fatalf("doDatabaseMigrations failed: %v", err)
+	}
+	// Running them again on an existing database has to work too.
+	if err := doDatabaseMigrations(ctx, db, env, blizzard); err != nil {
+		t.Fatalf("doDatabaseMigrations failed: %v", err)
+	}
+
+	var colors int
+	db.Model(&ClassColor{}).Count(&colors)
+	if colors != 12 {
+		t.Errorf("Want 12 class colors, got %v", colors)
+	}
+
+	toon := Toon{Name: "Borvoh", RaceID: 29, ClassID: 5, Realm: "Duskwood", Region: "us"}
+	err := db.InsertToon(ctx, &toon)
+	if err != nil {
+		t.Fatalf("Could not insert toon: %v", err)
+	}
+
+	badToon := Toon{Name: "Nobody", RaceID: 999, ClassID: 5, Realm: "Duskwood", Region: "us"}
+	if db.InsertToon(ctx, &badToon) == nil {
+		t.Errorf("Toon with an unknown race should violate the foreign key")
+	}
+
+	yesterday := Stat{ToonID: toon.ID, Level: 119, ItemLevel: 400, InsertDate: time.Now().AddDate(0, 0, -1)}
+	today := Stat{ToonID: toon.ID, Level: 120, ItemLevel: 415, InsertDate: time.Now()}
+	for _, s := range []*Stat{&yesterday, &today} {
+		err = db.InsertStats(ctx, s)
+		if err != nil {
+			t.Fatalf("Could not insert stats: %v", err)
+		}
+	}
+
+	again := Stat{ToonID: toon.ID, Level: 120, InsertDate: time.Now()}
+	if db.InsertStats(ctx, &again) == nil {
+		t.Errorf("Second stats for the same day should violate idx_toon_id_create_date")
+	}
+
+	orphan := Stat{ToonID: 999, InsertDate: time.Now()}
+	if db.InsertStats(ctx, &orphan) == nil {
+		t.Errorf("Stats for an unknown toon should violate the foreign key")
+	}
+
+	summary, err := db.GetAllToonLatestQuickSummary(ctx)
+	if err != nil {
+		t.Fatalf("GetAllToonLatestQuickSummary failed: %v", err)
+	}
+	if len(summary) != 1 || summary[0].Level != 120 || summary[0].Toon.Name != "Borvoh" {
+		t.Errorf("GetAllToonLatestQuickSummary returned %+v", summary)
+	}
+}
+
+func TestMigrateDownAndUp(t *testing.T) {
+	ctx := context.Background()
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	applied, err := db.MigrateUp(ctx)
+	if err != nil {
+		t.Fatalf("MigrateUp failed: %v", err)
+	}
+	if len(applied) != len(migrations) {
+		t.Errorf("MigrateUp applied %v migrations, want %v", len(applied), len(migrations))
+	}
+
+	reverted, err := db.MigrateDown(ctx, len(migrations))
+	if err != nil {
+		t.Fatalf("MigrateDown failed: %v", err)
+	}
+	if len(reverted) != len(migrations) || db.HasTable("toons") {
+		t.Errorf("MigrateDown reverted %v migrations and left toons behind", len(reverted))
+	}
+
+	_, err = db.MigrateUp(ctx)
+	if err != nil {
+		t.Fatalf("MigrateUp after MigrateDown failed: %v", err)
+	}
+	states, err := db.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatalf("MigrationStatus failed: %v", err)
+	}
+	for _, s := range states {
+		if !s.Applied {
+			t.Errorf("Migration %v is still pending", s.Version)
+		}
+	}
+}
+
+// A database that AutoMigrate built before there were migrations only gets the baseline marked as applied.
+func TestMigrateExistingAutoMigrateDatabase(t *testing.T) {
+	ctx := context.Background()
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	err := db.AutoMigrate(&Race{}, &ToonClass{}, &Toon{}, &ClassColor{}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Exec("CREATE TABLE stats (id integer PRIMARY KEY AUTOINCREMENT, toon_id integer, insert_date date)").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := db.MigrateUp(ctx)
+	if err != nil {
+		t.Fatalf("MigrateUp failed: %v", err)
+	}
+	for _, m := range applied {
+		if m.Version <= baselineVersion {
+			t.Errorf("Baseline migration %v was run on an existing database", m.Version)
+		}
+	}
+	if !db.Dialect().HasColumn("stats", "unchanged") {
+		t.Errorf("stats is missing the unchanged column")
+	}
+}
+
+// A bootstrap that fails leaves nothing behind, and an empty schema_migrations left by an older version next to
+// existing tables still gets bootstrapped.
+func TestMigrateAfterFailedBootstrap(t *testing.T) {
+	ctx := context.Background()
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	err := db.AutoMigrate(&Race{}, &ToonClass{}, &Toon{}, &ClassColor{}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without stats adding the unchanged column fails.
+	if _, err = db.MigrateUp(ctx); err == nil {
+		t.Fatalf("MigrateUp without stats should fail")
+	}
+	if db.HasTable(&SchemaMigration{}) {
+		t.Errorf("The failed bootstrap left schema_migrations behind")
+	}
+
+	err = db.Exec("CREATE TABLE stats (id integer PRIMARY KEY AUTOINCREMENT, toon_id integer, insert_date date)").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.CreateTable(&SchemaMigration{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	applied, err := db.MigrateUp(ctx)
+	if err != nil {
+		t.Fatalf("MigrateUp after the failed bootstrap failed: %v", err)
+	}
+	if len(applied) != len(migrations)-baselineVersion {
+		t.Errorf("Want the %v migrations after the baseline applied, got %v", len(migrations)-baselineVersion, len(applied))
+	}
+}
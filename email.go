@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"net/smtp"
 	"bytes"
 	"html/template"
@@ -59,7 +60,7 @@ func (r *EmailRequest) SendEmail() error {
 // EmailRequest body field.
 func (r *EmailRequest) ParseTemplate(templateFileName string, data interface{}) error {
 	t := template.New("")
-	t.Funcs(template.FuncMap{"zebra": func(i int) bool { return i%2 == 0 }})
+	t.Funcs(template.FuncMap{"zebra": func(i int) bool { return i%2 == 0 }, "describeItem": describeItem})
 	t.Parse(templateFileName)
 	buf := new(bytes.Buffer)
 	if err := t.Execute(buf, data); err != nil {
@@ -71,28 +72,55 @@ func (r *EmailRequest) ParseTemplate(templateFileName string, data interface{})
 
 // Run the email summary. This will get the latest stats, then execute the template and finally send
 // the email.
-func DoEmailSummary(env *Env) error {
-	stats, err := env.db.GetAllToonLatestQuickSummary()
+func DoEmailSummary(ctx context.Context, env *Env) error {
+	stats, err := env.db.GetAllToonLatestQuickSummary(ctx)
 	if err != nil {
 		return err
 	}
+	ratings, err := latestMythicRatings(ctx, env)
+	if err != nil {
+		return err
+	}
+	upgrades, err := recentUpgrades(ctx, env)
+	if err != nil {
+		return err
+	}
+	data := struct {
+		Stats    []Stat
+		Ratings  map[uint]string
+		Upgrades []EquipmentChange
+		Days     int
+	}{stats, ratings, upgrades, upgradeReportDays}
 
 	// The email template laying out the HTML email.
 	const tpl = `
 <table border="0" cellspacing="0" cellpadding="5">
         <caption>WoW Stats</caption>
     <thead>
-    <tr><th>Name</th><th>Level</th><th>Item Level</th><th>Last Modified</th><th>Last Recorded Date</th></tr>
+    <tr><th>Name</th><th>Level</th><th>Item Level</th><th>M+ Rating</th><th>Last Modified</th><th>Last Recorded Date</th></tr>
+    </thead>
+    <tbody>
+{{range $idx, $b := .Stats}}
+{{if zebra $idx}}<tr bgcolor="#C4C2C2">{{else}}<tr bgcolor="#DBDBDB">{{end}}
+<td>{{$b.Toon.Name}}</td><td>{{$b.Level}}</td><td>{{$b.ItemLevel}}</td><td>{{index $.Ratings $b.ToonID}}</td><td>{{$b.LastModifiedAsDateTime}}</td><td>{{$b.InsertDate.Format "2006-01-02"}}</td></tr>
+{{end}}
+</tbody></table><p>
+{{if .Upgrades}}
+<table border="0" cellspacing="0" cellpadding="5">
+        <caption>Upgrades in the last {{.Days}} days</caption>
+    <thead>
+    <tr><th>Date</th><th>Name</th><th>Slot</th><th>Old</th><th>New</th><th>Delta</th></tr>
     </thead>
     <tbody>
-{{range $idx, $b := .}}
+{{range $idx, $u := .Upgrades}}
 {{if zebra $idx}}<tr bgcolor="#C4C2C2">{{else}}<tr bgcolor="#DBDBDB">{{end}}
-<td>{{$b.Toon.Name}}</td><td>{{$b.Level}}</td><td>{{$b.ItemLevel}}</td><td>{{$b.LastModifiedAsDateTime}}</td><td>{{$b.CreateDate.Format "2006-01-02"}}</td></tr>
+<td>{{$u.Date.Format "2006-01-02"}}</td><td>{{$u.Toon.Name}}</td><td>{{$u.Slot}}</td><td>{{describeItem $u.Old}}</td><td>{{describeItem $u.New}}</td><td>{{printf "%+d" $u.Delta}}</td></tr>
 {{end}}
 </tbody></table><p>
+{{end}}
 `
 	r := NewEmailRequest(env.config.Email.ToAddress, env.config.Email.FromAddress, "WoW Stats", env.config.Email.Server, "")
-	err = r.ParseTemplate(tpl, stats)
+	err = r.ParseTemplate(tpl, data)
 	if err != nil {
 		return err
 	}
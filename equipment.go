@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// What a toon had equipped in a slot on a day. Slot is the Profile API slot type, like HEAD or TRINKET_1,
+// and Quality is its quality type, like EPIC. BonusList and AzeritePowers are comma separated IDs.
+type EquipmentSnapshot struct {
+	ID            int64
+	ToonID        uint
+	InsertDate    time.Time `gorm:"type:date"`
+	Slot          string
+	ItemID        int64
+	Name          string
+	ItemLevel     int64
+	Quality       string
+	BonusList     string
+	AzeritePowers string
+}
+
+// Keep InsertDate to just the day, for the same reason as Stat.
+func (e *EquipmentSnapshot) BeforeSave() error {
+	e.InsertDate = truncateToDay(e.InsertDate)
+	return nil
+}
+
+// A slot that has something different in it than the last time the toon's equipment was recorded. Old is
+// empty when the slot was empty before.
+type EquipmentChange struct {
+	Toon Toon
+	Date time.Time
+	Slot string
+	Old  EquipmentSnapshot
+	New  EquipmentSnapshot
+}
+
+// How much the item level in the slot went up, or down.
+func (c EquipmentChange) Delta() int64 {
+	return c.New.ItemLevel - c.Old.ItemLevel
+}
+
+// How many days of upgrades go in the summary and the email.
+const upgradeReportDays = 7
+
+// The Community API used its own names for the slots and numbers for the qualities.
+var communitySlots = map[string]string{
+	"head": "HEAD", "neck": "NECK", "shoulder": "SHOULDER", "back": "BACK", "chest": "CHEST", "shirt": "SHIRT",
+	"tabard": "TABARD", "wrist": "WRIST", "hands": "HANDS", "waist": "WAIST", "legs": "LEGS", "feet": "FEET",
+	"finger1": "FINGER_1", "finger2": "FINGER_2", "trinket1": "TRINKET_1", "trinket2": "TRINKET_2",
+	"mainHand": "MAIN_HAND", "offHand": "OFF_HAND",
+}
+var communityQualities = []string{"POOR", "COMMON", "UNCOMMON", "RARE", "EPIC", "LEGENDARY", "ARTIFACT", "HEIRLOOM"}
+
+// Get what's in each slot from a character document, either the Profile API or the Community API one.
+func ParseEquipment(myJson string) []EquipmentSnapshot {
+	var equipment []EquipmentSnapshot
+
+	if items := gjson.Get(myJson, "equipment.equipped_items"); items.Exists() {
+		items.ForEach(func(_, item gjson.Result) bool {
+			equipment = append(equipment, EquipmentSnapshot{
+				Slot:          item.Get("slot.type").String(),
+				ItemID:        item.Get("item.id").Int(),
+				Name:          item.Get("name").String(),
+				ItemLevel:     item.Get("level.value").Int(),
+				Quality:       item.Get("quality.type").String(),
+				BonusList:     joinIds(item.Get("bonus_list")),
+				AzeritePowers: joinIds(item.Get("azerite_details.selected_powers.#.id")),
+			})
+			return true
+		})
+		return equipment
+	}
+
+	gjson.Get(myJson, "items").ForEach(func(key, item gjson.Result) bool {
+		slot, ok := communitySlots[key.String()]
+		if !ok {
+			return true
+		}
+		quality := ""
+		if q := item.Get("quality").Int(); q >= 0 && int(q) < len(communityQualities) {
+			quality = communityQualities[q]
+		}
+		equipment = append(equipment, EquipmentSnapshot{
+			Slot:          slot,
+			ItemID:        item.Get("id").Int(),
+			Name:          item.Get("name").String(),
+			ItemLevel:     item.Get("itemLevel").Int(),
+			Quality:       quality,
+			BonusList:     joinIds(item.Get("bonusLists")),
+			AzeritePowers: joinIds(item.Get("azeriteEmpoweredItem.azeritePowers.#(id>0)#.id")),
+		})
+		return true
+	})
+	return equipment
+}
+
+func joinIds(ids gjson.Result) string {
+	var parts []string
+	for _, id := range ids.Array() {
+		parts = append(parts, strconv.FormatInt(id.Int(), 10))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Save what the toon had equipped on a day.
+func saveEquipment(ctx context.Context, env *Env, toonId uint, day time.Time, myJson string) error {
+	equipment := ParseEquipment(myJson)
+	if len(equipment) == 0 {
+		return nil
+	}
+	for i := range equipment {
+		equipment[i].ToonID = toonId
+		equipment[i].InsertDate = day
+	}
+	return env.db.SaveEquipment(ctx, toonId, day, equipment)
+}
+
+// Work out the slot changes from a toon's equipment history, which has to be ordered by date. Each day is
+// compared to the day before it that has equipment. Slots that were emptied aren't changes.
+func equipmentChanges(toon Toon, history []EquipmentSnapshot) []EquipmentChange {
+	var changes []EquipmentChange
+	var previous map[string]EquipmentSnapshot
+	for start := 0; start < len(history); {
+		end := start
+		current := make(map[string]EquipmentSnapshot)
+		for end < len(history) && history[end].InsertDate.Equal(history[start].InsertDate) {
+			current[history[end].Slot] = history[end]
+			end++
+		}
+
+		if previous != nil {
+			for slot, item := range current {
+				old := previous[slot]
+				if old.ItemID != item.ItemID || old.ItemLevel != item.ItemLevel {
+					changes = append(changes, EquipmentChange{Toon: toon, Date: item.InsertDate, Slot: slot, Old: old, New: item})
+				}
+			}
+		}
+		previous = current
+		start = end
+	}
+	return changes
+}
+
+// Get the slot changes for every toon on or after since, ordered by date, toon and slot.
+func EquipmentUpgrades(ctx context.Context, env *Env, since time.Time) ([]EquipmentChange, error) {
+	toons, err := env.db.GetAllToons(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []EquipmentChange
+	for _, t := range toons {
+		history, err := env.db.GetEquipmentHistory(ctx, t.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range equipmentChanges(t, history) {
+			if !c.Date.Before(since) {
+				changes = append(changes, c)
+			}
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		a, b := changes[i], changes[j]
+		if !a.Date.Equal(b.Date) {
+			return a.Date.Before(b.Date)
+		}
+		if a.Toon.Name != b.Toon.Name {
+			return a.Toon.Name < b.Toon.Name
+		}
+		return a.Slot < b.Slot
+	})
+	return changes, nil
+}
+
+// The upgrades for the summary and email, the last upgradeReportDays days.
+func recentUpgrades(ctx context.Context, env *Env) ([]EquipmentChange, error) {
+	return EquipmentUpgrades(ctx, env, time.Now().AddDate(0, 0, -upgradeReportDays))
+}
+
+// Write the slot changes as a table, one row per change.
+func PrintUpgrades(changes []EquipmentChange, out io.Writer) error {
+	w := tabwriter.NewWriter(out, 5, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "Date\tName\tSlot\tOld\tNew\tDelta\t")
+	for _, c := range changes {
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%+d\t\n", c.Date.Format("2006-01-02"), c.Toon.Name, c.Slot,
+			describeItem(c.Old), describeItem(c.New), c.Delta())
+	}
+	return w.Flush()
+}
+
+func describeItem(e EquipmentSnapshot) string {
+	if e.ItemID == 0 {
+		return "(empty)"
+	}
+	return fmt.Sprintf("%v (%v)", e.Name, e.ItemLevel)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseEquipment(t *testing.T) {
+	for _, file := range []string{"test-json-profile.json", "test-json.json"} {
+		jsonText, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Could not read file: %v", err)
+		}
+
+		equipment := ParseEquipment(string(jsonText))
+		if len(equipment) != 17 {
+			t.Errorf("%s: want 17 slots, got %v", file, len(equipment))
+		}
+		found := false
+		for _, e := range equipment {
+			if e.Slot != "HEAD" {
+				continue
+			}
+			found = true
+			if e.ItemID != 157969 || e.ItemLevel != 420 || e.Quality != "EPIC" || e.BonusList != "1607,4786,6264" || e.AzeritePowers != "13,44,21,115,166" {
+				t.Errorf("%s: head incorrect, got %+v", file, e)
+			}
+		}
+		if !found {
+			t.Errorf("%s: no head slot", file)
+		}
+	}
+}
+
+func TestEquipmentUpgrades(t *testing.T) {
+	ctx := context.Background()
+	db, env, cleanup := newMigratedEnv(t)
+	defer cleanup()
+
+	toon := insertTestToon(t, db)
+
+	profile, _ := ioutil.ReadFile("test-json-profile.json")
+	later := strings.Replace(string(profile), `"value": 420,`, `"value": 430,`, 1)
+	if later == string(profile) {
+		t.Fatal("Could not change the head item level")
+	}
+	days := []time.Time{time.Date(2019, 10, 16, 0, 0, 0, 0, time.UTC), time.Date(2019, 10, 17, 0, 0, 0, 0, time.UTC)}
+	for i, doc := range []string{string(profile), later} {
+		if err := saveEquipment(ctx, env, toon.ID, days[i], doc); err != nil {
+			t.Fatalf("saveEquipment failed: %v", err)
+		}
+	}
+	// Saving a day again replaces it rather than adding to it.
+	if err := saveEquipment(ctx, env, toon.ID, days[1], later); err != nil {
+		t.Fatalf("saveEquipment failed: %v", err)
+	}
+
+	changes, err := EquipmentUpgrades(ctx, env, days[0])
+	if err != nil {
+		t.Fatalf("EquipmentUpgrades failed: %v", err)
+	}
+	if len(changes) != 1 {
+		t.Fatalf("Want one change, got %+v", changes)
+	}
+	if c := changes[0]; c.Slot != "HEAD" || c.Delta() != 10 || !c.Date.Equal(days[1]) || c.Toon.Name != "Borvoh" {
+		t.Errorf("Change incorrect, got %+v", c)
+	}
+
+	changes, _ = EquipmentUpgrades(ctx, env, days[1].AddDate(0, 0, 1))
+	if len(changes) != 0 {
+		t.Errorf("Want no changes after the last day, got %+v", changes)
+	}
+
+	var out bytes.Buffer
+	err = PrintUpgrades(changes[:0], &out)
+	if err != nil || !strings.Contains(out.String(), "Delta") {
+		t.Errorf("PrintUpgrades incorrect: %v\n%s", err, out.String())
+	}
+}
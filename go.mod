@@ -6,6 +6,7 @@ require (
 	github.com/adrg/xdg v0.0.0-20191014103126-5e0e8ae1af11
 	github.com/jessevdk/go-flags v1.4.0
 	github.com/jinzhu/gorm v1.9.11
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/viper v1.4.0
 	github.com/tidwall/gjson v1.9.3
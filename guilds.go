@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// A guild whose roster is tracked. Members that are at least MinLevel and have a rank of MaxRank or better,
+// 0 being the guild master, are added as toons. A MaxRank below 0 takes every rank. Added is the day the
+// guild was registered, everyone in it on that day was already a member.
+type Guild struct {
+	ID       int64
+	Name     string
+	Realm    string
+	Region   string
+	MinLevel int64
+	MaxRank  int64
+	Added    time.Time `gorm:"type:date"`
+}
+
+// Keep Added to just the day, for the same reason as Stat.
+func (g *Guild) BeforeSave() error {
+	g.Added = truncateToDay(g.Added)
+	return nil
+}
+
+// Whether a member gets added as a toon.
+func (g *Guild) enrolls(m GuildMember) bool {
+	return m.Level >= g.MinLevel && (g.MaxRank < 0 || m.GuildRank <= g.MaxRank)
+}
+
+// A character's time in a guild, from the day it was first on the roster until the day it wasn't. LeaveDate
+// is nil while it's still a member, a character that leaves and comes back gets another row. ToonID is set
+// once the member is a toon, either because it passed the guild's filter or because it was already one.
+type GuildMember struct {
+	ID        int64
+	GuildID   int64
+	ToonID    *uint
+	Name      string
+	Realm     string
+	Level     int64
+	GuildRank int64
+	ClassID   int64
+	RaceID    int64
+	JoinDate  time.Time  `gorm:"type:date"`
+	LeaveDate *time.Time `gorm:"type:date"`
+}
+
+// Keep the dates to just the day, for the same reason as Stat.
+func (m *GuildMember) BeforeSave() error {
+	m.JoinDate = truncateToDay(m.JoinDate)
+	if m.LeaveDate != nil {
+		left := truncateToDay(*m.LeaveDate)
+		m.LeaveDate = &left
+	}
+	return nil
+}
+
+// Name and realm slug, which is how roster members are matched up.
+func (m *GuildMember) key() string {
+	return strings.ToLower(m.Name) + "-" + realmSlug(m.Realm)
+}
+
+// A toon that isn't fetched any more. GuildID is the guild it left, 0 when it was deactivated by hand.
+type InactiveToon struct {
+	ToonID  uint `gorm:"primary_key;auto_increment:false"`
+	GuildID int64
+	Since   time.Time `gorm:"type:date"`
+}
+
+// Keep Since to just the day, for the same reason as Stat.
+func (t *InactiveToon) BeforeSave() error {
+	t.Since = truncateToDay(t.Since)
+	return nil
+}
+
+// What a roster sync changed.
+type GuildSync struct {
+	Guild       Guild
+	Joined      []GuildMember
+	Left        []GuildMember
+	Enrolled    []Toon
+	Deactivated []Toon
+}
+
+// Get the members from a guild roster document. The roster only has the realm slug, the realm is kept as the
+// name realmName makes of it.
+func ParseGuildRoster(myJson string) []GuildMember {
+	var members []GuildMember
+	gjson.Get(myJson, "members").ForEach(func(_, m gjson.Result) bool {
+		members = append(members, GuildMember{
+			Name:      m.Get("character.name").String(),
+			Realm:     realmName(m.Get("character.realm.slug").String()),
+			Level:     m.Get("character.level").Int(),
+			GuildRank: m.Get("rank").Int(),
+			ClassID:   m.Get("character.playable_class.id").Int(),
+			RaceID:    m.Get("character.playable_race.id").Int(),
+		})
+		return true
+	})
+	return members
+}
+
+// Work out the guild's members after a roster fetch. It returns everyone on the roster, with the row they
+// already had when they were already members, and the members that aren't on it any more with LeaveDate set.
+func rosterChanges(current []GuildMember, roster []GuildMember, guildId int64, day time.Time) ([]GuildMember, []GuildMember) {
+	day = truncateToDay(day)
+	byKey := make(map[string]GuildMember)
+	for _, m := range current {
+		byKey[m.key()] = m
+	}
+
+	var members, left []GuildMember
+	seen := make(map[string]bool)
+	for _, r := range roster {
+		seen[r.key()] = true
+		m, ok := byKey[r.key()]
+		if !ok {
+			m = GuildMember{GuildID: guildId, Name: r.Name, Realm: r.Realm, JoinDate: day}
+		}
+		m.Level = r.Level
+		m.GuildRank = r.GuildRank
+		m.ClassID = r.ClassID
+		m.RaceID = r.RaceID
+		members = append(members, m)
+	}
+
+	for _, m := range current {
+		if !seen[m.key()] {
+			m.LeaveDate = &day
+			left = append(left, m)
+		}
+	}
+	return members, left
+}
+
+// Fetch a guild's roster and bring its members up to date. New members that pass the guild's filter become
+// toons, members that are already toons are linked to them and get fetched again if they had left, and toons
+// that left are deactivated unless they're still in another tracked guild. Members get their realm's name from
+// the realms table when it has the realm.
+func SyncGuild(ctx context.Context, env *Env, blizzard Blizzard, guild Guild) (*GuildSync, error) {
+	myJson, err := blizzard.GetGuildRoster(ctx, guild)
+	if err != nil {
+		return nil, err
+	}
+	roster := ParseGuildRoster(myJson)
+	realms, err := env.db.GetRealms(ctx, strings.ToLower(guild.Region))
+	if err != nil {
+		return nil, err
+	}
+	realmNames := make(map[string]string)
+	for i := range realms {
+		realmNames[realms[i].Slug] = realms[i].storedName()
+	}
+	for i := range roster {
+		if name, ok := realmNames[realmSlug(roster[i].Realm)]; ok {
+			roster[i].Realm = name
+		}
+	}
+
+	history, err := env.db.GetGuildMembers(ctx, guild.ID)
+	if err != nil {
+		return nil, err
+	}
+	var current []GuildMember
+	for _, m := range history {
+		if m.LeaveDate == nil {
+			current = append(current, m)
+		}
+	}
+	toons, err := env.db.GetAllToons(ctx)
+	if err != nil {
+		return nil, err
+	}
+	inactive, err := env.db.GetInactiveToons(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	toonsByKey := make(map[string]Toon)
+	for _, t := range toons {
+		if strings.EqualFold(t.Region, guild.Region) {
+			toonsByKey[strings.ToLower(t.Name)+"-"+realmSlug(t.Realm)] = t
+		}
+	}
+	toonsById := make(map[uint]Toon)
+	for _, t := range toons {
+		toonsById[t.ID] = t
+	}
+	inactiveById := make(map[uint]InactiveToon)
+	for _, t := range inactive {
+		inactiveById[t.ToonID] = t
+	}
+
+	day := time.Now()
+	sync := &GuildSync{Guild: guild}
+	members, left := rosterChanges(current, roster, guild.ID, day)
+	for i := range members {
+		m := &members[i]
+		if m.ID == 0 {
+			sync.Joined = append(sync.Joined, *m)
+		}
+
+		if m.ToonID == nil {
+			if t, ok := toonsByKey[m.key()]; ok {
+				m.ToonID = &t.ID
+			} else if guild.enrolls(*m) {
+				t := Toon{Name: m.Name, RaceID: m.RaceID, ClassID: m.ClassID, Realm: m.Realm, Region: guild.Region}
+				err = env.db.InsertToon(ctx, &t)
+				if err != nil {
+					log.WithFields(log.Fields{"guild": guild.Name, "toon": m.Name}).Errorf("Could not add guild member: %v", err)
+					continue
+				}
+				m.ToonID = &t.ID
+				sync.Enrolled = append(sync.Enrolled, t)
+			}
+		}
+
+		if m.ToonID != nil {
+			if status, ok := inactiveById[*m.ToonID]; ok && status.GuildID == guild.ID {
+				err = env.db.SetToonActive(ctx, *m.ToonID)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	err = env.db.SaveGuildMembers(ctx, append(members, left...))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range left {
+		sync.Left = append(sync.Left, m)
+		if m.ToonID == nil {
+			continue
+		}
+		memberships, err := env.db.GetCurrentMemberships(ctx, *m.ToonID)
+		if err != nil {
+			return nil, err
+		}
+		if len(memberships) > 0 {
+			continue
+		}
+		err = env.db.SetToonInactive(ctx, InactiveToon{ToonID: *m.ToonID, GuildID: guild.ID, Since: day})
+		if err != nil {
+			return nil, err
+		}
+		sync.Deactivated = append(sync.Deactivated, toonsById[*m.ToonID])
+	}
+	return sync, nil
+}
+
+// Sync every tracked guild. A guild that can't be fetched is logged and skipped, the others still get synced.
+func SyncGuilds(ctx context.Context, env *Env, blizzard Blizzard) error {
+	guilds, err := env.db.GetGuilds(ctx)
+	if err != nil {
+		return err
+	}
+	for _, g := range guilds {
+		sync, err := SyncGuild(ctx, env, blizzard, g)
+		if err != nil {
+			log.WithFields(log.Fields{"guild": g.Name, "realm": g.Realm, "region": g.Region}).Errorf("Could not sync guild: %v", err)
+			continue
+		}
+		log.WithFields(log.Fields{
+			"guild":       g.Name,
+			"joined":      len(sync.Joined),
+			"left":        len(sync.Left),
+			"enrolled":    len(sync.Enrolled),
+			"deactivated": len(sync.Deactivated),
+		}).Debug("Synced guild roster")
+	}
+	return nil
+}
+
+// Register a guild and do its first sync. The realm is matched the same way as a toon's. The guild is only kept
+// if its roster could be fetched.
+func AddGuild(ctx context.Context, env *Env, blizzard Blizzard, guild Guild, out io.Writer) error {
+	if _, err := GetRegion(guild.Region); err != nil {
+		return err
+	}
+	realm, err := resolveRealm(ctx, env, blizzard, guild.Realm, guild.Region)
+	if err != nil {
+		return err
+	}
+	if realm != nil {
+		guild.Realm = realm.storedName()
+	}
+	if _, err := blizzard.GetGuildRoster(ctx, guild); err != nil {
+		return fmt.Errorf("could not find guild: %v", err)
+	}
+
+	guild.Added = time.Now()
+	err = env.db.InsertGuild(ctx, &guild)
+	if err != nil {
+		return fmt.Errorf("could not insert guild into database: %v", err)
+	}
+	sync, err := SyncGuild(ctx, env, blizzard, guild)
+	if err != nil {
+		return err
+	}
+
+	_, _ = fmt.Fprintf(out, "Added %v-%v with %v members, %v of them new toons:\n", guild.Name, guild.Realm, len(sync.Joined), len(sync.Enrolled))
+	for _, t := range sync.Enrolled {
+		_, _ = fmt.Fprintf(out, "  %v\n", t.Name)
+	}
+	return nil
+}
+
+// Print the tracked guilds and the members that joined or left in the last days days. The members that were
+// there when a guild was added didn't join then, they aren't listed.
+func PrintGuilds(ctx context.Context, env *Env, days int, out io.Writer) error {
+	guilds, err := env.db.GetGuilds(ctx)
+	if err != nil {
+		return err
+	}
+	since := truncateToDay(time.Now().AddDate(0, 0, -days))
+
+	type event struct {
+		date   time.Time
+		guild  string
+		member GuildMember
+		kind   string
+	}
+	var events []event
+
+	w := tabwriter.NewWriter(out, 5, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "Guild\tRealm\tRegion\tMembers\tToons\tMin Level\tMax Rank\t")
+	for _, g := range guilds {
+		members, err := env.db.GetGuildMembers(ctx, g.ID)
+		if err != nil {
+			return err
+		}
+		current, tracked := 0, 0
+		for _, m := range members {
+			if m.LeaveDate == nil {
+				current++
+				if m.ToonID != nil {
+					tracked++
+				}
+			}
+			if !m.JoinDate.Before(since) && m.JoinDate.After(truncateToDay(g.Added)) {
+				events = append(events, event{m.JoinDate, g.Name, m, "joined"})
+			}
+			if m.LeaveDate != nil && !m.LeaveDate.Before(since) {
+				events = append(events, event{*m.LeaveDate, g.Name, m, "left"})
+			}
+		}
+		maxRank := "any"
+		if g.MaxRank >= 0 {
+			maxRank = fmt.Sprint(g.MaxRank)
+		}
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t\n", g.Name, g.Realm, g.Region, current, tracked, g.MinLevel, maxRank)
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].date.After(events[j].date)
+	})
+	_, _ = fmt.Fprintf(out, "\nJoined and left in the last %v days:\n", days)
+	w = tabwriter.NewWriter(out, 5, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "Date\tGuild\tName\tLevel\tRank\tEvent\t")
+	for _, e := range events {
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t\n", e.date.Format("2006-01-02"), e.guild, e.member.Name, e.member.Level, e.member.GuildRank, e.kind)
+	}
+	return w.Flush()
+}
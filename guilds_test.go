@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseGuildRoster(t *testing.T) {
+	jsonText, err := ioutil.ReadFile("test-json-guild-roster.json")
+	if err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	}
+
+	members := ParseGuildRoster(string(jsonText))
+	if len(members) != 6 {
+		t.Fatalf("Want 6 members, got %v", len(members))
+	}
+	want := GuildMember{Name: "Borvoh", Realm: "Duskwood", Level: 120, GuildRank: 3, ClassID: 5, RaceID: 29}
+	if members[1].Name != want.Name || members[1].Realm != want.Realm || members[1].Level != want.Level ||
+		members[1].GuildRank != want.GuildRank || members[1].ClassID != want.ClassID || members[1].RaceID != want.RaceID {
+		t.Errorf("Borvoh incorrect, got %+v want %+v", members[1], want)
+	}
+	if members[5].Name != "Aurelia" || members[5].Realm != "Argent Dawn" || realmSlug(members[5].Realm) != "argent-dawn" {
+		t.Errorf("Aurelia's realm should slug back to argent-dawn, got %+v", members[5])
+	}
+}
+
+// The roster without Kessla and with Shadowpaw promoted to rank 6.
+func changedRoster(t *testing.T) string {
+	jsonText, _ := ioutil.ReadFile("test-json-guild-roster.json")
+	var doc map[string]interface{}
+	if err := json.Unmarshal(jsonText, &doc); err != nil {
+		t.Fatal(err)
+	}
+	var members []interface{}
+	for _, m := range doc["members"].([]interface{}) {
+		member := m.(map[string]interface{})
+		switch member["character"].(map[string]interface{})["name"] {
+		case "Kessla":
+			continue
+		case "Shadowpaw":
+			member["rank"] = 6
+		}
+		members = append(members, member)
+	}
+	doc["members"] = members
+
+	roster, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(roster)
+}
+
+func activeToonNames(t *testing.T, db *WowDB) string {
+	toons, err := db.GetActiveToons(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, toon := range toons {
+		names = append(names, toon.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestSyncGuild(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeBlizzard(t)
+	defer fake.Close()
+	blizzard := newTestBlizzard(t, fake.Transport())
+	db, env, cleanup := newMigratedEnv(t)
+	defer cleanup()
+
+	insertTestToon(t, db)
+
+	// Altoon is under the level and Shadowpaw's rank is too low, Borvoh is already a toon.
+	guild := Guild{Name: "Hand of Azeroth", Realm: "Duskwood", Region: "us", MinLevel: 50, MaxRank: 6}
+	var out bytes.Buffer
+	if err := AddGuild(ctx, env, blizzard, guild, &out); err != nil {
+		t.Fatalf("AddGuild failed: %v", err)
+	}
+	if !strings.HasPrefix(out.String(), "Added Hand of Azeroth-Duskwood with 6 members, 3 of them new toons") {
+		t.Errorf("AddGuild output incorrect:\n%s", out.String())
+	}
+	if names := activeToonNames(t, db); names != "Borvoh,Thrandor,Kessla,Aurelia" {
+		t.Errorf("Want Borvoh, Thrandor, Kessla and Aurelia to be fetched, got %v", names)
+	}
+	aurelia, err := FindToon(ctx, env, "Aurelia")
+	if err != nil || aurelia.Realm != "Argent Dawn" {
+		t.Errorf("Aurelia should be on Argent Dawn, got %+v: %v", aurelia, err)
+	}
+
+	guilds, _ := db.GetGuilds(ctx)
+	if len(guilds) != 1 {
+		t.Fatalf("Want 1 guild, got %+v", guilds)
+	}
+	roster := fake.documents["/data/wow/guild/duskwood/hand-of-azeroth/roster"]
+	fake.documents["/data/wow/guild/duskwood/hand-of-azeroth/roster"] = changedRoster(t)
+	sync, err := SyncGuild(ctx, env, blizzard, guilds[0])
+	if err != nil {
+		t.Fatalf("SyncGuild failed: %v", err)
+	}
+	if len(sync.Joined) != 0 || len(sync.Left) != 1 || len(sync.Enrolled) != 1 || len(sync.Deactivated) != 1 ||
+		sync.Enrolled[0].Name != "Shadowpaw" || sync.Deactivated[0].Name != "Kessla" {
+		t.Errorf("Sync incorrect, got %+v", sync)
+	}
+	if names := activeToonNames(t, db); names != "Borvoh,Thrandor,Aurelia,Shadowpaw" {
+		t.Errorf("Want Borvoh, Thrandor, Aurelia and Shadowpaw to be fetched, got %v", names)
+	}
+
+	// Kessla coming back is a new membership and gets fetched again.
+	fake.documents["/data/wow/guild/duskwood/hand-of-azeroth/roster"] = roster
+	sync, err = SyncGuild(ctx, env, blizzard, guilds[0])
+	if err != nil {
+		t.Fatalf("SyncGuild failed: %v", err)
+	}
+	if len(sync.Joined) != 1 || len(sync.Enrolled) != 0 {
+		t.Errorf("Sync incorrect, got %+v", sync)
+	}
+	if names := activeToonNames(t, db); names != "Borvoh,Thrandor,Kessla,Aurelia,Shadowpaw" {
+		t.Errorf("Want Kessla to be fetched again, got %v", names)
+	}
+	members, _ := db.GetGuildMembers(ctx, guilds[0].ID)
+	if len(members) != 7 {
+		t.Errorf("Want 7 memberships, got %v", len(members))
+	}
+
+	out.Reset()
+	if err := PrintGuilds(ctx, env, 7, &out); err != nil {
+		t.Fatalf("PrintGuilds failed: %v", err)
+	}
+	lines := tableLines(out.String())
+	today := truncateToDay(time.Now()).Format("2006-01-02")
+	for _, s := range []string{"Hand of Azeroth Duskwood us 6 5 50 6", today + " Hand of Azeroth Kessla 120 5 left"} {
+		if !lines[s] {
+			t.Errorf("PrintGuilds missing %q:\n%s", s, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "joined") {
+		t.Errorf("The members from when the guild was added didn't join:\n%s", out.String())
+	}
+}
+
+func TestNormalizeRealms(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeBlizzard(t)
+	defer fake.Close()
+	blizzard := newTestBlizzard(t, fake.Transport())
+	db, env, cleanup := newMigratedEnv(t)
+	defer cleanup()
+
+	// What the roster used to keep for Argent Dawn, next to a realm that really has a hyphen.
+	guild := Guild{Name: "Hand of Azeroth", Realm: "Duskwood", Region: "us", MinLevel: 50, MaxRank: 6}
+	if err := db.InsertGuild(ctx, &guild); err != nil {
+		t.Fatal(err)
+	}
+	for _, toon := range []Toon{
+		{Name: "Aurelia", RaceID: 1, ClassID: 2, Realm: "Argent-Dawn", Region: "us"},
+		{Name: "Borvoh", RaceID: 29, ClassID: 5, Realm: "Azjol-Nerub", Region: "us"},
+		{Name: "Thrandor", RaceID: 1, ClassID: 1, Realm: "Argent-Dawn", Region: "eu"},
+	} {
+		if err := db.InsertToon(ctx, &toon); err != nil {
+			t.Fatal(err)
+		}
+	}
+	member := GuildMember{GuildID: guild.ID, Name: "Aurelia", Realm: "Argent-Dawn", Level: 120, JoinDate: time.Now()}
+	if err := db.SaveGuildMembers(ctx, []GuildMember{member}); err != nil {
+		t.Fatal(err)
+	}
+	// Wardens was added again once guilds got the realm's name, renaming the old one would break the unique index.
+	for _, g := range []Guild{
+		{Name: "Wardens", Realm: "Argent-Dawn", Region: "us"},
+		{Name: "Wardens", Realm: "Argent Dawn", Region: "us"},
+		{Name: "Silver Hand", Realm: "Argent-Dawn", Region: "us"},
+	} {
+		if err := db.InsertGuild(ctx, &g); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := UpdateRealmsFromBlizzard(ctx, env, blizzard, "us"); err != nil {
+		t.Fatal(err)
+	}
+	if err := NormalizeRealms(ctx, env, []string{"us", "eu"}); err != nil {
+		t.Fatalf("NormalizeRealms failed: %v", err)
+	}
+	toons, _ := db.GetAllToons(ctx)
+	var realms []string
+	for _, toon := range toons {
+		realms = append(realms, toon.Name+" "+toon.Realm)
+	}
+	want := "Aurelia Argent Dawn,Borvoh Azjol-Nerub,Thrandor Argent-Dawn"
+	if strings.Join(realms, ",") != want {
+		t.Errorf("Toon realms incorrect, want %v got %v", want, strings.Join(realms, ","))
+	}
+	members, _ := db.GetGuildMembers(ctx, guild.ID)
+	if len(members) != 1 || members[0].Realm != "Argent Dawn" {
+		t.Errorf("Aurelia's membership should be on Argent Dawn, got %+v", members)
+	}
+	guilds, _ := db.GetGuilds(ctx)
+	var names []string
+	for _, g := range guilds {
+		names = append(names, g.Name+" "+g.Realm)
+	}
+	sort.Strings(names)
+	want = "Hand of Azeroth Duskwood,Silver Hand Argent Dawn,Wardens Argent Dawn,Wardens Argent-Dawn"
+	if strings.Join(names, ",") != want {
+		t.Errorf("Guild realms incorrect, want %v got %v", want, strings.Join(names, ","))
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run update, add, collect and summary the way main does, against the fake Blizzard.
+func TestMainFlow(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeBlizzard(t)
+	defer fake.Close()
+	blizzard := newTestBlizzard(t, fake.Transport())
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	env := &Env{db: db, config: Config{Concurrency: 2, ToonTimeout: time.Minute}}
+	opts.Quiet = true
+
+	// On an empty database the migrations load the classes and races too, so update has nothing to add.
+	if err := doDatabaseMigrations(ctx, db, env, blizzard); err != nil {
+		t.Fatalf("doDatabaseMigrations failed: %v", err)
+	}
+
+	err := UpdateClassesFromBlizzard(ctx, env, blizzard)
+	if err != nil {
+		t.Fatalf("UpdateClassesFromBlizzard failed: %v", err)
+	}
+	err = UpdateRacesFromBlizzard(ctx, env, blizzard)
+	if err != nil {
+		t.Fatalf("UpdateRacesFromBlizzard failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	err = AddToon(ctx, env, blizzard, strings.NewReader("borvoh\nduskwood\nus\ny\n"), &out)
+	if err != nil {
+		t.Fatalf("AddToon failed: %v", err)
+	}
+
+	toons, _ := env.db.GetAllToons(ctx)
+	if len(toons) != 1 || toons[0].Name != "Borvoh" || toons[0].ClassID != 5 || toons[0].RaceID != 29 {
+		t.Fatalf("AddToon did not add Borvoh, toons are %+v", toons)
+	}
+
+	CollectStats(ctx, env, blizzard, toons)
+
+	stats, err := env.db.GetLatestStats(ctx, toons[0].ID)
+	if err != nil {
+		t.Fatalf("CollectStats did not insert stats: %v", err)
+	}
+	if stats.Level != 120 || stats.ItemLevel != 415 || stats.AchievementPoints != 21835 {
+		t.Errorf("Collected stats incorrect, got %+v", stats)
+	}
+
+	raids, _ := env.db.GetRaidProgress(ctx)
+	if len(raids) != 7 {
+		t.Errorf("CollectStats should have saved the raid progress, got %+v", raids)
+	}
+	brackets, _ := env.db.GetPvpBracketHistory(ctx, toons[0].ID, time.Time{})
+	if len(brackets) != 3 {
+		t.Errorf("CollectStats should have saved the 3 PvP brackets, got %+v", brackets)
+	}
+
+	out.Reset()
+	err = PrintSummary(ctx, env, &out)
+	if err != nil {
+		t.Fatalf("PrintSummary failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "Borvoh") || !strings.Contains(out.String(), "415") || !strings.Contains(out.String(), "565") {
+		t.Errorf("Summary missing Borvoh:\n%s", out.String())
+	}
+}
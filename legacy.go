@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	defaultLegacyToonTable  = "toon"
+	defaultLegacyStatsTable = "stats"
+)
+
+// Where the tables from the Python and Groovy versions are. With no DbUrl they're read from the wowstats
+// database itself, in which case they need to have been renamed or moved to another schema since the
+// current stats table has the same name.
+type LegacyConfig struct {
+	DbDriver   string
+	DbUrl      string
+	ToonTable  string
+	StatsTable string
+}
+
+// Row of the legacy toon table.
+type LegacyToon struct {
+	ID      int64
+	Name    string
+	RaceID  int64
+	ClassID int64
+	Gender  int64
+	Realm   string
+	Region  string
+}
+
+// Row of the legacy stats table. The columns other than toon_id could be null, they're read as 0.
+type LegacyStat struct {
+	ToonID            int64
+	LastModified      int64
+	CreateDate        time.Time
+	AchievementPoints int64
+	NumberExalted     int64
+	MountsOwned       int64
+	QuestsCompleted   int64
+	FishCaught        int64
+	PetsOwned         int64
+	PetBattlesWon     int64
+	PetBattlesPvpWon  int64
+	Level             int64
+	ItemLevel         int64
+	HonorableKills    int64
+}
+
+const legacyStatColumns = `toon_id, COALESCE(last_modified, 0) AS last_modified, create_date,
+	COALESCE(achievement_points, 0) AS achievement_points, COALESCE(number_exalted, 0) AS number_exalted,
+	COALESCE(mounts_owned, 0) AS mounts_owned, COALESCE(quests_completed, 0) AS quests_completed,
+	COALESCE(fish_caught, 0) AS fish_caught, COALESCE(pets_owned, 0) AS pets_owned,
+	COALESCE(pet_battles_won, 0) AS pet_battles_won, COALESCE(pet_battles_pvp_won, 0) AS pet_battles_pvp_won,
+	COALESCE(level, 0) AS level, COALESCE(item_level, 0) AS item_level,
+	COALESCE(honorable_kills, 0) AS honorable_kills`
+
+// Map a legacy stats row onto a Stat. The columns are the same apart from a few names.
+func (l *LegacyStat) ToStat(toonId uint) Stat {
+	return Stat{
+		ToonID:            toonId,
+		LastModified:      l.LastModified,
+		InsertDate:        l.CreateDate,
+		Level:             l.Level,
+		AchievementPoints: l.AchievementPoints,
+		ExaltedReps:       l.NumberExalted,
+		MountsCollected:   l.MountsOwned,
+		QuestsCompleted:   l.QuestsCompleted,
+		FishCaught:        l.FishCaught,
+		PetsCollected:     l.PetsOwned,
+		PetBattlesWon:     l.PetBattlesWon,
+		PetBattlesPvpWon:  l.PetBattlesPvpWon,
+		ItemLevel:         l.ItemLevel,
+		HonorableKills:    l.HonorableKills,
+	}
+}
+
+// What happened to one legacy toon's stats.
+type LegacyImportResult struct {
+	Name      string
+	Realm     string
+	Region    string
+	Created   bool
+	Legacy    int
+	Imported  int
+	Duplicate int
+	Failed    int
+	First     time.Time
+	Last      time.Time
+	Err       error
+}
+
+// Open the legacy tables described by config. db is the wowstats database, used when config has no DbUrl.
+func OpenLegacy(db *WowDB, config LegacyConfig) (*gorm.DB, func() error, error) {
+	if config.DbUrl == "" {
+		if config.StatsTable == defaultLegacyStatsTable {
+			return nil, nil, fmt.Errorf("the legacy stats table can't be read from the wowstats database as %q, that's the current stats table", config.StatsTable)
+		}
+		return db.DB, func() error { return nil }, nil
+	}
+
+	legacyDb, err := NewDB(config.DbDriver, config.DbUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+	return legacyDb.DB, legacyDb.Close, nil
+}
+
+// Copy the legacy toons and stats into env.db. A legacy toon's realm is matched to one in the realms table,
+// then the toon is matched to a toon by name, realm slug and region and added if it isn't there yet. Stats
+// for a day the toon already has are left alone, that's the same rule as idx_toon_id_create_date, so running
+// the import again only adds what's new.
+func ImportLegacy(ctx context.Context, env *Env, blizzard Blizzard, legacyDb *gorm.DB, config LegacyConfig) ([]LegacyImportResult, error) {
+	var legacyToons []LegacyToon
+	err := legacyDb.Table(config.ToonTable).Order("id").Find(&legacyToons).Error
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", config.ToonTable, err)
+	}
+
+	toons, err := env.db.GetAllToons(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []LegacyImportResult
+	for _, lt := range legacyToons {
+		if ctx.Err() != nil {
+			return results, ctx.Err()
+		}
+
+		name := strings.Title(strings.ToLower(strings.TrimSpace(lt.Name)))
+		realm := strings.Title(strings.ToLower(strings.TrimSpace(lt.Realm)))
+		region := strings.ToLower(strings.TrimSpace(lt.Region))
+		known, realmErr := resolveRealm(ctx, env, blizzard, realm, region)
+		if known != nil {
+			realm = known.storedName()
+		}
+		result := LegacyImportResult{Name: name, Realm: realm, Region: region}
+		toon, ok := findLegacyToon(toons, Toon{Name: name, Realm: realm, Region: region})
+		if !ok {
+			if realmErr != nil {
+				result.Err = realmErr
+				results = append(results, result)
+				continue
+			}
+			toon = Toon{Name: name, RaceID: lt.RaceID, ClassID: lt.ClassID, Gender: lt.Gender, Realm: realm, Region: region}
+			err = env.db.InsertToon(ctx, &toon)
+			if err != nil {
+				result.Err = fmt.Errorf("could not add toon: %v", err)
+				results = append(results, result)
+				continue
+			}
+			toons = append(toons, toon)
+			result.Created = true
+		}
+
+		err = importLegacyStats(ctx, env, legacyDb, config, lt.ID, toon.ID, &result)
+		if err != nil {
+			result.Err = err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// The toon that's the same character as the legacy one.
+func findLegacyToon(toons []Toon, legacy Toon) (Toon, bool) {
+	for _, t := range toons {
+		if legacy.sameCharacter(t) {
+			return t, true
+		}
+	}
+	return Toon{}, false
+}
+
+func legacyToonKey(name string, realm string, region string) string {
+	return strings.ToLower(name + "-" + realm + "-" + region)
+}
+
+// Import one legacy toon's stats into the toon with id toonId.
+func importLegacyStats(ctx context.Context, env *Env, legacyDb *gorm.DB, config LegacyConfig, legacyId int64, toonId uint, result *LegacyImportResult) error {
+	var legacyStats []LegacyStat
+	err := legacyDb.Table(config.StatsTable).Select(legacyStatColumns).Where("toon_id = ?", legacyId).Order("create_date").Scan(&legacyStats).Error
+	if err != nil {
+		return fmt.Errorf("could not read %s: %v", config.StatsTable, err)
+	}
+
+	current, err := env.db.GetStatsForToon(ctx, toonId)
+	if err != nil {
+		return err
+	}
+	days := make(map[string]bool)
+	for _, s := range current {
+		days[s.InsertDate.Format("2006-01-02")] = true
+	}
+
+	for _, ls := range legacyStats {
+		result.Legacy++
+		if result.First.IsZero() {
+			result.First = ls.CreateDate
+		}
+		result.Last = ls.CreateDate
+
+		day := ls.CreateDate.Format("2006-01-02")
+		if days[day] {
+			result.Duplicate++
+			continue
+		}
+
+		stats := ls.ToStat(toonId)
+		err = env.db.InsertStats(ctx, &stats)
+		if err != nil {
+			result.Failed++
+			if result.Err == nil {
+				result.Err = fmt.Errorf("could not insert stats for %s: %v", day, err)
+			}
+			continue
+		}
+		days[day] = true
+		result.Imported++
+	}
+	return result.Err
+}
+
+// Write the reconciliation report for an import: for each legacy toon how many stats rows it had and how
+// many were imported, already there or failed, then the totals. Every legacy row is in exactly one of the
+// last three columns unless the toon itself failed.
+func PrintLegacyReport(results []LegacyImportResult, out io.Writer) error {
+	sort.SliceStable(results, func(i, j int) bool {
+		return legacyToonKey(results[i].Name, results[i].Realm, results[i].Region) < legacyToonKey(results[j].Name, results[j].Realm, results[j].Region)
+	})
+
+	w := tabwriter.NewWriter(out, 5, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "Toon\tRegion\tToon Added\tLegacy Rows\tImported\tAlready Present\tFailed\tFirst\tLast\t")
+	var legacy, imported, duplicate, failed, created int
+	var errors []string
+	for _, r := range results {
+		toonAdded := "no"
+		if r.Created {
+			toonAdded = "yes"
+		}
+		_, _ = fmt.Fprintf(w, "%v-%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t\n", r.Name, r.Realm, r.Region, toonAdded,
+			r.Legacy, r.Imported, r.Duplicate, r.Failed, formatReportDate(r.First), formatReportDate(r.Last))
+
+		legacy += r.Legacy
+		imported += r.Imported
+		duplicate += r.Duplicate
+		failed += r.Failed
+		if r.Created {
+			created++
+		}
+		if r.Err != nil {
+			errors = append(errors, fmt.Sprintf("%v-%v: %v", r.Name, r.Realm, r.Err))
+		}
+	}
+	_, _ = fmt.Fprintf(w, "Total\t\t%v\t%v\t%v\t%v\t%v\t\t\t\n", created, legacy, imported, duplicate, failed)
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+
+	if len(errors) > 0 {
+		_, _ = fmt.Fprintln(out, "\nProblems:")
+		for _, e := range errors {
+			_, _ = fmt.Fprintf(out, "  %v\n", e)
+		}
+	}
+	return nil
+}
+
+func formatReportDate(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format("2006-01-02")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportLegacy(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeBlizzard(t)
+	defer fake.Close()
+	blizzard := newTestBlizzard(t, fake.Transport())
+	db, env, cleanup := newMigratedEnv(t)
+	defer cleanup()
+
+	legacyDb, legacyCleanup := newTestDB(t)
+	defer legacyCleanup()
+	for _, statement := range []string{
+		`CREATE TABLE toon (id integer PRIMARY KEY, name text, race_id integer, class_id integer, gender integer, realm text, region text)`,
+		`CREATE TABLE stats (id integer PRIMARY KEY, toon_id integer, last_modified bigint, create_date date,
+			achievement_points integer, number_exalted integer, mounts_owned integer, quests_completed integer,
+			fish_caught integer, pets_owned integer, pet_battles_won integer, pet_battles_pvp_won integer,
+			level integer, item_level integer, honorable_kills integer)`,
+		`INSERT INTO toon VALUES (7, 'borvoh', 29, 5, 0, 'duskwood', 'US')`,
+		`INSERT INTO toon VALUES (8, 'aurelia', 1, 2, 0, 'argent-dawn', 'US')`,
+		`INSERT INTO toon VALUES (9, 'talos', 1, 2, 0, 'kaelthas', 'US')`,
+		`INSERT INTO stats (toon_id, create_date, level, item_level, number_exalted, mounts_owned, pets_owned) VALUES
+			(7, '2016-09-01', 110, 850, 40, 200, 300),
+			(7, '2016-09-02', 110, 852, NULL, 201, 301),
+			(7, '2016-09-03', 110, 855, 41, 202, 302)`,
+	} {
+		if err := legacyDb.Exec(statement).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The toon is already there with one of the days.
+	toon := insertTestToon(t, db)
+	aurelia := Toon{Name: "Aurelia", RaceID: 1, ClassID: 2, Realm: "Argent Dawn", Region: "us"}
+	if err := db.InsertToon(ctx, &aurelia); err != nil {
+		t.Fatal(err)
+	}
+	existing := Stat{ToonID: toon.ID, Level: 110, InsertDate: time.Date(2016, 9, 2, 0, 0, 0, 0, time.UTC)}
+	if err := db.InsertStats(ctx, &existing); err != nil {
+		t.Fatal(err)
+	}
+
+	config := LegacyConfig{ToonTable: "toon", StatsTable: "stats"}
+	results, err := ImportLegacy(ctx, env, blizzard, legacyDb.DB, config)
+	if err != nil {
+		t.Fatalf("ImportLegacy failed: %v", err)
+	}
+	if len(results) != 3 || results[0].Created || results[0].Legacy != 3 || results[0].Imported != 2 || results[0].Duplicate != 1 || results[0].Err != nil {
+		t.Fatalf("ImportLegacy results incorrect: %+v", results)
+	}
+
+	// Argent-Dawn is the same realm as the toon's Argent Dawn, and the new toon gets the realm's real name.
+	if results[1].Created || results[1].Err != nil {
+		t.Errorf("The legacy toon should have matched Aurelia-Argent Dawn: %+v", results[1])
+	}
+	if !results[2].Created || results[2].Realm != "Kael'thas" || results[2].Err != nil {
+		t.Errorf("The new toon should be on Kael'thas: %+v", results[2])
+	}
+	toons, _ := db.GetAllToons(ctx)
+	if len(toons) != 3 {
+		t.Errorf("Want 3 toons after the import, got %+v", toons)
+	}
+
+	stats, _ := db.GetStatsForToon(ctx, toon.ID)
+	if len(stats) != 3 || stats[0].ExaltedReps != 40 || stats[0].MountsCollected != 200 || stats[2].PetsCollected != 302 {
+		t.Errorf("Imported stats incorrect: %+v", stats)
+	}
+
+	// A second import finds everything already there.
+	results, err = ImportLegacy(ctx, env, blizzard, legacyDb.DB, config)
+	if err != nil || results[0].Imported != 0 || results[0].Duplicate != 3 {
+		t.Errorf("Second import should only find duplicates, got %+v, %v", results, err)
+	}
+
+	var out bytes.Buffer
+	_ = PrintLegacyReport(results, &out)
+	if !strings.Contains(out.String(), "Borvoh-Duskwood") || !strings.Contains(out.String(), "2016-09-03") {
+		t.Errorf("Report missing the toon:\n%s", out.String())
+	}
+}
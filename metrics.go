@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"math"
+	"time"
+)
+
+// A value to track for each toon every day. It's either found with a gjson Path into the document from
+// GetToonJson or it's the achievement statistic with StatisticID, which is found wherever it is in the
+// statistics tree. Type is int or float, ints are truncated like gjson's Int. Aggregation says what to do
+// when Path matches an array: value takes a single value, count counts the elements and sum, avg, min and
+// max combine them.
+type Metric struct {
+	ID          int64
+	Name        string
+	Path        string
+	StatisticID int64
+	Type        string
+	Aggregation string
+}
+
+// Value of a metric for a toon on a day, the long format counterpart of a Stat column.
+type StatValue struct {
+	ID         int64
+	ToonID     uint
+	InsertDate time.Time `gorm:"type:date"`
+	MetricID   int64
+	Value      float64
+}
+
+// Keep InsertDate to just the day, for the same reason as Stat.
+func (v *StatValue) BeforeSave() error {
+	v.InsertDate = truncateToDay(v.InsertDate)
+	return nil
+}
+
+var metricTypes = map[string]bool{"int": true, "float": true}
+var metricAggregations = map[string]bool{"value": true, "count": true, "sum": true, "avg": true, "min": true, "max": true}
+
+// The metrics that fill in the Stat columns. These are always tracked, metrics from the config are added to them.
+var builtinMetrics = []Metric{
+	{Name: "level", Path: "level"},
+	{Name: "achievement_points", Path: "achievement_points"},
+	{Name: "exalted_reps", StatisticID: 377},
+	{Name: "mounts_collected", Path: "mounts_collection.mounts", Aggregation: "count"},
+	{Name: "quests_completed", StatisticID: 98},
+	{Name: "fish_caught", StatisticID: 1518},
+	{Name: "pets_collected", Path: "pets_collection.pets", Aggregation: "count"},
+	{Name: "pet_battles_won", StatisticID: 8278},
+	{Name: "pet_battles_pvp_won", StatisticID: 8286},
+	{Name: "item_level", Path: "average_item_level"},
+	{Name: "honorable_kills", Path: "pvp_summary.honorable_kills"},
+}
+
+// Fill in the defaults and check that a metric makes sense.
+func (m *Metric) validate() error {
+	if m.Type == "" {
+		m.Type = "int"
+	}
+	if m.Aggregation == "" {
+		m.Aggregation = "value"
+	}
+
+	switch {
+	case m.Name == "":
+		return fmt.Errorf("metric with path %q has no name", m.Path)
+	case (m.Path == "") == (m.StatisticID == 0):
+		return fmt.Errorf("metric %s needs either a path or a statisticId", m.Name)
+	case !metricTypes[m.Type]:
+		return fmt.Errorf("metric %s has unknown type %q, allowed values are int and float", m.Name, m.Type)
+	case !metricAggregations[m.Aggregation]:
+		return fmt.Errorf("metric %s has unknown aggregation %q, allowed values are value, count, sum, avg, min and max", m.Name, m.Aggregation)
+	}
+	return nil
+}
+
+// Check the metrics from the config and save them and the built in ones to the metrics table. Returns all of
+// them with their IDs.
+func RegisterMetrics(ctx context.Context, env *Env, configured []Metric) ([]Metric, error) {
+	all := append(append([]Metric(nil), builtinMetrics...), configured...)
+	names := make(map[string]bool)
+	for i := range all {
+		err := all[i].validate()
+		if err != nil {
+			return nil, err
+		}
+		if names[all[i].Name] {
+			return nil, fmt.Errorf("metric %s is defined more than once", all[i].Name)
+		}
+		names[all[i].Name] = true
+	}
+
+	for i := range all {
+		err := env.db.SaveMetric(ctx, &all[i])
+		if err != nil {
+			return nil, fmt.Errorf("could not save metric %s: %v", all[i].Name, err)
+		}
+	}
+	return all, nil
+}
+
+// Get the value of a metric from a document. Returns false if the document doesn't have it. An empty Type or
+// Aggregation is the same as the default, so builtinMetrics can leave them out.
+func (m *Metric) Evaluate(myJson string) (float64, bool) {
+	var result gjson.Result
+	if m.StatisticID != 0 {
+		result = findStatistic(myJson, m.StatisticID).Get("quantity")
+	} else {
+		result = gjson.Get(myJson, m.Path)
+	}
+	if !result.Exists() {
+		return 0, false
+	}
+
+	aggregation, valueType := m.Aggregation, m.Type
+	if aggregation == "" {
+		aggregation = "value"
+	}
+	if valueType == "" {
+		valueType = "int"
+	}
+
+	var value float64
+	if aggregation == "value" {
+		if result.IsArray() || result.IsObject() {
+			return 0, false
+		}
+		value = result.Float()
+	} else {
+		elements := []gjson.Result{result}
+		if result.IsArray() {
+			elements = result.Array()
+		}
+		if aggregation == "count" {
+			value = float64(len(elements))
+		} else if len(elements) == 0 {
+			return 0, false
+		} else {
+			value = aggregate(aggregation, elements)
+		}
+	}
+
+	if valueType == "int" {
+		value = math.Trunc(value)
+	}
+	return value, true
+}
+
+func aggregate(aggregation string, elements []gjson.Result) float64 {
+	value := elements[0].Float()
+	sum := 0.0
+	for _, e := range elements {
+		f := e.Float()
+		sum += f
+		switch {
+		case aggregation == "min" && f < value:
+			value = f
+		case aggregation == "max" && f > value:
+			value = f
+		}
+	}
+
+	switch aggregation {
+	case "sum":
+		return sum
+	case "avg":
+		return sum / float64(len(elements))
+	}
+	return value
+}
+
+// Find an achievement statistic by ID anywhere in the statistics tree. This works on both the Profile API
+// document and the old Community API one, they just spell the nesting differently.
+func findStatistic(myJson string, id int64) gjson.Result {
+	if tree := gjson.Get(myJson, "achievement_statistics.categories"); tree.Exists() {
+		return findStatisticIn(tree, id, "sub_categories")
+	}
+	return findStatisticIn(gjson.Get(myJson, "statistics.subCategories"), id, "subCategories")
+}
+
+func findStatisticIn(categories gjson.Result, id int64, subKey string) gjson.Result {
+	var found gjson.Result
+	categories.ForEach(func(_, category gjson.Result) bool {
+		category.Get("statistics").ForEach(func(_, statistic gjson.Result) bool {
+			if statistic.Get("id").Int() == id {
+				found = statistic
+			}
+			return !found.Exists()
+		})
+		if !found.Exists() {
+			found = findStatisticIn(category.Get(subKey), id, subKey)
+		}
+		return !found.Exists()
+	})
+	return found
+}
+
+// Evaluate metrics on a document, by name. Metrics the document doesn't have are left out.
+func EvaluateMetrics(myJson string, metrics []Metric) map[string]float64 {
+	values := make(map[string]float64)
+	for _, m := range metrics {
+		if value, ok := m.Evaluate(myJson); ok {
+			values[m.Name] = value
+		}
+	}
+	return values
+}
+
+// Save the values of every registered metric for a toon on a day, replacing any that are already there.
+func saveMetricValues(ctx context.Context, env *Env, toonId uint, day time.Time, myJson string) error {
+	if len(env.metrics) == 0 {
+		return nil
+	}
+
+	var values []StatValue
+	for _, m := range env.metrics {
+		if value, ok := m.Evaluate(myJson); ok {
+			values = append(values, StatValue{ToonID: toonId, InsertDate: day, MetricID: m.ID, Value: value})
+		}
+	}
+	return env.db.SaveStatValues(ctx, values)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestEvaluateMetrics(t *testing.T) {
+	profile, err := ioutil.ReadFile("test-json-profile.json")
+	if err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	}
+	community, err := ioutil.ReadFile("test-json.json")
+	if err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	}
+
+	tests := []struct {
+		metric Metric
+		json   []byte
+		want   float64
+		found  bool
+	}{
+		{Metric{Path: "honor_level"}, profile, 0, false},
+		{Metric{Path: "pvp_summary.honor_level"}, profile, 53, true},
+		{Metric{Path: "equipment.equipped_items.#.level.value", Aggregation: "max"}, profile, 463, true},
+		{Metric{Path: "equipment.equipped_items.#.level.value", Aggregation: "min"}, profile, 1, true},
+		{Metric{Path: "equipment.equipped_items.#.level.value", Aggregation: "sum"}, profile, 6230, true},
+		{Metric{Path: "equipment.equipped_items.#.level.value", Aggregation: "avg"}, profile, 366, true},
+		{Metric{Path: "equipment.equipped_items.#.level.value", Aggregation: "avg", Type: "float"}, profile, 6230.0 / 17, true},
+		{Metric{Path: "equipment.equipped_items", Aggregation: "count"}, profile, 17, true},
+		{Metric{Path: "equipment.equipped_items"}, profile, 0, false},
+		{Metric{StatisticID: 377}, profile, 95, true},
+		{Metric{StatisticID: 1518}, community, 22306, true},
+		{Metric{StatisticID: 999999}, profile, 0, false},
+	}
+
+	for _, test := range tests {
+		value, found := test.metric.Evaluate(string(test.json))
+		if value != test.want || found != test.found {
+			t.Errorf("Evaluate(%+v) = %v, %v, want %v, %v", test.metric, value, found, test.want, test.found)
+		}
+	}
+}
+
+func TestSaveMetricValues(t *testing.T) {
+	ctx := context.Background()
+	db, env, cleanup := newMigratedEnv(t)
+	defer cleanup()
+
+	_, err := RegisterMetrics(ctx, env, []Metric{{Name: "level", Path: "level"}})
+	if err == nil {
+		t.Errorf("A configured metric with the name of a built in one should be rejected")
+	}
+	_, err = RegisterMetrics(ctx, env, []Metric{{Name: "honor_level", Path: "pvp_summary.honor_level", StatisticID: 1}})
+	if err == nil {
+		t.Errorf("A metric with both a path and a statistic should be rejected")
+	}
+
+	configured := []Metric{{Name: "honor_level", Path: "pvp_summary.honor_level"}}
+	env.metrics, err = RegisterMetrics(ctx, env, configured)
+	if err != nil {
+		t.Fatalf("RegisterMetrics failed: %v", err)
+	}
+	// Registering again keeps the same IDs.
+	again, err := RegisterMetrics(ctx, env, configured)
+	if err != nil || again[len(again)-1].ID != env.metrics[len(env.metrics)-1].ID {
+		t.Fatalf("RegisterMetrics a second time changed the metrics: %v", err)
+	}
+
+	toon := insertTestToon(t, db)
+	profile, _ := ioutil.ReadFile("test-json-profile.json")
+	for i := 0; i < 2; i++ {
+		err = saveMetricValues(ctx, env, toon.ID, time.Now(), string(profile))
+		if err != nil {
+			t.Fatalf("saveMetricValues failed: %v", err)
+		}
+	}
+
+	var values []StatValue
+	db.Where("toon_id = ?", toon.ID).Find(&values)
+	if len(values) != len(builtinMetrics)+1 {
+		t.Errorf("Want one value per metric, got %v values", len(values))
+	}
+	var honor StatValue
+	db.Joins("JOIN metrics ON metrics.id = stat_values.metric_id").Where("metrics.name = ?", "honor_level").First(&honor)
+	if honor.Value != 53 {
+		t.Errorf("honor_level value incorrect, got %+v", honor)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A numbered change to the schema. Up applies it and Down undoes it.
+type Migration struct {
+	Version     int
+	Description string
+	Up          DialectSql
+	Down        DialectSql
+}
+
+// The SQL statements for one direction of a migration. All is used for every database unless the
+// database has its own statements in Only. Statements can use the placeholders in columnTypes for the
+// column types that are spelled differently on each database.
+type DialectSql struct {
+	All  []string
+	Only map[string][]string
+}
+
+// Row in the schema_migrations table, one for each migration that has been applied.
+type SchemaMigration struct {
+	Version     int `gorm:"primary_key;auto_increment:false"`
+	Description string
+	AppliedAt   time.Time
+}
+
+// State of a migration for the migrate status command.
+type MigrationState struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Column types by database. These match what gorm's AutoMigrate used to create so that databases from
+// before there were migrations look the same as new ones.
+var columnTypes = map[string]map[string]string{
+	"postgres": {
+		"{serial}":    "serial PRIMARY KEY",
+		"{bigserial}": "bigserial PRIMARY KEY",
+		"{uint}":      "integer",
+		"{text}":      "text",
+		"{timestamp}": "timestamp with time zone",
+		"{bool}":      "boolean",
+	},
+	"mysql": {
+		"{serial}":    "int unsigned AUTO_INCREMENT PRIMARY KEY",
+		"{bigserial}": "bigint AUTO_INCREMENT PRIMARY KEY",
+		"{uint}":      "int unsigned",
+		"{text}":      "varchar(255)",
+		"{timestamp}": "datetime NULL",
+		"{bool}":      "boolean",
+	},
+	"sqlite": {
+		"{serial}":    "integer PRIMARY KEY AUTOINCREMENT",
+		"{bigserial}": "integer PRIMARY KEY AUTOINCREMENT",
+		"{uint}":      "integer",
+		"{text}":      "varchar(255)",
+		"{timestamp}": "datetime",
+		"{bool}":      "bool",
+	},
+}
+
+// The statements for a database with the column type placeholders filled in.
+func (d DialectSql) statements(dbDriver string) []string {
+	statements := d.All
+	if only, ok := d.Only[dbDriver]; ok {
+		statements = only
+	}
+
+	var replacements []string
+	for placeholder, columnType := range columnTypes[dbDriver] {
+		replacements = append(replacements, placeholder, columnType)
+	}
+	replacer := strings.NewReplacer(replacements...)
+
+	var result []string
+	for _, s := range statements {
+		result = append(result, replacer.Replace(s))
+	}
+	return result
+}
+
+// The migrations in version order.
+func sortedMigrations() []Migration {
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return sorted
+}
+
+// Get the versions that have been applied. Creates schema_migrations if it isn't there, and if this is a
+// database from before there were migrations it gets brought in line first. An empty schema_migrations next to
+// existing tables is from a bootstrap that didn't finish, so that gets bootstrapped again.
+func (db *WowDB) appliedMigrations(ctx context.Context) (map[int]SchemaMigration, error) {
+	var rows []SchemaMigration
+	if db.HasTable(&SchemaMigration{}) {
+		err := db.withContext(ctx, func(tx *gorm.DB) error {
+			return tx.Find(&rows).Error
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(rows) == 0 {
+		err := db.bootstrapMigrations(ctx)
+		if err != nil {
+			return nil, err
+		}
+		err = db.withContext(ctx, func(tx *gorm.DB) error {
+			return tx.Find(&rows).Error
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	applied := make(map[int]SchemaMigration)
+	for _, r := range rows {
+		applied[r.Version] = r
+	}
+	return applied, nil
+}
+
+// Create schema_migrations. There are two kinds of databases that already have tables but no migrations:
+// ones that gorm's AutoMigrate built, which already match the baseline, and ones built from the old
+// postgres.sql and mysql.sql, which get upgraded in place to match it. It's all one transaction, but MySQL
+// commits DDL as it goes, so schema_migrations is dropped again when anything fails.
+func (db *WowDB) bootstrapMigrations(ctx context.Context) error {
+	err := db.withContext(ctx, func(tx *gorm.DB) error {
+		if !tx.HasTable(&SchemaMigration{}) {
+			err := tx.CreateTable(&SchemaMigration{}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case tx.HasTable("toons"):
+			log.Info("Found tables from before migrations, marking the baseline migrations as applied")
+			// The unchanged flag was added to stats after the last release that used AutoMigrate.
+			if !tx.Dialect().HasColumn("stats", "unchanged") {
+				err := execStatements(tx, db.dbDriver, 0, DialectSql{All: []string{"ALTER TABLE stats ADD COLUMN unchanged {bool}"}})
+				if err != nil {
+					return err
+				}
+			}
+			return recordBaseline(tx)
+		case tx.HasTable("toon"):
+			if _, ok := legacyUpgrade.Only[db.dbDriver]; !ok {
+				return fmt.Errorf("can't upgrade the legacy schema on %s", db.dbDriver)
+			}
+			log.Info("Found the legacy toon and stats tables, upgrading them to the current schema")
+			err := execStatements(tx, db.dbDriver, 0, legacyUpgrade)
+			if err != nil {
+				return err
+			}
+			return recordBaseline(tx)
+		}
+		return nil
+	})
+	if err != nil && db.HasTable(&SchemaMigration{}) {
+		if dropErr := db.DropTable(&SchemaMigration{}).Error; dropErr != nil {
+			log.Errorf("Could not drop schema_migrations after the failed bootstrap: %v", dropErr)
+		}
+	}
+	return err
+}
+
+// Run the statements for a migration, version is only used in the error.
+func execStatements(tx *gorm.DB, dbDriver string, version int, sql DialectSql) error {
+	for _, statement := range sql.statements(dbDriver) {
+		err := tx.Exec(statement).Error
+		if err != nil {
+			return fmt.Errorf("migration %d: %v", version, err)
+		}
+	}
+	return nil
+}
+
+func recordMigration(tx *gorm.DB, m Migration) error {
+	return tx.Create(&SchemaMigration{Version: m.Version, Description: m.Description, AppliedAt: time.Now()}).Error
+}
+
+// Mark the baseline migrations as applied.
+func recordBaseline(tx *gorm.DB) error {
+	for _, m := range sortedMigrations() {
+		if m.Version > baselineVersion {
+			break
+		}
+		err := recordMigration(tx, m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run one migration in a transaction and record or remove it in schema_migrations. MySQL commits DDL as it
+// goes, so there a failure part way through can leave the migration half done.
+func (db *WowDB) runMigration(ctx context.Context, m Migration, up bool) error {
+	sql := m.Down
+	if up {
+		sql = m.Up
+	}
+
+	return db.withContext(ctx, func(tx *gorm.DB) error {
+		err := execStatements(tx, db.dbDriver, m.Version, sql)
+		if err != nil {
+			return err
+		}
+
+		if up {
+			return recordMigration(tx, m)
+		}
+		return tx.Delete(&SchemaMigration{Version: m.Version}).Error
+	})
+}
+
+// Apply every migration that hasn't been applied yet, oldest first. Returns the ones it applied.
+func (db *WowDB) MigrateUp(ctx context.Context) ([]Migration, error) {
+	applied, err := db.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, m := range sortedMigrations() {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+
+		log.Infof("Applying migration %d: %s", m.Version, m.Description)
+		err = db.runMigration(ctx, m, true)
+		if err != nil {
+			return done, err
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// Undo the last steps applied migrations, newest first. Returns the ones it undid.
+func (db *WowDB) MigrateDown(ctx context.Context, steps int) ([]Migration, error) {
+	applied, err := db.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := sortedMigrations()
+	var done []Migration
+	for i := len(sorted) - 1; i >= 0 && len(done) < steps; i-- {
+		m := sorted[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+
+		log.Infof("Reverting migration %d: %s", m.Version, m.Description)
+		err = db.runMigration(ctx, m, false)
+		if err != nil {
+			return done, err
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// Get every migration and whether it has been applied.
+func (db *WowDB) MigrationStatus(ctx context.Context) ([]MigrationState, error) {
+	applied, err := db.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var states []MigrationState
+	for _, m := range sortedMigrations() {
+		row, ok := applied[m.Version]
+		states = append(states, MigrationState{Migration: m, Applied: ok, AppliedAt: row.AppliedAt})
+	}
+	return states, nil
+}
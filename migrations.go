@@ -0,0 +1,693 @@
+package main
+
+// The schema, one migration per change. Add new ones to the end with the next version number and never edit
+// one that has been released, databases that already applied it won't run it again.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "Create races, toon_classes, toons, stats and class_colors",
+		Up: DialectSql{All: []string{
+			`CREATE TABLE races (
+				id {bigserial},
+				mask bigint,
+				side {text},
+				name {text}
+			)`,
+			`CREATE TABLE toon_classes (
+				id {bigserial},
+				mask bigint,
+				power_type {text},
+				name {text}
+			)`,
+			`CREATE TABLE toons (
+				id {serial},
+				created_at {timestamp},
+				updated_at {timestamp},
+				deleted_at {timestamp},
+				name {text},
+				race_id bigint REFERENCES races(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				class_id bigint REFERENCES toon_classes(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				gender bigint,
+				realm {text},
+				region {text}
+			)`,
+			`CREATE INDEX idx_toons_deleted_at ON toons (deleted_at)`,
+			`CREATE TABLE stats (
+				id {serial},
+				created_at {timestamp},
+				updated_at {timestamp},
+				deleted_at {timestamp},
+				toon_id {uint} REFERENCES toons(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				last_modified bigint,
+				insert_date date,
+				level bigint,
+				achievement_points bigint,
+				exalted_reps bigint,
+				mounts_collected bigint,
+				quests_completed bigint,
+				fish_caught bigint,
+				pets_collected bigint,
+				pet_battles_won bigint,
+				pet_battles_pvp_won bigint,
+				item_level bigint,
+				honorable_kills bigint,
+				unchanged {bool}
+			)`,
+			`CREATE INDEX idx_stats_deleted_at ON stats (deleted_at)`,
+			`CREATE UNIQUE INDEX idx_toon_id_create_date ON stats (toon_id, insert_date)`,
+			`CREATE TABLE class_colors (
+				id {bigserial},
+				toon_class_id bigint REFERENCES toon_classes(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				color {text}
+			)`,
+		}},
+		Down: DialectSql{All: []string{
+			`DROP TABLE class_colors`,
+			`DROP TABLE stats`,
+			`DROP TABLE toons`,
+			`DROP TABLE toon_classes`,
+			`DROP TABLE races`,
+		}},
+	},
+	{
+		Version:     2,
+		Description: "Seed classes, races and class colors",
+		Up: DialectSql{All: []string{
+			`INSERT INTO toon_classes (id, mask, power_type, name) VALUES
+				(1, 1, 'rage', 'Warrior'),
+				(2, 2, 'mana', 'Paladin'),
+				(3, 4, 'focus', 'Hunter'),
+				(4, 8, 'energy', 'Rogue'),
+				(5, 16, 'mana', 'Priest'),
+				(6, 32, 'runic-power', 'Death Knight'),
+				(7, 64, 'mana', 'Shaman'),
+				(8, 128, 'mana', 'Mage'),
+				(9, 256, 'mana', 'Warlock'),
+				(10, 512, 'energy', 'Monk'),
+				(11, 1024, 'mana', 'Druid'),
+				(12, 2048, 'fury', 'Demon Hunter')`,
+			`INSERT INTO races (id, mask, side, name) VALUES
+				(1, 1, 'alliance', 'Human'),
+				(2, 2, 'horde', 'Orc'),
+				(3, 4, 'alliance', 'Dwarf'),
+				(4, 8, 'alliance', 'Night Elf'),
+				(5, 16, 'horde', 'Undead'),
+				(6, 32, 'horde', 'Tauren'),
+				(7, 64, 'alliance', 'Gnome'),
+				(8, 128, 'horde', 'Troll'),
+				(9, 256, 'horde', 'Goblin'),
+				(10, 512, 'horde', 'Blood Elf'),
+				(11, 1024, 'alliance', 'Draenei'),
+				(22, 2097152, 'alliance', 'Worgen'),
+				(24, 8388608, 'neutral', 'Pandaren'),
+				(25, 16777216, 'alliance', 'Pandaren'),
+				(26, 33554432, 'horde', 'Pandaren'),
+				(27, 67108864, 'horde', 'Nightborne'),
+				(28, 134217728, 'horde', 'Highmountain Tauren'),
+				(29, 268435456, 'alliance', 'Void Elf'),
+				(30, 536870912, 'alliance', 'Lightforged Draenei')`,
+			// Colors from https://wow.gamepedia.com/Class_colors
+			`INSERT INTO class_colors (toon_class_id, color) VALUES
+				(1, '#C79C63'),
+				(2, '#F58CBA'),
+				(3, '#ABD473'),
+				(4, '#FFF569'),
+				(5, '#F0EBE0'),
+				(6, '#C41F3B'),
+				(7, '#0070DE'),
+				(8, '#69CCF0'),
+				(9, '#9482C9'),
+				(10, '#00FF96'),
+				(11, '#FF7D0A'),
+				(12, '#A330C9')`,
+		}},
+		// Classes and races that toons use have to stay.
+		Down: DialectSql{All: []string{
+			`DELETE FROM class_colors`,
+			`DELETE FROM toon_classes WHERE id NOT IN (SELECT class_id FROM toons)`,
+			`DELETE FROM races WHERE id NOT IN (SELECT race_id FROM toons)`,
+		}},
+	},
+	{
+		Version:     3,
+		Description: "Create metrics and stat_values",
+		Up: DialectSql{All: []string{
+			`CREATE TABLE metrics (
+				id {bigserial},
+				name {text} NOT NULL,
+				path {text},
+				statistic_id bigint,
+				type {text},
+				aggregation {text}
+			)`,
+			`CREATE UNIQUE INDEX idx_metrics_name ON metrics (name)`,
+			`CREATE TABLE stat_values (
+				id {bigserial},
+				toon_id {uint} REFERENCES toons(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				insert_date date,
+				metric_id bigint REFERENCES metrics(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				value double precision
+			)`,
+			`CREATE UNIQUE INDEX idx_stat_values_toon_date_metric ON stat_values (toon_id, insert_date, metric_id)`,
+		}},
+		Down: DialectSql{All: []string{
+			`DROP TABLE stat_values`,
+			`DROP TABLE metrics`,
+		}},
+	},
+	{
+		Version:     4,
+		Description: "Create statistic_definitions and statistic_values",
+		Up: DialectSql{All: []string{
+			`CREATE TABLE statistic_definitions (
+				id bigint PRIMARY KEY,
+				name {text},
+				category_path {text}
+			)`,
+			`CREATE TABLE statistic_values (
+				id {bigserial},
+				toon_id {uint} REFERENCES toons(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				insert_date date,
+				statistic_id bigint REFERENCES statistic_definitions(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				quantity double precision
+			)`,
+			`CREATE UNIQUE INDEX idx_statistic_values_toon_date_statistic ON statistic_values (toon_id, insert_date, statistic_id)`,
+			`CREATE INDEX idx_statistic_values_toon_statistic ON statistic_values (toon_id, statistic_id)`,
+		}},
+		Down: DialectSql{All: []string{
+			`DROP TABLE statistic_values`,
+			`DROP TABLE statistic_definitions`,
+		}},
+	},
+	{
+		Version:     5,
+		Description: "Create equipment_snapshots",
+		Up: DialectSql{All: []string{
+			`CREATE TABLE equipment_snapshots (
+				id {bigserial},
+				toon_id {uint} REFERENCES toons(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				insert_date date,
+				slot {text},
+				item_id bigint,
+				name {text},
+				item_level bigint,
+				quality {text},
+				bonus_list {text},
+				azerite_powers {text}
+			)`,
+			`CREATE UNIQUE INDEX idx_equipment_snapshots_toon_date_slot ON equipment_snapshots (toon_id, insert_date, slot)`,
+		}},
+		Down: DialectSql{All: []string{
+			`DROP TABLE equipment_snapshots`,
+		}},
+	},
+	{
+		Version:     6,
+		Description: "Create mount_collection",
+		Up: DialectSql{All: []string{
+			`CREATE TABLE mount_collection (
+				id {bigserial},
+				toon_id {uint} REFERENCES toons(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				name {text},
+				mount_id bigint,
+				spell_id bigint,
+				item_id bigint,
+				quality {text},
+				is_ground {bool},
+				is_flying {bool},
+				is_aquatic {bool},
+				is_jumping {bool},
+				first_seen date
+			)`,
+			`CREATE UNIQUE INDEX idx_mount_collection_toon_name ON mount_collection (toon_id, name)`,
+		}},
+		Down: DialectSql{All: []string{
+			`DROP TABLE mount_collection`,
+		}},
+	},
+	{
+		Version:     7,
+		Description: "Create pets and pet_events",
+		Up: DialectSql{All: []string{
+			`CREATE TABLE pets (
+				guid {text} PRIMARY KEY,
+				toon_id {uint} REFERENCES toons(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				species_id bigint,
+				name {text},
+				breed_id bigint,
+				quality {text},
+				level bigint,
+				health bigint,
+				power bigint,
+				speed bigint,
+				first_seen date,
+				last_seen date,
+				released {bool}
+			)`,
+			`CREATE INDEX idx_pets_species_id ON pets (species_id)`,
+			`CREATE TABLE pet_events (
+				id {bigserial},
+				guid {text} REFERENCES pets(guid) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				species_id bigint,
+				event_date date,
+				event {text},
+				old_value {text},
+				new_value {text}
+			)`,
+			`CREATE INDEX idx_pet_events_event_date ON pet_events (event_date)`,
+		}},
+		Down: DialectSql{All: []string{
+			`DROP TABLE pet_events`,
+			`DROP TABLE pets`,
+		}},
+	},
+	{
+		Version:     8,
+		Description: "Create reputation_values",
+		Up: DialectSql{All: []string{
+			`CREATE TABLE reputation_values (
+				id {bigserial},
+				toon_id {uint} REFERENCES toons(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				insert_date date,
+				faction_id bigint,
+				faction_name {text},
+				tier bigint,
+				standing_name {text},
+				raw bigint,
+				value bigint,
+				max bigint,
+				renown_level bigint,
+				paragon_raw bigint,
+				paragon_value bigint,
+				paragon_max bigint
+			)`,
+			`CREATE UNIQUE INDEX idx_reputation_values_toon_date_faction ON reputation_values (toon_id, insert_date, faction_id)`,
+		}},
+		Down: DialectSql{All: []string{
+			`DROP TABLE reputation_values`,
+		}},
+	},
+	{
+		Version:     9,
+		Description: "Create achievement_definitions, toon_achievements and achievement_criteria",
+		Up: DialectSql{All: []string{
+			`CREATE TABLE achievement_definitions (
+				id bigint PRIMARY KEY,
+				name {text},
+				category_id bigint,
+				category_path {text}
+			)`,
+			`CREATE TABLE toon_achievements (
+				id {bigserial},
+				toon_id {uint} REFERENCES toons(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				achievement_id bigint,
+				name {text},
+				completed_at {timestamp}
+			)`,
+			`CREATE UNIQUE INDEX idx_toon_achievements_toon_achievement ON toon_achievements (toon_id, achievement_id)`,
+			`CREATE TABLE achievement_criteria (
+				id {bigserial},
+				toon_id {uint} REFERENCES toons(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				achievement_id bigint,
+				criteria_id bigint,
+				amount bigint,
+				is_completed {bool}
+			)`,
+			`CREATE UNIQUE INDEX idx_achievement_criteria_toon_achievement_criteria ON achievement_criteria (toon_id, achievement_id, criteria_id)`,
+		}},
+		Down: DialectSql{All: []string{
+			`DROP TABLE achievement_criteria`,
+			`DROP TABLE toon_achievements`,
+			`DROP TABLE achievement_definitions`,
+		}},
+	},
+	{
+		Version:     10,
+		Description: "Create mythic_ratings and mythic_runs",
+		Up: DialectSql{All: []string{
+			`CREATE TABLE mythic_ratings (
+				id {bigserial},
+				toon_id {uint} REFERENCES toons(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				insert_date date,
+				season_id bigint,
+				rating double precision
+			)`,
+			`CREATE UNIQUE INDEX idx_mythic_ratings_toon_date ON mythic_ratings (toon_id, insert_date)`,
+			`CREATE TABLE mythic_runs (
+				id {bigserial},
+				toon_id {uint} REFERENCES toons(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				season_id bigint,
+				period_id bigint,
+				dungeon_id bigint,
+				dungeon_name {text},
+				keystone_level bigint,
+				duration bigint,
+				timed {bool},
+				affixes {text},
+				completed_at {timestamp},
+				rating double precision
+			)`,
+			`CREATE UNIQUE INDEX idx_mythic_runs_toon_dungeon_completed ON mythic_runs (toon_id, dungeon_id, completed_at)`,
+		}},
+		Down: DialectSql{All: []string{
+			`DROP TABLE mythic_runs`,
+			`DROP TABLE mythic_ratings`,
+		}},
+	},
+	{
+		Version:     11,
+		Description: "Create pvp_summaries and pvp_brackets",
+		Up: DialectSql{All: []string{
+			`CREATE TABLE pvp_summaries (
+				id {bigserial},
+				toon_id {uint} REFERENCES toons(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				insert_date date,
+				honor_level bigint,
+				honorable_kills bigint
+			)`,
+			`CREATE UNIQUE INDEX idx_pvp_summaries_toon_date ON pvp_summaries (toon_id, insert_date)`,
+			`CREATE TABLE pvp_brackets (
+				id {bigserial},
+				toon_id {uint} REFERENCES toons(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				insert_date date,
+				bracket {text},
+				season_id bigint,
+				rating bigint,
+				season_played bigint,
+				season_won bigint,
+				season_lost bigint,
+				weekly_played bigint,
+				weekly_won bigint,
+				weekly_lost bigint
+			)`,
+			`CREATE UNIQUE INDEX idx_pvp_brackets_toon_date_bracket ON pvp_brackets (toon_id, insert_date, bracket)`,
+		}},
+		Down: DialectSql{All: []string{
+			`DROP TABLE pvp_brackets`,
+			`DROP TABLE pvp_summaries`,
+		}},
+	},
+	{
+		Version:     12,
+		Description: "Create raid_progress and raid_kills",
+		Up: DialectSql{All: []string{
+			`CREATE TABLE raid_progress (
+				id {bigserial},
+				toon_id {uint} REFERENCES toons(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				expansion_id bigint,
+				expansion_name {text},
+				instance_id bigint,
+				instance_name {text},
+				difficulty {text},
+				completed bigint,
+				total bigint
+			)`,
+			`CREATE UNIQUE INDEX idx_raid_progress_toon_instance_difficulty ON raid_progress (toon_id, instance_id, difficulty)`,
+			`CREATE TABLE raid_kills (
+				id {bigserial},
+				toon_id {uint} REFERENCES toons(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				instance_id bigint,
+				difficulty {text},
+				encounter_id bigint,
+				encounter_name {text},
+				kills bigint,
+				first_kill {timestamp},
+				last_kill {timestamp}
+			)`,
+			`CREATE UNIQUE INDEX idx_raid_kills_toon_encounter_difficulty ON raid_kills (toon_id, encounter_id, difficulty)`,
+		}},
+		Down: DialectSql{All: []string{
+			`DROP TABLE raid_kills`,
+			`DROP TABLE raid_progress`,
+		}},
+	},
+	{
+		Version:     13,
+		Description: "Create profession_skills and toon_recipes",
+		Up: DialectSql{All: []string{
+			`CREATE TABLE profession_skills (
+				id {bigserial},
+				toon_id {uint} REFERENCES toons(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				insert_date date,
+				profession_id bigint,
+				profession_name {text},
+				is_primary {bool},
+				tier_id bigint,
+				tier_name {text},
+				skill_points bigint,
+				max_skill_points bigint
+			)`,
+			`CREATE UNIQUE INDEX idx_profession_skills_toon_date_tier ON profession_skills (toon_id, insert_date, profession_id, tier_id)`,
+			`CREATE TABLE toon_recipes (
+				id {bigserial},
+				toon_id {uint} REFERENCES toons(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				recipe_id bigint,
+				name {text},
+				profession_id bigint,
+				tier_id bigint,
+				first_seen date
+			)`,
+			`CREATE UNIQUE INDEX idx_toon_recipes_toon_recipe ON toon_recipes (toon_id, recipe_id)`,
+		}},
+		Down: DialectSql{All: []string{
+			`DROP TABLE toon_recipes`,
+			`DROP TABLE profession_skills`,
+		}},
+	},
+	{
+		Version:     14,
+		Description: "Create guilds, guild_members and inactive_toons",
+		Up: DialectSql{All: []string{
+			`CREATE TABLE guilds (
+				id {bigserial},
+				name {text},
+				realm {text},
+				region {text},
+				min_level bigint,
+				max_rank bigint,
+				added date
+			)`,
+			`CREATE UNIQUE INDEX idx_guilds_name_realm_region ON guilds (name, realm, region)`,
+			`CREATE TABLE guild_members (
+				id {bigserial},
+				guild_id bigint REFERENCES guilds(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				toon_id {uint} REFERENCES toons(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				name {text},
+				realm {text},
+				level bigint,
+				guild_rank bigint,
+				class_id bigint,
+				race_id bigint,
+				join_date date,
+				leave_date date
+			)`,
+			`CREATE INDEX idx_guild_members_guild ON guild_members (guild_id)`,
+			`CREATE TABLE inactive_toons (
+				toon_id {uint} PRIMARY KEY REFERENCES toons(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				guild_id bigint,
+				since date
+			)`,
+		}},
+		Down: DialectSql{All: []string{
+			`DROP TABLE inactive_toons`,
+			`DROP TABLE guild_members`,
+			`DROP TABLE guilds`,
+		}},
+	},
+	{
+		Version:     15,
+		Description: "Create realms",
+		Up: DialectSql{All: []string{
+			`CREATE TABLE realms (
+				id {bigserial},
+				region {text},
+				realm_id bigint,
+				slug {text},
+				name {text},
+				locale {text},
+				timezone {text},
+				connected_realm_id bigint
+			)`,
+			`CREATE UNIQUE INDEX idx_realms_region_slug ON realms (region, slug)`,
+		}},
+		Down: DialectSql{All: []string{
+			`DROP TABLE realms`,
+		}},
+	},
+	{
+		Version:     16,
+		Description: "Create mount_definitions",
+		Up: DialectSql{All: []string{
+			`CREATE TABLE mount_definitions (
+				id bigint PRIMARY KEY,
+				name {text},
+				source {text},
+				faction {text}
+			)`,
+		}},
+		Down: DialectSql{All: []string{
+			`DROP TABLE mount_definitions`,
+		}},
+	},
+	{
+		Version:     17,
+		Description: "Keep raid_progress and raid_kills by day",
+		Up:          raidHistoryUp,
+		Down:        raidHistoryDown,
+	},
+}
+
+// The raid tables get an insert_date, the rows already there are kept as today's. MySQL wants the new index
+// in place before the old one goes since the toons foreign key needs one, and has its own DROP INDEX. SQLite
+// keeps dates as text, today has to be written the way gorm writes a day for it to match.
+var raidHistoryUp = DialectSql{Only: map[string][]string{
+	"postgres": raidHistoryUpSql(dropIndex, "CURRENT_DATE"),
+	"mysql":    raidHistoryUpSql(dropMysqlIndex, "CURRENT_DATE"),
+	"sqlite":   raidHistoryUpSql(dropIndex, "date('now') || ' 00:00:00+00:00'"),
+}}
+
+func raidHistoryUpSql(drop func(index string, table string) string, today string) []string {
+	return []string{
+		`ALTER TABLE raid_progress ADD COLUMN insert_date date`,
+		`UPDATE raid_progress SET insert_date = ` + today,
+		`CREATE UNIQUE INDEX idx_raid_progress_toon_date_instance_difficulty ON raid_progress (toon_id, insert_date, instance_id, difficulty)`,
+		drop("idx_raid_progress_toon_instance_difficulty", "raid_progress"),
+		`ALTER TABLE raid_kills ADD COLUMN insert_date date`,
+		`UPDATE raid_kills SET insert_date = ` + today,
+		`CREATE UNIQUE INDEX idx_raid_kills_toon_date_encounter_difficulty ON raid_kills (toon_id, insert_date, encounter_id, difficulty)`,
+		drop("idx_raid_kills_toon_encounter_difficulty", "raid_kills"),
+	}
+}
+
+func dropIndex(index string, _ string) string {
+	return "DROP INDEX " + index
+}
+
+func dropMysqlIndex(index string, table string) string {
+	return "DROP INDEX " + index + " ON " + table
+}
+
+// Only each toon's latest day is kept going back. The latest rows are picked out through a derived table
+// because MySQL won't delete from a table a plain subquery reads. SQLite can't drop a column, so it copies
+// the tables instead.
+const (
+	deleteOldRaidProgress = `DELETE FROM raid_progress WHERE id NOT IN (SELECT id FROM (SELECT r.id FROM raid_progress r
+		WHERE r.insert_date = (SELECT max(insert_date) FROM raid_progress p WHERE p.toon_id = r.toon_id)) latest)`
+	deleteOldRaidKills = `DELETE FROM raid_kills WHERE id NOT IN (SELECT id FROM (SELECT r.id FROM raid_kills r
+		WHERE r.insert_date = (SELECT max(insert_date) FROM raid_kills k WHERE k.toon_id = r.toon_id)) latest)`
+)
+
+var raidHistoryDown = DialectSql{
+	All: raidHistoryDownSql(dropIndex),
+	Only: map[string][]string{
+		"mysql": raidHistoryDownSql(dropMysqlIndex),
+		"sqlite": {
+			deleteOldRaidProgress,
+			`DROP INDEX idx_raid_progress_toon_date_instance_difficulty`,
+			`CREATE TABLE raid_progress_copy (
+				id {bigserial},
+				toon_id {uint} REFERENCES toons(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				expansion_id bigint,
+				expansion_name {text},
+				instance_id bigint,
+				instance_name {text},
+				difficulty {text},
+				completed bigint,
+				total bigint
+			)`,
+			`INSERT INTO raid_progress_copy SELECT id, toon_id, expansion_id, expansion_name, instance_id,
+				instance_name, difficulty, completed, total FROM raid_progress`,
+			`DROP TABLE raid_progress`,
+			`ALTER TABLE raid_progress_copy RENAME TO raid_progress`,
+			`CREATE UNIQUE INDEX idx_raid_progress_toon_instance_difficulty ON raid_progress (toon_id, instance_id, difficulty)`,
+			deleteOldRaidKills,
+			`DROP INDEX idx_raid_kills_toon_date_encounter_difficulty`,
+			`CREATE TABLE raid_kills_copy (
+				id {bigserial},
+				toon_id {uint} REFERENCES toons(id) ON DELETE RESTRICT ON UPDATE RESTRICT,
+				instance_id bigint,
+				difficulty {text},
+				encounter_id bigint,
+				encounter_name {text},
+				kills bigint,
+				first_kill {timestamp},
+				last_kill {timestamp}
+			)`,
+			`INSERT INTO raid_kills_copy SELECT id, toon_id, instance_id, difficulty, encounter_id, encounter_name,
+				kills, first_kill, last_kill FROM raid_kills`,
+			`DROP TABLE raid_kills`,
+			`ALTER TABLE raid_kills_copy RENAME TO raid_kills`,
+			`CREATE UNIQUE INDEX idx_raid_kills_toon_encounter_difficulty ON raid_kills (toon_id, encounter_id, difficulty)`,
+		},
+	},
+}
+
+func raidHistoryDownSql(drop func(index string, table string) string) []string {
+	return []string{
+		deleteOldRaidProgress,
+		`CREATE UNIQUE INDEX idx_raid_progress_toon_instance_difficulty ON raid_progress (toon_id, instance_id, difficulty)`,
+		drop("idx_raid_progress_toon_date_instance_difficulty", "raid_progress"),
+		`ALTER TABLE raid_progress DROP COLUMN insert_date`,
+		deleteOldRaidKills,
+		`CREATE UNIQUE INDEX idx_raid_kills_toon_encounter_difficulty ON raid_kills (toon_id, encounter_id, difficulty)`,
+		drop("idx_raid_kills_toon_date_encounter_difficulty", "raid_kills"),
+		`ALTER TABLE raid_kills DROP COLUMN insert_date`,
+	}
+}
+
+// Migrations up to this version describe the schema that existed before there were migrations. Databases
+// that already have that schema are marked as having applied them rather than running them.
+const baselineVersion = 2
+
+// Upgrade a database built from the old postgres.sql or mysql.sql to what the baseline migrations create.
+// Those files seeded the classes, races and class colors, so only the tables and columns change. The legacy
+// schema was never used with SQLite.
+var legacyUpgrade = DialectSql{Only: map[string][]string{
+	"postgres": {
+		`ALTER TABLE classes RENAME TO toon_classes`,
+		`ALTER TABLE toon_classes RENAME COLUMN powertype TO power_type`,
+		`ALTER TABLE class_colors RENAME COLUMN class_id TO toon_class_id`,
+		`ALTER TABLE toon RENAME TO toons`,
+		`ALTER TABLE toons
+			ADD COLUMN created_at {timestamp},
+			ADD COLUMN updated_at {timestamp},
+			ADD COLUMN deleted_at {timestamp}`,
+		`UPDATE toons SET created_at = now(), updated_at = now()`,
+		`CREATE INDEX idx_toons_deleted_at ON toons (deleted_at)`,
+		`ALTER TABLE stats RENAME COLUMN create_date TO insert_date`,
+		`ALTER TABLE stats RENAME COLUMN number_exalted TO exalted_reps`,
+		`ALTER TABLE stats RENAME COLUMN mounts_owned TO mounts_collected`,
+		`ALTER TABLE stats RENAME COLUMN pets_owned TO pets_collected`,
+		`ALTER TABLE stats
+			ADD COLUMN created_at {timestamp},
+			ADD COLUMN updated_at {timestamp},
+			ADD COLUMN deleted_at {timestamp},
+			ADD COLUMN unchanged {bool} DEFAULT false`,
+		`UPDATE stats SET created_at = insert_date, updated_at = insert_date`,
+		`CREATE INDEX idx_stats_deleted_at ON stats (deleted_at)`,
+		`CREATE UNIQUE INDEX idx_toon_id_create_date ON stats (toon_id, insert_date)`,
+	},
+	"mysql": {
+		`RENAME TABLE classes TO toon_classes, toon TO toons`,
+		`ALTER TABLE toon_classes CHANGE powertype power_type varchar(255) NOT NULL`,
+		`ALTER TABLE class_colors CHANGE class_id toon_class_id integer NOT NULL`,
+		`ALTER TABLE toons
+			ADD COLUMN created_at {timestamp},
+			ADD COLUMN updated_at {timestamp},
+			ADD COLUMN deleted_at {timestamp}`,
+		`UPDATE toons SET created_at = now(), updated_at = now()`,
+		`CREATE INDEX idx_toons_deleted_at ON toons (deleted_at)`,
+		`ALTER TABLE stats
+			CHANGE create_date insert_date date,
+			CHANGE number_exalted exalted_reps integer,
+			CHANGE mounts_owned mounts_collected integer,
+			CHANGE pets_owned pets_collected integer,
+			ADD COLUMN created_at {timestamp},
+			ADD COLUMN updated_at {timestamp},
+			ADD COLUMN deleted_at {timestamp},
+			ADD COLUMN unchanged {bool} DEFAULT false`,
+		`UPDATE stats SET created_at = insert_date, updated_at = insert_date`,
+		`CREATE INDEX idx_stats_deleted_at ON stats (deleted_at)`,
+		`CREATE UNIQUE INDEX idx_toon_id_create_date ON stats (toon_id, insert_date)`,
+	},
+}}
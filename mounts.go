@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// A mount in a toon's collection and the first day it was seen there. Mounts are matched by name since the
+// Profile API and the Community API don't share an ID. MountID is the Profile API's, the spell, item, quality
+// and type flags only come from the Community API and are empty for mounts it never saw. What the Profile API
+// knows about a mount is in its MountDefinition.
+type MountCollection struct {
+	ID        int64
+	ToonID    uint
+	Name      string
+	MountID   int64
+	SpellID   int64
+	ItemID    int64
+	Quality   string
+	IsGround  bool
+	IsFlying  bool
+	IsAquatic bool
+	IsJumping bool
+	FirstSeen time.Time `gorm:"type:date"`
+}
+
+func (MountCollection) TableName() string {
+	return "mount_collection"
+}
+
+// Keep FirstSeen to just the day, for the same reason as Stat.
+func (m *MountCollection) BeforeSave() error {
+	m.FirstSeen = truncateToDay(m.FirstSeen)
+	return nil
+}
+
+// Whether the spell, item, quality and type flags are known.
+func (m *MountCollection) hasDetails() bool {
+	return m.SpellID != 0
+}
+
+// Fill in what the other API knew about the mount.
+func (m *MountCollection) merge(other MountCollection) {
+	if m.MountID == 0 {
+		m.MountID = other.MountID
+	}
+	if !m.hasDetails() && other.hasDetails() {
+		m.SpellID = other.SpellID
+		m.ItemID = other.ItemID
+		m.Quality = other.Quality
+		m.IsGround = other.IsGround
+		m.IsFlying = other.IsFlying
+		m.IsAquatic = other.IsAquatic
+		m.IsJumping = other.IsJumping
+	}
+}
+
+// A mount from the Game Data API. Source is how it's obtained, like Drop or Vendor, and Faction is empty
+// unless only one faction can use it. The Game Data API has no type or quality for mounts.
+type MountDefinition struct {
+	ID      int64 `gorm:"primary_key;auto_increment:false"`
+	Name    string
+	Source  string
+	Faction string
+}
+
+// Get the definition from a Game Data API mount document.
+func ParseMountDefinition(myJson string) MountDefinition {
+	return MountDefinition{
+		ID:      gjson.Get(myJson, "id").Int(),
+		Name:    gjson.Get(myJson, "name").String(),
+		Source:  gjson.Get(myJson, "source.name").String(),
+		Faction: gjson.Get(myJson, "faction.name").String(),
+	}
+}
+
+// Load the definitions of the collected mounts that don't have one yet, which after the first time is just
+// the ones new to the account. A mount Blizzard doesn't have gets a definition without a source so it isn't
+// asked for every run.
+func RefreshMountDefinitions(ctx context.Context, env *Env, blizzard Blizzard) error {
+	unknown, err := env.db.GetUnknownMounts(ctx)
+	if err != nil || len(unknown) == 0 {
+		return err
+	}
+	log.Debugf("%v mounts without a definition, loading them from Blizzard", len(unknown))
+
+	var definitions []MountDefinition
+	for _, m := range unknown {
+		myJson, err := blizzard.GetMount(ctx, m.MountID)
+		if errors.Is(err, ErrNotFound) {
+			definitions = append(definitions, MountDefinition{ID: m.MountID, Name: m.Name})
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		definitions = append(definitions, ParseMountDefinition(myJson))
+	}
+	return env.db.SaveMountDefinitions(ctx, definitions)
+}
+
+// A mount that showed up in a toon's collection since the run before the latest one. NewToAccount is set
+// when no other toon had it before that day either.
+type NewMount struct {
+	Toon         Toon
+	Mount        MountCollection
+	NewToAccount bool
+}
+
+// Get the collected mounts from a character document, either the Profile API or the Community API one.
+func ParseMounts(myJson string) []MountCollection {
+	var mounts []MountCollection
+	seen := make(map[string]bool)
+	add := func(m MountCollection) {
+		// A few mounts have the same name for each faction, the first one is enough.
+		if m.Name == "" || seen[m.Name] {
+			return
+		}
+		seen[m.Name] = true
+		mounts = append(mounts, m)
+	}
+
+	if collected := gjson.Get(myJson, "mounts_collection.mounts"); collected.Exists() {
+		collected.ForEach(func(_, m gjson.Result) bool {
+			add(MountCollection{Name: m.Get("mount.name").String(), MountID: m.Get("mount.id").Int()})
+			return true
+		})
+		return mounts
+	}
+
+	gjson.Get(myJson, "mounts.collected").ForEach(func(_, m gjson.Result) bool {
+		quality := ""
+		if q := m.Get("qualityId").Int(); q >= 0 && int(q) < len(communityQualities) {
+			quality = communityQualities[q]
+		}
+		add(MountCollection{
+			Name:      m.Get("name").String(),
+			SpellID:   m.Get("spellId").Int(),
+			ItemID:    m.Get("itemId").Int(),
+			Quality:   quality,
+			IsGround:  m.Get("isGround").Bool(),
+			IsFlying:  m.Get("isFlying").Bool(),
+			IsAquatic: m.Get("isAquatic").Bool(),
+			IsJumping: m.Get("isJumping").Bool(),
+		})
+		return true
+	})
+	return mounts
+}
+
+// Add the mounts in the document to the toon's collection, first seen on day unless they were seen before.
+func saveMounts(ctx context.Context, env *Env, toonId uint, day time.Time, myJson string) error {
+	mounts := ParseMounts(myJson)
+	if len(mounts) == 0 {
+		return nil
+	}
+	for i := range mounts {
+		mounts[i].ToonID = toonId
+		mounts[i].FirstSeen = day
+	}
+	return env.db.SaveMounts(ctx, toonId, mounts)
+}
+
+// The account's collection, each mount with the toon and day it was first seen on any toon.
+func accountMounts(collection []MountCollection) []MountCollection {
+	first := make(map[string]MountCollection)
+	for _, m := range collection {
+		f, ok := first[m.Name]
+		if !ok || m.FirstSeen.Before(f.FirstSeen) {
+			m.merge(f)
+			first[m.Name] = m
+		} else {
+			f.merge(m)
+			first[m.Name] = f
+		}
+	}
+
+	var mounts []MountCollection
+	for _, m := range first {
+		mounts = append(mounts, m)
+	}
+	sortMounts(mounts)
+	return mounts
+}
+
+func sortMounts(mounts []MountCollection) {
+	sort.Slice(mounts, func(i, j int) bool {
+		if !mounts[i].FirstSeen.Equal(mounts[j].FirstSeen) {
+			return mounts[i].FirstSeen.Before(mounts[j].FirstSeen)
+		}
+		return mounts[i].Name < mounts[j].Name
+	})
+}
+
+// Get the mounts each toon picked up since its previous run, the stats day before its latest one. A toon
+// with only one day of stats has nothing new, everything it has was seen on its first run.
+func NewMounts(ctx context.Context, env *Env) ([]NewMount, error) {
+	toons, err := env.db.GetAllToons(ctx)
+	if err != nil {
+		return nil, err
+	}
+	collection, err := env.db.GetMountCollection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	account := make(map[string]MountCollection)
+	for _, m := range accountMounts(collection) {
+		account[m.Name] = m
+	}
+
+	var mounts []NewMount
+	for _, t := range toons {
+		stats, err := env.db.GetStatsForToon(ctx, t.ID)
+		if err != nil {
+			return nil, err
+		}
+		if len(stats) < 2 {
+			continue
+		}
+		previous := truncateToDay(stats[len(stats)-2].InsertDate)
+		for _, m := range collection {
+			if m.ToonID == t.ID && m.FirstSeen.After(previous) {
+				first := account[m.Name]
+				mounts = append(mounts, NewMount{Toon: t, Mount: m, NewToAccount: first.FirstSeen.Equal(m.FirstSeen)})
+			}
+		}
+	}
+	sort.Slice(mounts, func(i, j int) bool {
+		if mounts[i].Toon.Name != mounts[j].Toon.Name {
+			return mounts[i].Toon.Name < mounts[j].Toon.Name
+		}
+		return mounts[i].Mount.Name < mounts[j].Mount.Name
+	})
+	return mounts, nil
+}
+
+// Print the mount journal, for the whole account or, when toonName isn't empty, one toon. It has the mounts
+// that are new since the last run, counts by source and by faction and every mount with the day it was first
+// seen. Mounts without a definition, like ones only the Community API saw, count as Unknown.
+func PrintMounts(ctx context.Context, env *Env, toonName string, out io.Writer) error {
+	var toon *Toon
+	if toonName != "" {
+		var err error
+		toon, err = FindToon(ctx, env, toonName)
+		if err != nil {
+			return err
+		}
+	}
+
+	collection, err := env.db.GetMountCollection(ctx)
+	if err != nil {
+		return err
+	}
+	newMounts, err := NewMounts(ctx, env)
+	if err != nil {
+		return err
+	}
+	definitions, err := env.db.GetMountDefinitions(ctx)
+	if err != nil {
+		return err
+	}
+	byId := make(map[int64]MountDefinition)
+	for _, d := range definitions {
+		byId[d.ID] = d
+	}
+	source := func(m MountCollection) string {
+		if s := byId[m.MountID].Source; s != "" {
+			return s
+		}
+		return "Unknown"
+	}
+	faction := func(m MountCollection) string {
+		d := byId[m.MountID]
+		switch {
+		case d.Source == "":
+			return "Unknown"
+		case d.Faction == "":
+			return "Both"
+		}
+		return d.Faction
+	}
+	toons, err := env.db.GetAllToons(ctx)
+	if err != nil {
+		return err
+	}
+	names := make(map[uint]string)
+	for _, t := range toons {
+		names[t.ID] = t.Name
+	}
+
+	var mounts []MountCollection
+	if toon == nil {
+		mounts = accountMounts(collection)
+		_, _ = fmt.Fprintf(out, "%v mounts collected on the account\n", len(mounts))
+	} else {
+		for _, m := range collection {
+			if m.ToonID == toon.ID {
+				mounts = append(mounts, m)
+			}
+		}
+		sortMounts(mounts)
+		_, _ = fmt.Fprintf(out, "%v mounts collected by %v-%v\n", len(mounts), toon.Name, toon.Realm)
+	}
+
+	_, _ = fmt.Fprintln(out, "\nNew since the last run:")
+	w := tabwriter.NewWriter(out, 5, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "Name\tMount\tFirst Seen\tNew to Account\t")
+	for _, n := range newMounts {
+		if toon != nil && n.Toon.ID != toon.ID {
+			continue
+		}
+		newToAccount := ""
+		if n.NewToAccount {
+			newToAccount = "yes"
+		}
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t\n", n.Toon.Name, n.Mount.Name, n.Mount.FirstSeen.Format("2006-01-02"), newToAccount)
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	bySource := make(map[string]int)
+	byFaction := make(map[string]int)
+	for _, m := range mounts {
+		bySource[source(m)]++
+		byFaction[faction(m)]++
+	}
+	err = printCounts(out, "Source", bySource)
+	if err != nil {
+		return err
+	}
+	err = printCounts(out, "Faction", byFaction)
+	if err != nil {
+		return err
+	}
+
+	_, _ = fmt.Fprintln(out)
+	w = tabwriter.NewWriter(out, 5, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "First Seen\tMount\tSource\tFaction\tFirst Toon\t")
+	for _, m := range mounts {
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t\n", m.FirstSeen.Format("2006-01-02"), m.Name, source(m), faction(m), names[m.ToonID])
+	}
+	return w.Flush()
+}
+
+// Write counts as a two column table under a blank line, sorted by name.
+func printCounts(out io.Writer, heading string, counts map[string]int) error {
+	var keys []string
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	_, _ = fmt.Fprintln(out)
+	w := tabwriter.NewWriter(out, 5, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintf(w, "%v\tCount\t\n", heading)
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(w, "%v\t%v\t\n", k, counts[k])
+	}
+	return w.Flush()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMounts(t *testing.T) {
+	profile, err := ioutil.ReadFile("test-json-profile.json")
+	if err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	}
+	community, err := ioutil.ReadFile("test-json.json")
+	if err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	}
+
+	mounts := ParseMounts(string(profile))
+	if len(mounts) != 4 || mounts[0].Name != "Brown Horse" || mounts[0].MountID != 6 || mounts[0].hasDetails() {
+		t.Errorf("Profile mounts incorrect, got %+v", mounts)
+	}
+
+	mounts = ParseMounts(string(community))
+	if len(mounts) != 260 {
+		t.Errorf("Want 260 community mounts, got %v", len(mounts))
+	}
+	for _, m := range mounts {
+		if m.Name == "Brown Horse" && (m.Quality != "RARE" || !m.IsGround || m.IsFlying || m.SpellID == 0) {
+			t.Errorf("Brown Horse incorrect, got %+v", m)
+		}
+	}
+}
+
+func TestMountJournal(t *testing.T) {
+	ctx := context.Background()
+	db, env, cleanup := newMigratedEnv(t)
+	defer cleanup()
+
+	borvoh := Toon{Name: "Borvoh", RaceID: 29, ClassID: 5, Realm: "Duskwood", Region: "us"}
+	alt := Toon{Name: "Altvoh", RaceID: 29, ClassID: 5, Realm: "Duskwood", Region: "us"}
+	for _, toon := range []*Toon{&borvoh, &alt} {
+		if err := db.InsertToon(ctx, toon); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	day1 := time.Date(2019, 10, 16, 0, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+	horse := `{"name": "Brown Horse", "spellId": 458, "qualityId": 3, "isGround": true}`
+	drake := `{"name": "Albino Drake", "spellId": 60025, "qualityId": 4, "isGround": true, "isFlying": true}`
+	turtle := `{"name": "Sea Turtle", "spellId": 64731, "qualityId": 3, "isAquatic": true}`
+	snapshots := []struct {
+		toon   Toon
+		day    time.Time
+		mounts string
+	}{
+		{borvoh, day1, horse},
+		{alt, day1, horse},
+		{borvoh, day2, horse + "," + drake},
+		{alt, day2, horse + "," + drake + "," + turtle},
+	}
+	for _, s := range snapshots {
+		stats := Stat{ToonID: s.toon.ID, InsertDate: s.day}
+		if err := db.InsertStats(ctx, &stats); err != nil {
+			t.Fatal(err)
+		}
+		if err := saveMounts(ctx, env, s.toon.ID, s.day, `{"mounts": {"collected": [`+s.mounts+`]}}`); err != nil {
+			t.Fatalf("saveMounts failed: %v", err)
+		}
+	}
+	// The Profile API doesn't have the details, saving it again keeps the ones from before.
+	if err := saveMounts(ctx, env, borvoh.ID, day2, `{"mounts_collection": {"mounts": [{"mount": {"name": "Brown Horse", "id": 6}}]}}`); err != nil {
+		t.Fatalf("saveMounts failed: %v", err)
+	}
+
+	collection, _ := db.GetMountCollection(ctx)
+	if len(collection) != 5 {
+		t.Errorf("Want 5 mounts in the collection, got %+v", collection)
+	}
+	for _, m := range collection {
+		if m.Name == "Brown Horse" && m.ToonID == borvoh.ID && (m.MountID != 6 || m.SpellID != 458 || !m.FirstSeen.Equal(day1)) {
+			t.Errorf("Brown Horse incorrect, got %+v", m)
+		}
+	}
+
+	newMounts, err := NewMounts(ctx, env)
+	if err != nil {
+		t.Fatalf("NewMounts failed: %v", err)
+	}
+	var got []string
+	for _, n := range newMounts {
+		got = append(got, n.Toon.Name+" "+n.Mount.Name+" "+map[bool]string{true: "new", false: "old"}[n.NewToAccount])
+	}
+	want := "Altvoh Albino Drake new,Altvoh Sea Turtle new,Borvoh Albino Drake new"
+	if strings.Join(got, ",") != want {
+		t.Errorf("NewMounts incorrect, got %v want %v", got, want)
+	}
+
+	var out bytes.Buffer
+	err = PrintMounts(ctx, env, "", &out)
+	if err != nil {
+		t.Fatalf("PrintMounts failed: %v", err)
+	}
+	lines := tableLines(out.String())
+	// None of them have a definition, the Community API never gave a mount's ID.
+	for _, s := range []string{"3 mounts collected on the account", "Source Count", "Unknown 3"} {
+		if !lines[s] {
+			t.Errorf("PrintMounts missing %q:\n%s", s, out.String())
+		}
+	}
+
+	out.Reset()
+	err = PrintMounts(ctx, env, "borvoh", &out)
+	if err != nil || !strings.Contains(out.String(), "2 mounts collected by Borvoh-Duskwood") || strings.Contains(out.String(), "Sea Turtle") {
+		t.Errorf("PrintMounts for a toon incorrect: %v\n%s", err, out.String())
+	}
+}
+
+func TestMountDefinitions(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeBlizzard(t)
+	defer fake.Close()
+	blizzard := newTestBlizzard(t, fake.Transport())
+	db, env, cleanup := newMigratedEnv(t)
+	defer cleanup()
+
+	profile, err := ioutil.ReadFile("test-json-profile.json")
+	if err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	}
+	toon := insertTestToon(t, db)
+	if err := saveMounts(ctx, env, toon.ID, time.Now(), string(profile)); err != nil {
+		t.Fatalf("saveMounts failed: %v", err)
+	}
+
+	if err := RefreshMountDefinitions(ctx, env, blizzard); err != nil {
+		t.Fatalf("RefreshMountDefinitions failed: %v", err)
+	}
+	definitions, _ := db.GetMountDefinitions(ctx)
+	want := map[int64]MountDefinition{
+		6:    {ID: 6, Name: "Brown Horse", Source: "Vendor", Faction: "Alliance"},
+		35:   {ID: 35, Name: "Ivory Raptor"},
+		363:  {ID: 363, Name: "Invincible", Source: "Drop"},
+		1025: {ID: 1025, Name: "The Hivemind", Source: "Achievement"},
+	}
+	if len(definitions) != len(want) {
+		t.Errorf("Want %v mount definitions, got %+v", len(want), definitions)
+	}
+	for _, d := range definitions {
+		if d != want[d.ID] {
+			t.Errorf("Mount %v incorrect, want %+v got %+v", d.ID, want[d.ID], d)
+		}
+	}
+	if unknown, _ := db.GetUnknownMounts(ctx); len(unknown) != 0 {
+		t.Errorf("Every mount should have a definition now, got %+v", unknown)
+	}
+
+	var out bytes.Buffer
+	if err := PrintMounts(ctx, env, "", &out); err != nil {
+		t.Fatalf("PrintMounts failed: %v", err)
+	}
+	lines := tableLines(out.String())
+	for _, s := range []string{"Vendor 1", "Drop 1", "Achievement 1", "Unknown 1", "Alliance 1", "Both 2"} {
+		if !lines[s] {
+			t.Errorf("PrintMounts missing %q:\n%s", s, out.String())
+		}
+	}
+}
@@ -1,3 +1,6 @@
+-- Legacy schema from before wowstats managed its own tables. Don't use it for a new database, wowstats
+-- upgrades a database built from it to the current schema the first time it runs.
+
 
 CREATE TABLE classes (
                        id INTEGER PRIMARY KEY NOT NULL,
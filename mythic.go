@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// A toon's Mythic+ rating for a season on a day.
+type MythicRating struct {
+	ID         int64
+	ToonID     uint
+	InsertDate time.Time `gorm:"type:date"`
+	SeasonID   int64
+	Rating     float64
+}
+
+// Keep InsertDate to just the day, for the same reason as Stat.
+func (r *MythicRating) BeforeSave() error {
+	r.InsertDate = truncateToDay(r.InsertDate)
+	return nil
+}
+
+// A keystone run. PeriodID is the week it was in, which is only known for runs that were among the week's
+// best when the profile was fetched. Duration is in milliseconds and Affixes are the affix names, comma
+// separated.
+type MythicRun struct {
+	ID            int64
+	ToonID        uint
+	SeasonID      int64
+	PeriodID      int64
+	DungeonID     int64
+	DungeonName   string
+	KeystoneLevel int64
+	Duration      int64
+	Timed         bool
+	Affixes       string
+	CompletedAt   time.Time
+	Rating        float64
+}
+
+// Whether this run is better than other: timed beats not timed, then a higher keystone, then a faster one.
+func (r *MythicRun) better(other *MythicRun) bool {
+	if r.Timed != other.Timed {
+		return r.Timed
+	}
+	if r.KeystoneLevel != other.KeystoneLevel {
+		return r.KeystoneLevel > other.KeystoneLevel
+	}
+	return r.Duration < other.Duration
+}
+
+// The run's time as minutes and seconds.
+func (r *MythicRun) DurationString() string {
+	d := time.Duration(r.Duration) * time.Millisecond
+	return fmt.Sprintf("%d:%02d", int(d.Minutes()), int(d.Seconds())%60)
+}
+
+// One week of keystones.
+type MythicWeek struct {
+	PeriodID  int64
+	Runs      int
+	Timed     int
+	BestLevel int64
+}
+
+// Get the rating and runs from what GetMythicKeystoneProfile returns. The rating is nil when there's no
+// season. A run that is both one of the week's best and one of the season's best is only returned once.
+func ParseMythicKeystone(myJson string) (*MythicRating, []MythicRun) {
+	season := gjson.Get(myJson, "current_season.season.id").Int()
+	for _, s := range gjson.Get(myJson, "seasons.#.id").Array() {
+		if s.Int() > season {
+			season = s.Int()
+		}
+	}
+
+	var rating *MythicRating
+	if r := gjson.Get(myJson, "current_mythic_rating.rating"); r.Exists() && season > 0 {
+		rating = &MythicRating{SeasonID: season, Rating: r.Float()}
+	} else if r := gjson.Get(myJson, "current_season.mythic_rating.rating"); r.Exists() {
+		rating = &MythicRating{SeasonID: season, Rating: r.Float()}
+	}
+
+	var runs []MythicRun
+	seen := make(map[string]bool)
+	add := func(r gjson.Result, period int64) {
+		var affixes []string
+		for _, a := range r.Get("keystone_affixes.#.name").Array() {
+			affixes = append(affixes, a.String())
+		}
+		run := MythicRun{
+			SeasonID:      season,
+			PeriodID:      period,
+			DungeonID:     r.Get("dungeon.id").Int(),
+			DungeonName:   r.Get("dungeon.name").String(),
+			KeystoneLevel: r.Get("keystone_level").Int(),
+			Duration:      r.Get("duration").Int(),
+			Timed:         r.Get("is_completed_within_time").Bool(),
+			Affixes:       strings.Join(affixes, ","),
+			CompletedAt:   time.Unix(0, r.Get("completed_timestamp").Int()*int64(time.Millisecond)).UTC(),
+			Rating:        r.Get("mythic_rating.rating").Float(),
+		}
+		key := fmt.Sprintf("%d-%d", run.DungeonID, run.CompletedAt.Unix())
+		if !seen[key] {
+			seen[key] = true
+			runs = append(runs, run)
+		}
+	}
+
+	period := gjson.Get(myJson, "current_period.period.id").Int()
+	for _, r := range gjson.Get(myJson, "current_period.best_runs").Array() {
+		add(r, period)
+	}
+	for _, r := range gjson.Get(myJson, "current_season.best_runs").Array() {
+		add(r, 0)
+	}
+	return rating, runs
+}
+
+// Fetch and save a toon's Mythic+ rating and runs. Toons that have never done a keystone don't have a
+// profile, that's not a failure.
+func insertMythicKeystone(ctx context.Context, t Toon, env *Env, blizzard Blizzard) {
+	myJson, err := blizzard.GetMythicKeystoneProfile(ctx, t)
+	if err == ErrNotFound {
+		return
+	}
+	if err != nil {
+		reportToonFailure(t, "mythic", err)
+		return
+	}
+
+	rating, runs := ParseMythicKeystone(myJson)
+	if rating != nil {
+		rating.ToonID = t.ID
+		rating.InsertDate = time.Now()
+	}
+	for i := range runs {
+		runs[i].ToonID = t.ID
+	}
+	err = env.db.SaveMythicKeystone(ctx, t.ID, time.Now(), rating, runs)
+	if err != nil {
+		reportToonFailure(t, "mythic", err)
+	}
+}
+
+// The best run in each dungeon, by dungeon name.
+func bestMythicRuns(runs []MythicRun) []MythicRun {
+	best := make(map[int64]MythicRun)
+	for _, r := range runs {
+		if b, ok := best[r.DungeonID]; !ok || r.better(&b) {
+			best[r.DungeonID] = r
+		}
+	}
+
+	var result []MythicRun
+	for _, r := range best {
+		result = append(result, r)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].DungeonName < result[j].DungeonName
+	})
+	return result
+}
+
+// Group the runs that have a week into weeks, the latest first.
+func mythicWeeks(runs []MythicRun) []MythicWeek {
+	byPeriod := make(map[int64]*MythicWeek)
+	for _, r := range runs {
+		if r.PeriodID == 0 {
+			continue
+		}
+		w, ok := byPeriod[r.PeriodID]
+		if !ok {
+			w = &MythicWeek{PeriodID: r.PeriodID}
+			byPeriod[r.PeriodID] = w
+		}
+		w.Runs++
+		if r.Timed {
+			w.Timed++
+		}
+		if r.KeystoneLevel > w.BestLevel {
+			w.BestLevel = r.KeystoneLevel
+		}
+	}
+
+	var weeks []MythicWeek
+	for _, w := range byPeriod {
+		weeks = append(weeks, *w)
+	}
+	sort.Slice(weeks, func(i, j int) bool {
+		return weeks[i].PeriodID > weeks[j].PeriodID
+	})
+	return weeks
+}
+
+// Get the latest rating of each toon as text, for putting next to the item level. Toons without a rating
+// aren't in the map.
+func latestMythicRatings(ctx context.Context, env *Env) (map[uint]string, error) {
+	ratings, err := env.db.GetLatestMythicRatings(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byToon := make(map[uint]string)
+	for _, r := range ratings {
+		byToon[r.ToonID] = fmt.Sprintf("%.0f", r.Rating)
+	}
+	return byToon, nil
+}
+
+// Print a toon's Mythic+ rating, its best run in each dungeon for the latest season and the weeks it ran
+// keystones in.
+func PrintMythicKeystone(ctx context.Context, env *Env, toonName string, out io.Writer) error {
+	toon, err := FindToon(ctx, env, toonName)
+	if err != nil {
+		return err
+	}
+	ratings, err := env.db.GetMythicRatingHistory(ctx, toon.ID)
+	if err != nil {
+		return err
+	}
+	runs, err := env.db.GetMythicRuns(ctx, toon.ID)
+	if err != nil {
+		return err
+	}
+
+	if len(ratings) == 0 {
+		_, _ = fmt.Fprintf(out, "%v-%v has no Mythic+ rating\n", toon.Name, toon.Realm)
+		return nil
+	}
+	latest := ratings[len(ratings)-1]
+	_, _ = fmt.Fprintf(out, "%v-%v: season %v rating %.1f on %v\n", toon.Name, toon.Realm, latest.SeasonID, latest.Rating, latest.InsertDate.Format("2006-01-02"))
+
+	var season []MythicRun
+	for _, r := range runs {
+		if r.SeasonID == latest.SeasonID {
+			season = append(season, r)
+		}
+	}
+
+	_, _ = fmt.Fprintln(out, "\nBest runs:")
+	w := tabwriter.NewWriter(out, 5, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "Dungeon\tLevel\tTime\tTimed\tAffixes\tDate\t")
+	for _, r := range bestMythicRuns(season) {
+		timed := "no"
+		if r.Timed {
+			timed = "yes"
+		}
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t\n", r.DungeonName, r.KeystoneLevel, r.DurationString(), timed, r.Affixes, r.CompletedAt.Local().Format("2006-01-02"))
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	_, _ = fmt.Fprintln(out, "\nWeeks:")
+	w = tabwriter.NewWriter(out, 5, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "Period\tDungeons\tTimed\tBest Level\t")
+	for _, week := range mythicWeeks(runs) {
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t\n", week.PeriodID, week.Runs, week.Timed, week.BestLevel)
+	}
+	return w.Flush()
+}
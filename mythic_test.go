@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+)
+
+func TestParseMythicKeystone(t *testing.T) {
+	jsonText, err := ioutil.ReadFile("test-json-mythic-keystone.json")
+	if err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	}
+
+	rating, runs := ParseMythicKeystone(string(jsonText))
+	if rating == nil || rating.SeasonID != 3 || rating.Rating != 565 {
+		t.Errorf("Rating incorrect, got %+v", rating)
+	}
+	// Atal'Dazar is one of the week's best runs and one of the season's.
+	if len(runs) != 5 {
+		t.Fatalf("Want 5 runs, got %v", len(runs))
+	}
+	atal := runs[0]
+	if atal.DungeonName != "Atal'Dazar" || atal.PeriodID != 725 || atal.KeystoneLevel != 12 || !atal.Timed ||
+		atal.Affixes != "Fortified,Bolstering,Explosive,Awakened" || atal.DurationString() != "27:00" {
+		t.Errorf("Atal'Dazar run incorrect, got %+v", atal)
+	}
+}
+
+func TestMythicKeystone(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeBlizzard(t)
+	defer fake.Close()
+	blizzard := newTestBlizzard(t, fake.Transport())
+	db, env, cleanup := newMigratedEnv(t)
+	defer cleanup()
+
+	toon := insertTestToon(t, db)
+	insertMythicKeystone(ctx, toon, env, blizzard)
+	insertMythicKeystone(ctx, toon, env, blizzard)
+
+	runs, _ := db.GetMythicRuns(ctx, toon.ID)
+	ratings, _ := db.GetMythicRatingHistory(ctx, toon.ID)
+	if len(runs) != 5 || len(ratings) != 1 {
+		t.Fatalf("Want 5 runs and 1 rating, got %v and %v", len(runs), len(ratings))
+	}
+
+	best := bestMythicRuns(runs)
+	for _, r := range best {
+		// The +11 this week wasn't timed, the +10 earlier in the season was.
+		if r.DungeonName == "Siege of Boralus" && r.KeystoneLevel != 10 {
+			t.Errorf("Best Siege of Boralus run incorrect, got %+v", r)
+		}
+	}
+	if len(best) != 4 {
+		t.Errorf("Want a best run for 4 dungeons, got %v", len(best))
+	}
+
+	var out bytes.Buffer
+	if err := PrintMythicKeystone(ctx, env, "borvoh", &out); err != nil {
+		t.Fatalf("PrintMythicKeystone failed: %v", err)
+	}
+	lines := tableLines(out.String())
+	for _, s := range []string{"Borvoh-Duskwood: season 3 rating 565.0 on " + ratings[0].InsertDate.Format("2006-01-02"), "725 2 1 12"} {
+		if !lines[s] {
+			t.Errorf("PrintMythicKeystone missing %q:\n%s", s, out.String())
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// A battle pet on the account, keyed by Blizzard's battlePetGuid. Pets are shared by every toon on an account
+// so ToonID is just the toon whose document last had it, which is the one that gets to say it was released.
+type Pet struct {
+	Guid      string `gorm:"primary_key"`
+	ToonID    uint
+	SpeciesID int64
+	Name      string
+	BreedID   int64
+	Quality   string
+	Level     int64
+	Health    int64
+	Power     int64
+	Speed     int64
+	FirstSeen time.Time `gorm:"type:date"`
+	LastSeen  time.Time `gorm:"type:date"`
+	Released  bool
+}
+
+// Keep the dates to just the day, for the same reason as Stat.
+func (p *Pet) BeforeSave() error {
+	p.FirstSeen = truncateToDay(p.FirstSeen)
+	p.LastSeen = truncateToDay(p.LastSeen)
+	return nil
+}
+
+// Something that happened to a pet. OldValue and NewValue are the level or quality before and after, the
+// name for a new pet or species.
+type PetEvent struct {
+	ID        int64
+	Guid      string
+	SpeciesID int64
+	EventDate time.Time `gorm:"type:date"`
+	Event     string
+	OldValue  string
+	NewValue  string
+}
+
+// Keep EventDate to just the day, for the same reason as Stat.
+func (e *PetEvent) BeforeSave() error {
+	e.EventDate = truncateToDay(e.EventDate)
+	return nil
+}
+
+// The kinds of PetEvent.
+const (
+	PetAcquired   = "acquired"
+	PetNewSpecies = "new species"
+	PetLevelUp    = "level"
+	PetQualityUp  = "quality"
+	PetReleased   = "released"
+)
+
+// The level pets stop at and the quality battlers want them at.
+const (
+	petMaxLevel    = 25
+	petRareQuality = "RARE"
+)
+
+// How many days of pet events the report shows.
+const petReportDays = 7
+
+// Get the pets from a character document, either the Profile API or the Community API one. The Profile API
+// gives the guid as a number, it's formatted the way the Community API had it.
+func ParsePets(myJson string) []Pet {
+	var pets []Pet
+
+	if collected := gjson.Get(myJson, "pets_collection.pets"); collected.Exists() {
+		collected.ForEach(func(_, p gjson.Result) bool {
+			name := p.Get("name").String()
+			if name == "" {
+				name = p.Get("species.name").String()
+			}
+			pets = append(pets, Pet{
+				Guid:      fmt.Sprintf("%016x", p.Get("id").Uint()),
+				SpeciesID: p.Get("species.id").Int(),
+				Name:      name,
+				BreedID:   p.Get("stats.breed_id").Int(),
+				Quality:   p.Get("quality.type").String(),
+				Level:     p.Get("level").Int(),
+				Health:    p.Get("stats.health").Int(),
+				Power:     p.Get("stats.power").Int(),
+				Speed:     p.Get("stats.speed").Int(),
+			})
+			return true
+		})
+		return pets
+	}
+
+	gjson.Get(myJson, "pets.collected").ForEach(func(_, p gjson.Result) bool {
+		if p.Get("battlePetGuid").String() == "" {
+			return true
+		}
+		quality := ""
+		if q := p.Get("stats.petQualityId").Int(); q >= 0 && int(q) < len(communityQualities) {
+			quality = communityQualities[q]
+		}
+		pets = append(pets, Pet{
+			Guid:      p.Get("battlePetGuid").String(),
+			SpeciesID: p.Get("stats.speciesId").Int(),
+			Name:      p.Get("name").String(),
+			BreedID:   p.Get("stats.breedId").Int(),
+			Quality:   quality,
+			Level:     p.Get("stats.level").Int(),
+			Health:    p.Get("stats.health").Int(),
+			Power:     p.Get("stats.power").Int(),
+			Speed:     p.Get("stats.speed").Int(),
+		})
+		return true
+	})
+	return pets
+}
+
+// Update the roster from the pets in a toon's document for a day.
+func savePets(ctx context.Context, env *Env, toonId uint, day time.Time, myJson string) error {
+	pets := ParsePets(myJson)
+	if len(pets) == 0 {
+		return nil
+	}
+	return env.db.UpdatePetRoster(ctx, toonId, day, pets)
+}
+
+// Work out how the roster changes with the pets a toon had on a day. It returns the pets that are new, the
+// ones that changed and the events. A document that is older than when a pet was last seen, which happens
+// when backfilling, can only move its FirstSeen back, everything else it says is out of date.
+func petChanges(roster []Pet, toonId uint, day time.Time, pets []Pet) ([]Pet, []Pet, []PetEvent) {
+	day = truncateToDay(day)
+	byGuid := make(map[string]Pet)
+	species := make(map[int64]bool)
+	for _, p := range roster {
+		byGuid[p.Guid] = p
+		species[p.SpeciesID] = true
+	}
+
+	var added, changed []Pet
+	var events []PetEvent
+	event := func(p Pet, kind string, oldValue string, newValue string) {
+		events = append(events, PetEvent{Guid: p.Guid, SpeciesID: p.SpeciesID, EventDate: day, Event: kind, OldValue: oldValue, NewValue: newValue})
+	}
+
+	seen := make(map[string]bool)
+	for _, p := range pets {
+		seen[p.Guid] = true
+		p.ToonID = toonId
+		p.FirstSeen = day
+		p.LastSeen = day
+
+		old, ok := byGuid[p.Guid]
+		if !ok {
+			added = append(added, p)
+			event(p, PetAcquired, "", p.Name)
+			if !species[p.SpeciesID] {
+				event(p, PetNewSpecies, "", p.Name)
+				species[p.SpeciesID] = true
+			}
+			byGuid[p.Guid] = p
+			continue
+		}
+
+		if day.Before(truncateToDay(old.LastSeen)) {
+			if day.Before(truncateToDay(old.FirstSeen)) {
+				old.FirstSeen = day
+				changed = append(changed, old)
+			}
+			continue
+		}
+
+		p.FirstSeen = old.FirstSeen
+		if p.Level != old.Level {
+			event(p, PetLevelUp, strconv.FormatInt(old.Level, 10), strconv.FormatInt(p.Level, 10))
+		}
+		if p.Quality != old.Quality {
+			event(p, PetQualityUp, old.Quality, p.Quality)
+		}
+		if p != old {
+			changed = append(changed, p)
+		}
+	}
+
+	for _, p := range roster {
+		if p.ToonID == toonId && !p.Released && !seen[p.Guid] && !day.Before(truncateToDay(p.LastSeen)) {
+			p.Released = true
+			changed = append(changed, p)
+			event(p, PetReleased, "", p.Name)
+		}
+	}
+	return added, changed, events
+}
+
+// Print the roster report: how many pets are at the top level and at rare quality, the species there is more
+// than one of and what happened in the last few days.
+func PrintPets(ctx context.Context, env *Env, out io.Writer) error {
+	roster, err := env.db.GetPets(ctx)
+	if err != nil {
+		return err
+	}
+	events, err := env.db.GetPetEvents(ctx, time.Now().AddDate(0, 0, -petReportDays))
+	if err != nil {
+		return err
+	}
+
+	var pets []Pet
+	bySpecies := make(map[int64][]Pet)
+	maxLevel, rare := 0, 0
+	for _, p := range roster {
+		if p.Released {
+			continue
+		}
+		pets = append(pets, p)
+		bySpecies[p.SpeciesID] = append(bySpecies[p.SpeciesID], p)
+		if p.Level >= petMaxLevel {
+			maxLevel++
+		}
+		if p.Quality == petRareQuality {
+			rare++
+		}
+	}
+	names := make(map[string]string)
+	for _, p := range roster {
+		names[p.Guid] = p.Name
+	}
+
+	_, _ = fmt.Fprintf(out, "%v pets of %v species\n", len(pets), len(bySpecies))
+	_, _ = fmt.Fprintf(out, "Level %v: %v\n", petMaxLevel, maxLevel)
+	_, _ = fmt.Fprintf(out, "Rare: %v\n", rare)
+
+	var duplicated [][]Pet
+	for _, s := range bySpecies {
+		if len(s) > 1 {
+			duplicated = append(duplicated, s)
+		}
+	}
+	sort.Slice(duplicated, func(i, j int) bool {
+		if len(duplicated[i]) != len(duplicated[j]) {
+			return len(duplicated[i]) > len(duplicated[j])
+		}
+		return duplicated[i][0].Name < duplicated[j][0].Name
+	})
+
+	_, _ = fmt.Fprintln(out, "\nDuplicated species:")
+	w := tabwriter.NewWriter(out, 5, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "Species\tCount\tLevels\tQualities\t")
+	for _, s := range duplicated {
+		levels, qualities := "", ""
+		for i, p := range s {
+			if i > 0 {
+				levels += ","
+				qualities += ","
+			}
+			levels += strconv.FormatInt(p.Level, 10)
+			qualities += p.Quality
+		}
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t\n", s[0].Name, len(s), levels, qualities)
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	_, _ = fmt.Fprintf(out, "\nChanges in the last %v days:\n", petReportDays)
+	w = tabwriter.NewWriter(out, 5, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "Date\tPet\tEvent\tOld\tNew\t")
+	for _, e := range events {
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t\n", e.EventDate.Format("2006-01-02"), names[e.Guid], e.Event, e.OldValue, e.NewValue)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePets(t *testing.T) {
+	profile, err := ioutil.ReadFile("test-json-profile.json")
+	if err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	}
+	community, err := ioutil.ReadFile("test-json.json")
+	if err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	}
+
+	want := Pet{Guid: "000000000b9c44c0", SpeciesID: 2678, Name: "Abyssal Slitherling", BreedID: 5, Quality: "RARE", Level: 25, Health: 1319, Power: 288, Speed: 313}
+	for _, doc := range [][]byte{profile, community} {
+		pets := ParsePets(string(doc))
+		found := false
+		for _, p := range pets {
+			if p.Guid == want.Guid {
+				found = true
+				if p != want {
+					t.Errorf("Pet incorrect, got %+v want %+v", p, want)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("No pet %v in %v pets", want.Guid, len(pets))
+		}
+	}
+	if pets := ParsePets(string(community)); len(pets) != 1227 {
+		t.Errorf("Want 1227 community pets, got %v", len(pets))
+	}
+}
+
+func TestPetRoster(t *testing.T) {
+	ctx := context.Background()
+	db, env, cleanup := newMigratedEnv(t)
+	defer cleanup()
+
+	toon := insertTestToon(t, db)
+
+	pet := func(guid string, species int, name string, quality int, level int) string {
+		return `{"name": "` + name + `", "battlePetGuid": "` + guid + `", "stats": {"speciesId": ` + strconv.Itoa(species) +
+			`, "petQualityId": ` + strconv.Itoa(quality) + `, "level": ` + strconv.Itoa(level) + `}}`
+	}
+	doc := func(pets ...string) string {
+		return `{"pets": {"collected": [` + strings.Join(pets, ",") + `]}}`
+	}
+	today := truncateToDay(time.Now())
+	snapshots := []struct {
+		day time.Time
+		doc string
+	}{
+		{today.AddDate(0, 0, -2), doc(pet("a", 1, "Mechanical Squirrel", 1, 1), pet("b", 2, "Jade Tiger", 3, 25))},
+		{today.AddDate(0, 0, -1), doc(pet("a", 1, "Mechanical Squirrel", 3, 3), pet("c", 1, "Mechanical Squirrel", 3, 25))},
+		// An older archive only moves FirstSeen back.
+		{today.AddDate(0, 0, -5), doc(pet("a", 1, "Mechanical Squirrel", 0, 1))},
+	}
+	for _, s := range snapshots {
+		if err := savePets(ctx, env, toon.ID, s.day, s.doc); err != nil {
+			t.Fatalf("savePets failed: %v", err)
+		}
+	}
+
+	pets, _ := db.GetPets(ctx)
+	if len(pets) != 3 {
+		t.Fatalf("Want 3 pets, got %+v", pets)
+	}
+	for _, p := range pets {
+		switch p.Guid {
+		case "a":
+			if p.Level != 3 || p.Quality != "RARE" || !p.FirstSeen.Equal(today.AddDate(0, 0, -5)) {
+				t.Errorf("Pet a incorrect, got %+v", p)
+			}
+		case "b":
+			if !p.Released {
+				t.Errorf("Pet b should be released, got %+v", p)
+			}
+		}
+	}
+
+	events, _ := db.GetPetEvents(ctx, today.AddDate(0, 0, -30))
+	var got []string
+	for _, e := range events {
+		got = append(got, e.Guid+" "+e.Event+" "+e.OldValue+" "+e.NewValue)
+	}
+	want := []string{
+		"a acquired  Mechanical Squirrel",
+		"a new species  Mechanical Squirrel",
+		"b acquired  Jade Tiger",
+		"b new species  Jade Tiger",
+		"a level 1 3",
+		"a quality COMMON RARE",
+		"c acquired  Mechanical Squirrel",
+		"b released  Jade Tiger",
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Events incorrect, got\n%v\nwant\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	var out bytes.Buffer
+	if err := PrintPets(ctx, env, &out); err != nil {
+		t.Fatalf("PrintPets failed: %v", err)
+	}
+	for _, s := range []string{"2 pets of 1 species", "Level 25: 1", "Rare: 2", "Mechanical Squirrel   2", "released"} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("PrintPets missing %q:\n%s", s, out.String())
+		}
+	}
+}
+
+func TestCreatePetIfMissing(t *testing.T) {
+	ctx := context.Background()
+	db, _, cleanup := newMigratedEnv(t)
+	defer cleanup()
+	toon := insertTestToon(t, db)
+
+	// Another toon on the account adding the pet first is the same as it already being there.
+	for i, want := range []bool{true, false} {
+		pet := Pet{Guid: "a", ToonID: toon.ID, Name: "Mechanical Squirrel", Level: int64(i + 1)}
+		inserted, err := db.createIfMissing(db.DB, &pet)
+		if err != nil || inserted != want {
+			t.Errorf("Insert %v of pet a incorrect, want %v got %v: %v", i+1, want, inserted, err)
+		}
+	}
+	pets, _ := db.GetPets(ctx)
+	if len(pets) != 1 || pets[0].Level != 1 {
+		t.Errorf("The second insert should have left pet a alone, got %+v", pets)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// A toon's skill in a profession on a day. Each expansion has its own tier of a profession, like Kul Tiran
+// Tailoring, with its own skill. Archaeology doesn't have tiers, its TierID is 0 and TierName is the
+// profession's name.
+type ProfessionSkill struct {
+	ID             int64
+	ToonID         uint
+	InsertDate     time.Time `gorm:"type:date"`
+	ProfessionID   int64
+	ProfessionName string
+	IsPrimary      bool
+	TierID         int64
+	TierName       string
+	SkillPoints    int64
+	MaxSkillPoints int64
+}
+
+// Keep InsertDate to just the day, for the same reason as Stat.
+func (s *ProfessionSkill) BeforeSave() error {
+	s.InsertDate = truncateToDay(s.InsertDate)
+	return nil
+}
+
+// A recipe a toon knows and the first day it was seen.
+type ToonRecipe struct {
+	ID           int64
+	ToonID       uint
+	RecipeID     int64
+	Name         string
+	ProfessionID int64
+	TierID       int64
+	FirstSeen    time.Time `gorm:"type:date"`
+}
+
+// Keep FirstSeen to just the day, for the same reason as Stat.
+func (r *ToonRecipe) BeforeSave() error {
+	r.FirstSeen = truncateToDay(r.FirstSeen)
+	return nil
+}
+
+// Get the skill in each profession tier and the known recipes from the professions document. The Community
+// API document only has the old single skill per profession and isn't parsed.
+func ParseProfessions(myJson string) ([]ProfessionSkill, []ToonRecipe) {
+	var skills []ProfessionSkill
+	var recipes []ToonRecipe
+
+	parse := func(p gjson.Result, primary bool) {
+		profession := ProfessionSkill{
+			ProfessionID:   p.Get("profession.id").Int(),
+			ProfessionName: p.Get("profession.name").String(),
+			IsPrimary:      primary,
+		}
+		if !p.Get("tiers").Exists() {
+			profession.TierName = profession.ProfessionName
+			profession.SkillPoints = p.Get("skill_points").Int()
+			profession.MaxSkillPoints = p.Get("max_skill_points").Int()
+			skills = append(skills, profession)
+			return
+		}
+
+		for _, t := range p.Get("tiers").Array() {
+			skill := profession
+			skill.TierID = t.Get("tier.id").Int()
+			skill.TierName = t.Get("tier.name").String()
+			skill.SkillPoints = t.Get("skill_points").Int()
+			skill.MaxSkillPoints = t.Get("max_skill_points").Int()
+			skills = append(skills, skill)
+
+			for _, r := range t.Get("known_recipes").Array() {
+				recipes = append(recipes, ToonRecipe{
+					RecipeID:     r.Get("id").Int(),
+					Name:         r.Get("name").String(),
+					ProfessionID: skill.ProfessionID,
+					TierID:       skill.TierID,
+				})
+			}
+		}
+	}
+
+	for _, p := range gjson.Get(myJson, "professions.primaries").Array() {
+		parse(p, true)
+	}
+	for _, p := range gjson.Get(myJson, "professions.secondaries").Array() {
+		parse(p, false)
+	}
+	return skills, recipes
+}
+
+// Save the profession skills and recipes in the document for a toon on a day.
+func saveProfessions(ctx context.Context, env *Env, toonId uint, day time.Time, myJson string) error {
+	skills, recipes := ParseProfessions(myJson)
+	if len(skills) == 0 {
+		return nil
+	}
+	for i := range skills {
+		skills[i].ToonID = toonId
+		skills[i].InsertDate = day
+	}
+	for i := range recipes {
+		recipes[i].ToonID = toonId
+		recipes[i].FirstSeen = day
+	}
+	return env.db.SaveProfessions(ctx, toonId, day, skills, recipes)
+}
+
+// How much skill a toon gained in a tier.
+type SkillGain struct {
+	Latest ProfessionSkill
+	Gained int64
+}
+
+// Work out the skill gained in each tier from history, which has to be ordered by toon, profession, tier and
+// date.
+func skillGains(history []ProfessionSkill) []SkillGain {
+	var gains []SkillGain
+	for start := 0; start < len(history); {
+		end := start
+		for end < len(history) && history[end].ToonID == history[start].ToonID &&
+			history[end].ProfessionID == history[start].ProfessionID && history[end].TierID == history[start].TierID {
+			end++
+		}
+		first, last := history[start], history[end-1]
+		if last.SkillPoints > first.SkillPoints {
+			gains = append(gains, SkillGain{Latest: last, Gained: last.SkillPoints - first.SkillPoints})
+		}
+		start = end
+	}
+	return gains
+}
+
+// Get the recipes first seen on or after since. The recipes a tier had the first day it was seen were
+// learned before there was anything to compare to, so they aren't counted.
+func learnedRecipes(recipes []ToonRecipe, since time.Time) []ToonRecipe {
+	type tierKey struct {
+		toonId uint
+		tierId int64
+	}
+	baseline := make(map[tierKey]time.Time)
+	for _, r := range recipes {
+		key := tierKey{r.ToonID, r.TierID}
+		if first, ok := baseline[key]; !ok || r.FirstSeen.Before(first) {
+			baseline[key] = r.FirstSeen
+		}
+	}
+
+	since = truncateToDay(since)
+	var learned []ToonRecipe
+	for _, r := range recipes {
+		if !r.FirstSeen.Before(since) && r.FirstSeen.After(baseline[tierKey{r.ToonID, r.TierID}]) {
+			learned = append(learned, r)
+		}
+	}
+	return learned
+}
+
+// Print which toons have which professions, with their skill in each tier in the order Blizzard gives them,
+// and the skill gained and recipes learned in the last days days.
+func PrintProfessions(ctx context.Context, env *Env, days int, out io.Writer) error {
+	since := time.Now().AddDate(0, 0, -days)
+	toons, err := env.db.GetAllToons(ctx)
+	if err != nil {
+		return err
+	}
+	latest, err := env.db.GetLatestProfessionSkills(ctx)
+	if err != nil {
+		return err
+	}
+	history, err := env.db.GetProfessionSkillHistory(ctx, since)
+	if err != nil {
+		return err
+	}
+	recipes, err := env.db.GetToonRecipes(ctx)
+	if err != nil {
+		return err
+	}
+
+	names := make(map[uint]string)
+	for _, t := range toons {
+		names[t.ID] = t.Name
+	}
+	tiers := make(map[int64]string)
+	for _, s := range history {
+		tiers[s.TierID] = s.TierName
+	}
+	for _, s := range latest {
+		tiers[s.TierID] = s.TierName
+	}
+
+	type professionKey struct {
+		toonId       uint
+		professionId int64
+	}
+	byProfession := make(map[professionKey][]ProfessionSkill)
+	var coverage []professionKey
+	for _, s := range latest {
+		key := professionKey{s.ToonID, s.ProfessionID}
+		if _, ok := byProfession[key]; !ok {
+			coverage = append(coverage, key)
+		}
+		byProfession[key] = append(byProfession[key], s)
+	}
+	sort.Slice(coverage, func(i, j int) bool {
+		a, b := byProfession[coverage[i]][0], byProfession[coverage[j]][0]
+		if a.IsPrimary != b.IsPrimary {
+			return a.IsPrimary
+		}
+		if a.ProfessionName != b.ProfessionName {
+			return a.ProfessionName < b.ProfessionName
+		}
+		return names[a.ToonID] < names[b.ToonID]
+	})
+
+	_, _ = fmt.Fprintln(out, "Professions:")
+	w := tabwriter.NewWriter(out, 5, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "Profession\tName\tSkill\t")
+	for _, key := range coverage {
+		var skills []string
+		for _, s := range byProfession[key] {
+			skills = append(skills, fmt.Sprintf("%v %v/%v", s.TierName, s.SkillPoints, s.MaxSkillPoints))
+		}
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t\n", byProfession[key][0].ProfessionName, names[key.toonId], strings.Join(skills, ", "))
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	gains := skillGains(history)
+	sort.Slice(gains, func(i, j int) bool {
+		return gains[i].Gained > gains[j].Gained
+	})
+	_, _ = fmt.Fprintf(out, "\nSkill gained in the last %v days:\n", days)
+	w = tabwriter.NewWriter(out, 5, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "Name\tTier\tSkill\tGained\t")
+	for _, g := range gains {
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v/%v\t%+d\t\n", names[g.Latest.ToonID], g.Latest.TierName, g.Latest.SkillPoints, g.Latest.MaxSkillPoints, g.Gained)
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	_, _ = fmt.Fprintf(out, "\nRecipes learned in the last %v days:\n", days)
+	w = tabwriter.NewWriter(out, 5, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "Date\tName\tTier\tRecipe\t")
+	for _, r := range learnedRecipes(recipes, since) {
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t\n", r.FirstSeen.Format("2006-01-02"), names[r.ToonID], tiers[r.TierID], r.Name)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestParseProfessions(t *testing.T) {
+	jsonText, err := ioutil.ReadFile("test-json-profile.json")
+	if err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	}
+
+	skills, recipes := ParseProfessions(string(jsonText))
+	if len(skills) != 6 || len(recipes) != 11 {
+		t.Fatalf("Want 6 skills and 11 recipes, got %v and %v", len(skills), len(recipes))
+	}
+	want := ProfessionSkill{ProfessionID: 197, ProfessionName: "Tailoring", IsPrimary: true, TierID: 2533, TierName: "Kul Tiran Tailoring", SkillPoints: 150, MaxSkillPoints: 175}
+	if skills[1] != want {
+		t.Errorf("Kul Tiran Tailoring incorrect, got %+v want %+v", skills[1], want)
+	}
+	archaeology := skills[5]
+	if archaeology.TierID != 0 || archaeology.TierName != "Archaeology" || archaeology.IsPrimary || archaeology.SkillPoints != 800 {
+		t.Errorf("Archaeology incorrect, got %+v", archaeology)
+	}
+	if recipes[3].Name != "Tidespray Linen Bandage" || recipes[3].TierID != 2533 || recipes[3].ProfessionID != 197 {
+		t.Errorf("Recipe incorrect, got %+v", recipes[3])
+	}
+}
+
+// The profile from before the Embroidered Deep Sea Cloak was learned, with 10 less Kul Tiran Tailoring.
+func earlierProfessions(t *testing.T, jsonText []byte) string {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(jsonText, &doc); err != nil {
+		t.Fatal(err)
+	}
+	tailoring := doc["professions"].(map[string]interface{})["primaries"].([]interface{})[0].(map[string]interface{})
+	tier := tailoring["tiers"].([]interface{})[1].(map[string]interface{})
+	tier["skill_points"] = 140
+	known := tier["known_recipes"].([]interface{})
+	tier["known_recipes"] = known[:len(known)-1]
+
+	earlier, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(earlier)
+}
+
+func TestProfessions(t *testing.T) {
+	ctx := context.Background()
+	db, env, cleanup := newMigratedEnv(t)
+	defer cleanup()
+
+	toon := insertTestToon(t, db)
+
+	// Today's document first and then an older one, the way backfill would, to move the recipes' FirstSeen back.
+	jsonText, _ := ioutil.ReadFile("test-json-profile.json")
+	today := truncateToDay(time.Now())
+	earlier := today.AddDate(0, 0, -3)
+	if err := saveProfessions(ctx, env, toon.ID, today, string(jsonText)); err != nil {
+		t.Fatalf("saveProfessions failed: %v", err)
+	}
+	if err := saveProfessions(ctx, env, toon.ID, earlier, earlierProfessions(t, jsonText)); err != nil {
+		t.Fatalf("saveProfessions failed: %v", err)
+	}
+
+	recipes, _ := db.GetToonRecipes(ctx)
+	if len(recipes) != 11 {
+		t.Fatalf("Want 11 recipes, got %v", len(recipes))
+	}
+	learned := learnedRecipes(recipes, earlier)
+	if len(learned) != 1 || learned[0].Name != "Embroidered Deep Sea Cloak" || !learned[0].FirstSeen.Equal(today) {
+		t.Errorf("Only the cloak should have been learned, got %+v", learned)
+	}
+
+	var out bytes.Buffer
+	if err := PrintProfessions(ctx, env, 7, &out); err != nil {
+		t.Fatalf("PrintProfessions failed: %v", err)
+	}
+	lines := tableLines(out.String())
+	for _, s := range []string{"Tailoring Borvoh Tailoring 300/300, Kul Tiran Tailoring 150/175", "Archaeology Borvoh Archaeology 800/950",
+		"Borvoh Kul Tiran Tailoring 150/175 +10", today.Format("2006-01-02") + " Borvoh Kul Tiran Tailoring Embroidered Deep Sea Cloak"} {
+		if !lines[s] {
+			t.Errorf("PrintProfessions missing %q:\n%s", s, out.String())
+		}
+	}
+}
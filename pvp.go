@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// A toon's honor on a day, from the PvP summary.
+type PvpSummary struct {
+	ID             int64
+	ToonID         uint
+	InsertDate     time.Time `gorm:"type:date"`
+	HonorLevel     int64
+	HonorableKills int64
+}
+
+// Keep InsertDate to just the day, for the same reason as Stat.
+func (s *PvpSummary) BeforeSave() error {
+	s.InsertDate = truncateToDay(s.InsertDate)
+	return nil
+}
+
+// A toon's rating and games in a bracket on a day. Bracket is the name Blizzard uses in the URL: 2v2, 3v3,
+// rbg or shuffle-class-spec.
+type PvpBracket struct {
+	ID           int64
+	ToonID       uint
+	InsertDate   time.Time `gorm:"type:date"`
+	Bracket      string
+	SeasonID     int64
+	Rating       int64
+	SeasonPlayed int64
+	SeasonWon    int64
+	SeasonLost   int64
+	WeeklyPlayed int64
+	WeeklyWon    int64
+	WeeklyLost   int64
+}
+
+// Keep InsertDate to just the day, for the same reason as Stat.
+func (b *PvpBracket) BeforeSave() error {
+	b.InsertDate = truncateToDay(b.InsertDate)
+	return nil
+}
+
+// A bracket's latest rating and how it changed.
+type PvpTrend struct {
+	Toon   Toon
+	Latest PvpBracket
+	Change int64
+	Honor  int64
+}
+
+// Get the honor and brackets from a character document. The Community API document only has honorable kills
+// and no brackets.
+func ParsePvp(myJson string) (*PvpSummary, []PvpBracket) {
+	var summary *PvpSummary
+	if s := gjson.Get(myJson, "pvp_summary"); s.Exists() {
+		summary = &PvpSummary{HonorLevel: s.Get("honor_level").Int(), HonorableKills: s.Get("honorable_kills").Int()}
+	}
+
+	var brackets []PvpBracket
+	gjson.Get(myJson, "pvp_brackets").ForEach(func(name, b gjson.Result) bool {
+		brackets = append(brackets, PvpBracket{
+			Bracket:      name.String(),
+			SeasonID:     b.Get("season.id").Int(),
+			Rating:       b.Get("rating").Int(),
+			SeasonPlayed: b.Get("season_match_statistics.played").Int(),
+			SeasonWon:    b.Get("season_match_statistics.won").Int(),
+			SeasonLost:   b.Get("season_match_statistics.lost").Int(),
+			WeeklyPlayed: b.Get("weekly_match_statistics.played").Int(),
+			WeeklyWon:    b.Get("weekly_match_statistics.won").Int(),
+			WeeklyLost:   b.Get("weekly_match_statistics.lost").Int(),
+		})
+		return true
+	})
+	sort.Slice(brackets, func(i, j int) bool {
+		return brackets[i].Bracket < brackets[j].Bracket
+	})
+	return summary, brackets
+}
+
+// Save the honor and brackets in the document for a toon on a day.
+func savePvp(ctx context.Context, env *Env, toonId uint, day time.Time, myJson string) error {
+	summary, brackets := ParsePvp(myJson)
+	if summary == nil && len(brackets) == 0 {
+		return nil
+	}
+	if summary != nil {
+		summary.ToonID = toonId
+		summary.InsertDate = day
+	}
+	for i := range brackets {
+		brackets[i].ToonID = toonId
+		brackets[i].InsertDate = day
+	}
+	return env.db.SavePvp(ctx, toonId, day, summary, brackets)
+}
+
+// Work out each toon's latest rating in each bracket and how much it changed since the first day on or after
+// since.
+func PvpTrends(ctx context.Context, env *Env, since time.Time) ([]PvpTrend, error) {
+	toons, err := env.db.GetAllToons(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var trends []PvpTrend
+	for _, t := range toons {
+		history, err := env.db.GetPvpBracketHistory(ctx, t.ID, since)
+		if err != nil {
+			return nil, err
+		}
+		summary, err := env.db.GetLatestPvpSummary(ctx, t.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		first := make(map[string]PvpBracket)
+		latest := make(map[string]PvpBracket)
+		for _, b := range history {
+			if _, ok := first[b.Bracket]; !ok {
+				first[b.Bracket] = b
+			}
+			latest[b.Bracket] = b
+		}
+		for name, b := range latest {
+			trend := PvpTrend{Toon: t, Latest: b, Change: b.Rating - first[name].Rating}
+			if summary != nil {
+				trend.Honor = summary.HonorLevel
+			}
+			trends = append(trends, trend)
+		}
+	}
+
+	sort.Slice(trends, func(i, j int) bool {
+		if trends[i].Latest.Bracket != trends[j].Latest.Bracket {
+			return trends[i].Latest.Bracket < trends[j].Latest.Bracket
+		}
+		return trends[i].Latest.Rating > trends[j].Latest.Rating
+	})
+	return trends, nil
+}
+
+// Write the rating of each toon in each bracket with the change over the last days days, the season and
+// weekly records and the toon's honor level.
+func PrintPvpSummary(ctx context.Context, env *Env, days int, out io.Writer) error {
+	trends, err := PvpTrends(ctx, env, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 5, 0, 3, ' ', tabwriter.AlignRight)
+	_, _ = fmt.Fprintf(w, "Name\tBracket\tRating\t%vd Change\tSeason W-L\tWeek W-L\tHonor Level\t\n", days)
+	for _, t := range trends {
+		b := t.Latest
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%+d\t%v-%v\t%v-%v\t%v\t\n", t.Toon.Name, b.Bracket, b.Rating, t.Change,
+			b.SeasonWon, b.SeasonLost, b.WeeklyWon, b.WeeklyLost, t.Honor)
+	}
+	return w.Flush()
+}
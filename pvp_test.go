@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePvp(t *testing.T) {
+	profile, err := ioutil.ReadFile("test-json-profile.json")
+	if err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	}
+
+	summary, brackets := ParsePvp(string(profile))
+	if summary == nil || summary.HonorLevel != 53 || summary.HonorableKills != 11425 {
+		t.Errorf("PvP summary incorrect, got %+v", summary)
+	}
+	if len(brackets) != 3 || brackets[0].Bracket != "2v2" || brackets[2].Bracket != "rbg" {
+		t.Fatalf("Want the 2v2, 3v3 and rbg brackets, got %+v", brackets)
+	}
+	want := PvpBracket{Bracket: "3v3", SeasonID: 27, Rating: 1788, SeasonPlayed: 112, SeasonWon: 60, SeasonLost: 52, WeeklyPlayed: 14, WeeklyWon: 9, WeeklyLost: 5}
+	if brackets[1] != want {
+		t.Errorf("3v3 bracket incorrect, got %+v want %+v", brackets[1], want)
+	}
+
+	if summary, brackets := ParsePvp(`{"totalHonorableKills": 11425}`); summary != nil || len(brackets) != 0 {
+		t.Errorf("A Community API document has no PvP summary or brackets, got %+v %+v", summary, brackets)
+	}
+}
+
+func TestPvpTrends(t *testing.T) {
+	ctx := context.Background()
+	db, env, cleanup := newMigratedEnv(t)
+	defer cleanup()
+
+	toon := insertTestToon(t, db)
+
+	profile, _ := ioutil.ReadFile("test-json-profile.json")
+	earlier := strings.Replace(string(profile), `"rating": 1788,`, `"rating": 1750,`, 1)
+	today := truncateToDay(time.Now())
+	for i, doc := range []string{earlier, string(profile), string(profile)} {
+		day := today
+		if i == 0 {
+			day = today.AddDate(0, 0, -3)
+		}
+		if err := savePvp(ctx, env, toon.ID, day, doc); err != nil {
+			t.Fatalf("savePvp failed: %v", err)
+		}
+	}
+
+	history, _ := db.GetPvpBracketHistory(ctx, toon.ID, today.AddDate(0, 0, -30))
+	if len(history) != 6 {
+		t.Errorf("Want 6 brackets over two days, got %v", len(history))
+	}
+
+	var out bytes.Buffer
+	if err := PrintPvpSummary(ctx, env, 7, &out); err != nil {
+		t.Fatalf("PrintPvpSummary failed: %v", err)
+	}
+	lines := tableLines(out.String())
+	for _, s := range []string{"Borvoh 3v3 1788 +38 60-52 9-5 53", "Borvoh 2v2 1523 +0 25-23 4-2 53"} {
+		if !lines[s] {
+			t.Errorf("PrintPvpSummary missing %q:\n%s", s, out.String())
+		}
+	}
+}
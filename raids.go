@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// How far a toon is through a raid on a difficulty on the day it was fetched. Difficulty is Blizzard's type,
+// like HEROIC or LEGACY_25_MAN.
+type RaidProgress struct {
+	ID            int64
+	ToonID        uint
+	InsertDate    time.Time `gorm:"type:date"`
+	ExpansionID   int64
+	ExpansionName string
+	InstanceID    int64
+	InstanceName  string
+	Difficulty    string
+	Completed     int64
+	Total         int64
+}
+
+func (RaidProgress) TableName() string {
+	return "raid_progress"
+}
+
+// Keep InsertDate to just the day, for the same reason as Stat.
+func (p *RaidProgress) BeforeSave() error {
+	p.InsertDate = truncateToDay(p.InsertDate)
+	return nil
+}
+
+// A boss a toon had killed on a difficulty as of the day it was fetched. The encounters document only has the
+// latest kill, so FirstKill is the earliest kill that has been seen: for a boss that had been killed more than
+// once before it was first fetched that's a later kill than the real first one.
+type RaidKill struct {
+	ID            int64
+	ToonID        uint
+	InsertDate    time.Time `gorm:"type:date"`
+	InstanceID    int64
+	Difficulty    string
+	EncounterID   int64
+	EncounterName string
+	Kills         int64
+	FirstKill     time.Time
+	LastKill      time.Time
+}
+
+// Keep InsertDate to just the day, for the same reason as Stat.
+func (k *RaidKill) BeforeSave() error {
+	k.InsertDate = truncateToDay(k.InsertDate)
+	return nil
+}
+
+// The raid difficulties from easiest to hardest and how the report shortens them.
+var raidDifficulties = []struct {
+	Type  string
+	Short string
+}{
+	{"LFR", "LFR"},
+	{"LEGACY_10_MAN", "10"},
+	{"LEGACY_25_MAN", "25"},
+	{"NORMAL", "N"},
+	{"LEGACY_10_MAN_HEROIC", "10H"},
+	{"LEGACY_25_MAN_HEROIC", "25H"},
+	{"HEROIC", "H"},
+	{"MYTHIC", "M"},
+}
+
+// Where a difficulty goes in raidDifficulties, unknown ones go last.
+func raidDifficultyRank(difficulty string) int {
+	for i, d := range raidDifficulties {
+		if d.Type == difficulty {
+			return i
+		}
+	}
+	return len(raidDifficulties)
+}
+
+func raidDifficultyShort(difficulty string) string {
+	if i := raidDifficultyRank(difficulty); i < len(raidDifficulties) {
+		return raidDifficulties[i].Short
+	}
+	return difficulty
+}
+
+// Get the progress on each difficulty of each raid and the bosses killed from a raid encounters document.
+func ParseRaidEncounters(myJson string) ([]RaidProgress, []RaidKill) {
+	var progress []RaidProgress
+	var kills []RaidKill
+
+	for _, e := range gjson.Get(myJson, "expansions").Array() {
+		for _, i := range e.Get("instances").Array() {
+			for _, m := range i.Get("modes").Array() {
+				p := RaidProgress{
+					ExpansionID:   e.Get("expansion.id").Int(),
+					ExpansionName: e.Get("expansion.name").String(),
+					InstanceID:    i.Get("instance.id").Int(),
+					InstanceName:  i.Get("instance.name").String(),
+					Difficulty:    m.Get("difficulty.type").String(),
+					Completed:     m.Get("progress.completed_count").Int(),
+					Total:         m.Get("progress.total_count").Int(),
+				}
+				progress = append(progress, p)
+
+				for _, k := range m.Get("progress.encounters").Array() {
+					last := time.Unix(0, k.Get("last_kill_timestamp").Int()*int64(time.Millisecond)).UTC()
+					kills = append(kills, RaidKill{
+						InstanceID:    p.InstanceID,
+						Difficulty:    p.Difficulty,
+						EncounterID:   k.Get("encounter.id").Int(),
+						EncounterName: k.Get("encounter.name").String(),
+						Kills:         k.Get("completed_count").Int(),
+						FirstKill:     last,
+						LastKill:      last,
+					})
+				}
+			}
+		}
+	}
+	return progress, kills
+}
+
+// Fetch and save a toon's raid progress and boss kills for today. Toons that have never raided might not have the
+// document, that's not a failure.
+func insertRaidEncounters(ctx context.Context, t Toon, env *Env, blizzard Blizzard) {
+	myJson, err := blizzard.GetRaidEncounters(ctx, t)
+	if err == ErrNotFound {
+		return
+	}
+	if err != nil {
+		reportToonFailure(t, "raids", err)
+		return
+	}
+
+	progress, kills := ParseRaidEncounters(myJson)
+	for i := range progress {
+		progress[i].ToonID = t.ID
+	}
+	for i := range kills {
+		kills[i].ToonID = t.ID
+	}
+	err = env.db.SaveRaidEncounters(ctx, t.ID, time.Now(), progress, kills)
+	if err != nil {
+		reportToonFailure(t, "raids", err)
+	}
+}
+
+// Describe the progress through one raid, easiest difficulty first, like "9/9 N, 8/9 H, 3/9 M".
+func raidProgressText(progress []RaidProgress) string {
+	sorted := append([]RaidProgress(nil), progress...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return raidDifficultyRank(sorted[i].Difficulty) < raidDifficultyRank(sorted[j].Difficulty)
+	})
+
+	var parts []string
+	for _, p := range sorted {
+		if p.Completed > 0 {
+			parts = append(parts, fmt.Sprintf("%v/%v %v", p.Completed, p.Total, raidDifficultyShort(p.Difficulty)))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// A raid that's in the report, in the order Blizzard added them.
+type raidInstance struct {
+	ExpansionID   int64
+	ExpansionName string
+	InstanceID    int64
+	InstanceName  string
+}
+
+func raidInstances(progress []RaidProgress) []raidInstance {
+	seen := make(map[int64]bool)
+	var instances []raidInstance
+	for _, p := range progress {
+		if !seen[p.InstanceID] {
+			seen[p.InstanceID] = true
+			instances = append(instances, raidInstance{p.ExpansionID, p.ExpansionName, p.InstanceID, p.InstanceName})
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		if instances[i].ExpansionID != instances[j].ExpansionID {
+			return instances[i].ExpansionID < instances[j].ExpansionID
+		}
+		return instances[i].InstanceID < instances[j].InstanceID
+	})
+	return instances
+}
+
+// Print the raid progression. Without a toon it's a matrix of every toon's progress in the raids of the
+// latest expansion, with one it's the toon's progress in every raid and its boss kills in the latest
+// expansion.
+func PrintRaidProgress(ctx context.Context, env *Env, toonName string, out io.Writer) error {
+	progress, err := env.db.GetRaidProgress(ctx)
+	if err != nil {
+		return err
+	}
+	if toonName != "" {
+		return printToonRaidProgress(ctx, env, toonName, progress, out)
+	}
+
+	instances := raidInstances(progress)
+	if len(instances) == 0 {
+		_, _ = fmt.Fprintln(out, "No raid progress")
+		return nil
+	}
+	var latest []raidInstance
+	for _, i := range instances {
+		if i.ExpansionID == instances[len(instances)-1].ExpansionID {
+			latest = append(latest, i)
+		}
+	}
+
+	toons, err := env.db.GetAllToons(ctx)
+	if err != nil {
+		return err
+	}
+	byToon := make(map[uint]map[int64][]RaidProgress)
+	for _, p := range progress {
+		if byToon[p.ToonID] == nil {
+			byToon[p.ToonID] = make(map[int64][]RaidProgress)
+		}
+		byToon[p.ToonID][p.InstanceID] = append(byToon[p.ToonID][p.InstanceID], p)
+	}
+
+	_, _ = fmt.Fprintf(out, "%v\n\n", latest[0].ExpansionName)
+	w := tabwriter.NewWriter(out, 5, 0, 3, ' ', 0)
+	_, _ = fmt.Fprint(w, "Name\t")
+	for _, i := range latest {
+		_, _ = fmt.Fprintf(w, "%v\t", i.InstanceName)
+	}
+	_, _ = fmt.Fprintln(w)
+	for _, t := range toons {
+		if byToon[t.ID] == nil {
+			continue
+		}
+		_, _ = fmt.Fprintf(w, "%v\t", t.Name)
+		for _, i := range latest {
+			_, _ = fmt.Fprintf(w, "%v\t", raidProgressText(byToon[t.ID][i.InstanceID]))
+		}
+		_, _ = fmt.Fprintln(w)
+	}
+	return w.Flush()
+}
+
+func printToonRaidProgress(ctx context.Context, env *Env, toonName string, all []RaidProgress, out io.Writer) error {
+	toon, err := FindToon(ctx, env, toonName)
+	if err != nil {
+		return err
+	}
+	kills, err := env.db.GetRaidKills(ctx, toon.ID)
+	if err != nil {
+		return err
+	}
+
+	byInstance := make(map[int64][]RaidProgress)
+	var progress []RaidProgress
+	for _, p := range all {
+		if p.ToonID == toon.ID {
+			progress = append(progress, p)
+			byInstance[p.InstanceID] = append(byInstance[p.InstanceID], p)
+		}
+	}
+	instances := raidInstances(progress)
+	if len(instances) == 0 {
+		_, _ = fmt.Fprintf(out, "%v-%v has no raid progress\n", toon.Name, toon.Realm)
+		return nil
+	}
+
+	_, _ = fmt.Fprintf(out, "%v-%v\n\n", toon.Name, toon.Realm)
+	w := tabwriter.NewWriter(out, 5, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "Expansion\tRaid\tProgress\t")
+	for _, i := range instances {
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t\n", i.ExpansionName, i.InstanceName, raidProgressText(byInstance[i.InstanceID]))
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	latest := instances[len(instances)-1].ExpansionID
+	names := make(map[int64]string)
+	order := make(map[int64]int)
+	for n, i := range instances {
+		if i.ExpansionID == latest {
+			names[i.InstanceID] = i.InstanceName
+			order[i.InstanceID] = n
+		}
+	}
+	var latestKills []RaidKill
+	for _, k := range kills {
+		if _, ok := names[k.InstanceID]; ok {
+			latestKills = append(latestKills, k)
+		}
+	}
+	sort.Slice(latestKills, func(i, j int) bool {
+		a, b := latestKills[i], latestKills[j]
+		if a.InstanceID != b.InstanceID {
+			return order[a.InstanceID] < order[b.InstanceID]
+		}
+		if a.Difficulty != b.Difficulty {
+			return raidDifficultyRank(a.Difficulty) < raidDifficultyRank(b.Difficulty)
+		}
+		return a.FirstKill.Before(b.FirstKill)
+	})
+
+	_, _ = fmt.Fprintf(out, "\n%v bosses:\n", instances[len(instances)-1].ExpansionName)
+	w = tabwriter.NewWriter(out, 5, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "Raid\tBoss\tDifficulty\tKills\tFirst Kill\tLast Kill\t")
+	for _, k := range latestKills {
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t\n", names[k.InstanceID], k.EncounterName, raidDifficultyShort(k.Difficulty), k.Kills,
+			k.FirstKill.Local().Format("2006-01-02"), k.LastKill.Local().Format("2006-01-02"))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRaidEncounters(t *testing.T) {
+	jsonText, err := ioutil.ReadFile("test-json-raid-encounters.json")
+	if err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	}
+
+	progress, kills := ParseRaidEncounters(string(jsonText))
+	if len(progress) != 7 || len(kills) != 41 {
+		t.Fatalf("Want 7 raid difficulties and 41 kills, got %v and %v", len(progress), len(kills))
+	}
+	if got := raidProgressText(progress[1:4]); got != "9/9 N, 8/9 H, 3/9 M" {
+		t.Errorf("Battle of Dazar'alor progress incorrect, got %q", got)
+	}
+	jaina := kills[15]
+	if jaina.EncounterName != "Lady Jaina Proudmoore" || jaina.Difficulty != "NORMAL" || jaina.Kills != 5 ||
+		!jaina.FirstKill.Equal(time.Date(2019, 2, 13, 2, 18, 0, 0, time.UTC)) {
+		t.Errorf("Jaina kill incorrect, got %+v", jaina)
+	}
+}
+
+func TestRaidProgress(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeBlizzard(t)
+	defer fake.Close()
+	blizzard := newTestBlizzard(t, fake.Transport())
+	db, env, cleanup := newMigratedEnv(t)
+	defer cleanup()
+
+	toon := insertTestToon(t, db)
+	insertRaidEncounters(ctx, toon, env, blizzard)
+
+	// Tomorrow's fetch only has the latest kill, the first one has to be kept. Saving it twice replaces it.
+	tomorrow := time.Now().AddDate(0, 0, 1)
+	jsonText, _ := ioutil.ReadFile("test-json-raid-encounters.json")
+	progress, kills := ParseRaidEncounters(string(jsonText))
+	for i := range progress {
+		progress[i].ToonID = toon.ID
+	}
+	for i := range kills {
+		kills[i].ToonID = toon.ID
+		if kills[i].EncounterName == "Queen Azshara" {
+			kills[i].Kills++
+			kills[i].LastKill = kills[i].LastKill.AddDate(0, 0, 14)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := db.SaveRaidEncounters(ctx, toon.ID, tomorrow, progress, kills); err != nil {
+			t.Fatalf("SaveRaidEncounters failed: %v", err)
+		}
+	}
+
+	var history []RaidKill
+	if err := db.Find(&history).Error; err != nil || len(history) != 82 {
+		t.Errorf("Want 41 kills for each of 2 days, got %v: %v", len(history), err)
+	}
+	saved, _ := db.GetRaidKills(ctx, toon.ID)
+	if len(saved) != 41 {
+		t.Fatalf("Want 41 kills, got %v", len(saved))
+	}
+	if latest, _ := db.GetRaidProgress(ctx); len(latest) != len(progress) || !latest[0].InsertDate.Equal(truncateToDay(tomorrow)) {
+		t.Errorf("Want only tomorrow's %v raid progress, got %+v", len(progress), latest)
+	}
+	for _, k := range saved {
+		if k.EncounterName == "Queen Azshara" && (k.Kills != 3 || k.LastKill.Sub(k.FirstKill) != 14*24*time.Hour) {
+			t.Errorf("Queen Azshara kill incorrect, got %+v", k)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := PrintRaidProgress(ctx, env, "", &out); err != nil {
+		t.Fatalf("PrintRaidProgress failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "Battle for Azeroth") || strings.Contains(out.String(), "Emerald Nightmare") {
+		t.Errorf("The roster report should only have the latest expansion:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "9/9 N, 8/9 H, 3/9 M") {
+		t.Errorf("The roster report is missing Battle of Dazar'alor:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := PrintRaidProgress(ctx, env, "borvoh", &out); err != nil {
+		t.Fatalf("PrintRaidProgress failed: %v", err)
+	}
+	lines := tableLines(out.String())
+	for _, s := range []string{"Legion The Emerald Nightmare 7/7 N", "Battle for Azeroth The Eternal Palace 8/8 N, 4/8 H",
+		"Battle of Dazar'alor Grong the Revenant M 1 2019-05-09 2019-05-09"} {
+		if !lines[s] {
+			t.Errorf("PrintRaidProgress missing %q:\n%s", s, out.String())
+		}
+	}
+}
+
+func TestRaidHistoryMigration(t *testing.T) {
+	ctx := context.Background()
+	db, _, cleanup := newMigratedEnv(t)
+	defer cleanup()
+	toon := insertTestToon(t, db)
+
+	// Progress from before there was a day for it becomes today's.
+	if _, err := db.MigrateDown(ctx, 1); err != nil {
+		t.Fatalf("MigrateDown failed: %v", err)
+	}
+	err := db.Exec("INSERT INTO raid_progress (toon_id, instance_id, difficulty, completed, total) VALUES (?, 1031, 'NORMAL', 8, 8)", toon.ID).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.MigrateUp(ctx); err != nil {
+		t.Fatalf("MigrateUp failed: %v", err)
+	}
+	progress, _ := db.GetRaidProgress(ctx)
+	if len(progress) != 1 || !progress[0].InsertDate.Equal(truncateToDay(time.Now())) {
+		t.Fatalf("Want the old progress kept as today's, got %+v", progress)
+	}
+
+	// Fetching again today replaces it.
+	today := RaidProgress{ToonID: toon.ID, InstanceID: 1031, Difficulty: "NORMAL", Completed: 8, Total: 8}
+	if err := db.SaveRaidEncounters(ctx, toon.ID, time.Now(), []RaidProgress{today}, nil); err != nil {
+		t.Fatalf("SaveRaidEncounters failed: %v", err)
+	}
+	var count int
+	if err := db.Model(&RaidProgress{}).Count(&count).Error; err != nil || count != 1 {
+		t.Errorf("Today's progress should have been replaced, got %v rows: %v", count, err)
+	}
+
+	yesterday := RaidProgress{ToonID: toon.ID, InstanceID: 1031, Difficulty: "NORMAL", Completed: 7, Total: 8}
+	err = db.SaveRaidEncounters(ctx, toon.ID, time.Now().AddDate(0, 0, -1), []RaidProgress{yesterday}, nil)
+	if err != nil {
+		t.Fatalf("SaveRaidEncounters failed: %v", err)
+	}
+	if _, err := db.MigrateDown(ctx, 1); err != nil {
+		t.Fatalf("MigrateDown failed: %v", err)
+	}
+	var completed []int64
+	if err := db.Table("raid_progress").Pluck("completed", &completed).Error; err != nil || len(completed) != 1 || completed[0] != 8 {
+		t.Errorf("Going back should keep only the latest day, got %v: %v", completed, err)
+	}
+}
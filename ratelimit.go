@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Blizzard's published quotas for a client.
+const (
+	defaultRequestsPerSecond = 100
+	defaultRequestsPerHour   = 36000
+)
+
+// A single token bucket. Tokens come back at rate per second up to burst and each request takes one.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Add the tokens that have come back since the last time the bucket was looked at.
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// How long until the bucket has a token.
+func (b *tokenBucket) untilAvailable() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Rate limiter shared by all the Blizzard clients. A request needs a token from both the per second and the
+// per hour bucket, so a run can go as fast as the per second quota allows but never past the hourly one.
+type RateLimiter struct {
+	buckets []*tokenBucket
+	mutex   sync.Mutex
+}
+
+func NewRateLimiter(perSecond int, perHour int) *RateLimiter {
+	if perSecond <= 0 {
+		perSecond = defaultRequestsPerSecond
+	}
+	if perHour <= 0 {
+		perHour = defaultRequestsPerHour
+	}
+	return &RateLimiter{buckets: []*tokenBucket{
+		newTokenBucket(float64(perSecond), float64(perSecond)),
+		newTokenBucket(float64(perHour)/3600, float64(perHour)),
+	}}
+}
+
+// Block until a request is allowed or ctx is done.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	for {
+		wait := l.reserve()
+		if wait == 0 {
+			return nil
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Take a token from every bucket if they all have one and return 0, otherwise take nothing and return how
+// long to wait before trying again.
+func (l *RateLimiter) reserve() time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for _, b := range l.buckets {
+		b.refill(now)
+		if w := b.untilAvailable(); w > wait {
+			wait = w
+		}
+	}
+
+	if wait > 0 {
+		return wait
+	}
+
+	for _, b := range l.buckets {
+		b.tokens--
+	}
+	return 0
+}
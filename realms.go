@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+// A realm from the Game Data API. RealmID is Blizzard's ID for it and ConnectedRealmID the group of realms it
+// shares guilds and an auction house with. Locale is like enUS and Timezone like America/New_York.
+type Realm struct {
+	ID               int64
+	Region           string
+	RealmID          int64
+	Slug             string
+	Name             string
+	Locale           string
+	Timezone         string
+	ConnectedRealmID int64
+}
+
+// Returned when a realm can't be matched to one in the realms table.
+var ErrUnknownRealm = errors.New("unknown realm")
+
+// The realm name to keep for a slug when the realm's name isn't known or doesn't lead back to the slug: the
+// words title cased, so argent-dawn is Argent Dawn.
+func realmName(slug string) string {
+	return strings.Title(strings.ReplaceAll(slug, "-", " "))
+}
+
+// The name to keep for a realm in toons and guilds. It's the realm's name unless that doesn't give its slug,
+// like a realm named in Cyrillic.
+func (r *Realm) storedName() string {
+	if realmSlug(r.Name) == r.Slug {
+		return r.Name
+	}
+	return realmName(r.Slug)
+}
+
+// A slug with the hyphens taken out, so that argent-dawn, Argent Dawn and argentdawn all match.
+func compactSlug(slug string) string {
+	return strings.ReplaceAll(realmSlug(slug), "-", "")
+}
+
+// Find the realm that input means. The slug or name has to match, case, accents, apostrophes and spaces
+// aside, or else the input has to be the start of just one realm or at most a typo or two away from just one.
+func matchRealm(realms []Realm, input string, region string) (*Realm, error) {
+	want := compactSlug(input)
+	if want == "" {
+		return nil, fmt.Errorf("%w %q in %v", ErrUnknownRealm, input, region)
+	}
+	for i, r := range realms {
+		if compactSlug(r.Slug) == want || compactSlug(r.Name) == want {
+			return &realms[i], nil
+		}
+	}
+
+	var prefixed []Realm
+	for _, r := range realms {
+		if strings.HasPrefix(compactSlug(r.Slug), want) {
+			prefixed = append(prefixed, r)
+		}
+	}
+	if len(prefixed) == 1 && len(want) >= 3 {
+		return &prefixed[0], nil
+	}
+
+	best := 1 + len(want)/5
+	var closest []Realm
+	for _, r := range realms {
+		d := editDistance(want, compactSlug(r.Slug))
+		if d < best {
+			best, closest = d, nil
+		}
+		if d == best {
+			closest = append(closest, r)
+		}
+	}
+	if len(closest) == 1 {
+		return &closest[0], nil
+	}
+
+	suggestions := append(prefixed, closest...)
+	if len(suggestions) == 0 {
+		return nil, fmt.Errorf("%w %q in %v", ErrUnknownRealm, input, region)
+	}
+	var names []string
+	for _, r := range suggestions {
+		if len(names) < 5 {
+			names = append(names, r.Name)
+		}
+	}
+	return nil, fmt.Errorf("%w %q in %v, did you mean %v", ErrUnknownRealm, input, region, strings.Join(names, ", "))
+}
+
+// Levenshtein distance between two strings.
+func editDistance(a string, b string) int {
+	x, y := []rune(a), []rune(b)
+	previous := make([]int, len(y)+1)
+	current := make([]int, len(y)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(x); i++ {
+		current[0] = i
+		for j := 1; j <= len(y); j++ {
+			cost := 1
+			if x[i-1] == y[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(y)]
+}
+
+func min3(a int, b int, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// Fetch a region's realms from Blizzard and replace the ones in the realms table with them.
+func UpdateRealmsFromBlizzard(ctx context.Context, env *Env, blizzard Blizzard, region string) error {
+	realms, err := blizzard.GetRealms(ctx, region)
+	if err != nil {
+		return err
+	}
+	return env.db.SaveRealms(ctx, region, realms)
+}
+
+// Work out the realm for what was typed when adding a toon or guild. The region's realms are fetched the
+// first time they're needed. When they can't be, like when running offline, the realm can't be checked and
+// nil is returned without an error.
+func resolveRealm(ctx context.Context, env *Env, blizzard Blizzard, input string, region string) (*Realm, error) {
+	realms, err := env.db.GetRealms(ctx, region)
+	if err != nil {
+		return nil, err
+	}
+	if len(realms) == 0 {
+		err = UpdateRealmsFromBlizzard(ctx, env, blizzard, region)
+		if err != nil {
+			log.WithFields(log.Fields{"region": region}).Warnf("Could not get realms, %q can't be checked: %v", input, err)
+			return nil, nil
+		}
+		realms, err = env.db.GetRealms(ctx, region)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return matchRealm(realms, input, region)
+}
+
+// The realm to keep in place of a stored one that doesn't lead back to its realm's slug, or "" when the stored
+// one is fine or isn't a realm that's known. Guild members used to be kept as their title cased slug, which
+// made Argent Dawn Argent-Dawn and realmSlug turns that into argentdawn. Realms that really have a hyphen,
+// like Azjol-Nerub, don't have one in their slug so they're left alone.
+func normalRealm(realms []Realm, stored string) string {
+	bySlug := make(map[string]*Realm)
+	for i := range realms {
+		bySlug[realms[i].Slug] = &realms[i]
+	}
+	if _, ok := bySlug[realmSlug(stored)]; ok {
+		return ""
+	}
+	if r, ok := bySlug[strings.ToLower(stored)]; ok {
+		return r.storedName()
+	}
+	return ""
+}
+
+// Put right the realms of the toons, guilds and members in the regions that were kept as a title cased slug.
+// It's run by --update once the realms are fresh, a region with no realms is skipped since there's no telling
+// Argent-Dawn from Azjol-Nerub without them. A guild tracked under both names is left for the user to remove.
+func NormalizeRealms(ctx context.Context, env *Env, regions []string) error {
+	guilds, err := env.db.GetGuilds(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, region := range regions {
+		realms, err := env.db.GetRealms(ctx, region)
+		if err != nil {
+			return err
+		}
+		if len(realms) == 0 {
+			continue
+		}
+		stored, err := env.db.GetStoredRealms(ctx, region)
+		if err != nil {
+			return err
+		}
+		for _, name := range stored {
+			normal := normalRealm(realms, name)
+			if normal == "" {
+				continue
+			}
+			for _, g := range guilds {
+				if strings.EqualFold(g.Region, region) && g.Realm == name && trackedGuild(guilds, g.Name, normal, region) {
+					log.WithFields(log.Fields{"guild": g.Name, "region": region}).Warnf("Guild is tracked on both %v and %v, leaving it on %v", name, normal, name)
+				}
+			}
+			log.WithFields(log.Fields{"region": region}).Infof("Renaming realm %v to %v", name, normal)
+			err = env.db.RenameRealm(ctx, region, name, normal)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func trackedGuild(guilds []Guild, name string, realm string, region string) bool {
+	for _, g := range guilds {
+		if g.Name == name && g.Realm == realm && strings.EqualFold(g.Region, region) {
+			return true
+		}
+	}
+	return false
+}
+
+// The regions whose realms --update refreshes: the configured one and any a toon or guild is in.
+func realmRegions(ctx context.Context, env *Env) ([]string, error) {
+	regions := []string{strings.ToLower(env.config.Region)}
+	seen := map[string]bool{regions[0]: true}
+	add := func(region string) {
+		region = strings.ToLower(region)
+		if !seen[region] {
+			seen[region] = true
+			regions = append(regions, region)
+		}
+	}
+
+	toons, err := env.db.GetAllToons(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range toons {
+		add(t.Region)
+	}
+	guilds, err := env.db.GetGuilds(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range guilds {
+		add(g.Region)
+	}
+	return regions, nil
+}
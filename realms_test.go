@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRealmSlug(t *testing.T) {
+	slugs := map[string]string{
+		"Duskwood":             "duskwood",
+		"Argent Dawn":          "argent-dawn",
+		" area  52 ":           "area-52",
+		"Kael'thas":            "kaelthas",
+		"Kael'Thas":            "kaelthas",
+		"Azjol-Nerub":          "azjolnerub",
+		"Aggra (Português)":    "aggra-portugues",
+		"Confrérie du Thorium": "confrerie-du-thorium",
+	}
+	for name, want := range slugs {
+		if got := realmSlug(name); got != want {
+			t.Errorf("realmSlug(%q) incorrect, want %q got %q", name, want, got)
+		}
+	}
+}
+
+var testRealms = []Realm{
+	{Slug: "argent-dawn", Name: "Argent Dawn"},
+	{Slug: "azjolnerub", Name: "Azjol-Nerub"},
+	{Slug: "dragonblight", Name: "Dragonblight"},
+	{Slug: "dragonmaw", Name: "Dragonmaw"},
+	{Slug: "duskwood", Name: "Duskwood"},
+	{Slug: "gordunni", Name: "Гордунни"},
+	{Slug: "kaelthas", Name: "Kael'thas"},
+	{Slug: "the-scryers", Name: "The Scryers"},
+}
+
+func TestMatchRealm(t *testing.T) {
+	matches := map[string]string{
+		"argent dawn": "Argent Dawn",
+		"ARGENT-DAWN": "Argent Dawn",
+		"argentdawn":  "Argent Dawn",
+		"Kael'Thas":   "Kael'thas",
+		"kaelthas":    "Kael'thas",
+		"azjol nerub": "Azjol-Nerub",
+		"Duskwod":     "Duskwood",
+		"the scry":    "The Scryers",
+		"Gordunni":    "Гордунни",
+		"Гордунни":    "Гордунни",
+	}
+	for input, want := range matches {
+		realm, err := matchRealm(testRealms, input, "us")
+		if err != nil {
+			t.Errorf("matchRealm(%q) failed: %v", input, err)
+			continue
+		}
+		if realm.Name != want {
+			t.Errorf("matchRealm(%q) incorrect, want %v got %v", input, want, realm.Name)
+		}
+	}
+
+	_, err := matchRealm(testRealms, "dragon", "us")
+	if !errors.Is(err, ErrUnknownRealm) || !strings.HasSuffix(err.Error(), "did you mean Dragonblight, Dragonmaw") {
+		t.Errorf("An ambiguous realm should fail with suggestions, got %v", err)
+	}
+	for _, input := range []string{"Stormrage", ""} {
+		_, err = matchRealm(testRealms, input, "us")
+		if !errors.Is(err, ErrUnknownRealm) || exitCode(err) != exitUsage {
+			t.Errorf("matchRealm(%q) should fail as unknown, got %v", input, err)
+		}
+	}
+}
+
+func TestRealmStoredName(t *testing.T) {
+	for _, r := range testRealms {
+		want := r.Name
+		if r.Slug == "gordunni" {
+			want = "Gordunni"
+		}
+		if got := r.storedName(); got != want || realmSlug(got) != r.Slug {
+			t.Errorf("storedName for %v incorrect, want %q got %q", r.Slug, want, got)
+		}
+	}
+}
+
+func TestGetRealms(t *testing.T) {
+	fake := newFakeBlizzard(t)
+	defer fake.Close()
+	blizzard := newTestBlizzard(t, fake.Transport())
+
+	realms, err := blizzard.GetRealms(context.Background(), "us")
+	if err != nil {
+		t.Fatalf("GetRealms failed: %v", err)
+	}
+	if len(realms) != 9 {
+		t.Fatalf("Want 9 realms, got %v", len(realms))
+	}
+	want := Realm{Region: "us", RealmID: 1138, Slug: "kaelthas", Name: "Kael'thas", Locale: "enUS", Timezone: "America/Chicago", ConnectedRealmID: 1138}
+	found := false
+	for _, r := range realms {
+		if r.Slug == want.Slug {
+			found = true
+			if r != want {
+				t.Errorf("Kael'thas incorrect, want %+v got %+v", want, r)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("GetRealms did not return Kael'thas, got %+v", realms)
+	}
+
+	// A single region's client only knows its own realms.
+	client, err := blizzard.Client(context.Background(), "us")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.GetRealms(context.Background(), "eu"); err == nil {
+		t.Errorf("The us client should not get the eu realms")
+	}
+}
+
+func TestAddResolvesRealm(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeBlizzard(t)
+	defer fake.Close()
+	blizzard := newTestBlizzard(t, fake.Transport())
+	db, env, cleanup := newMigratedEnv(t)
+	defer cleanup()
+	env.config = Config{Region: "us"}
+
+	var out bytes.Buffer
+	err := AddToon(ctx, env, blizzard, strings.NewReader("borvoh\nnowhere\nus\ny\n"), &out)
+	if !errors.Is(err, ErrUnknownRealm) {
+		t.Errorf("Adding on an unknown realm should fail, got %v", err)
+	}
+
+	// The realms were fetched for the failed add. Drop one so that fetching them again would show.
+	realms, err := db.GetRealms(ctx, "us")
+	if err != nil || len(realms) != 9 {
+		t.Fatalf("Want the 9 realms saved, got %v: %v", len(realms), err)
+	}
+	err = db.SaveRealms(ctx, "us", realms[:8])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = AddToon(ctx, env, blizzard, strings.NewReader("borvoh\nduskwod\nus\ny\n"), &out)
+	if err != nil {
+		t.Fatalf("AddToon failed: %v", err)
+	}
+	toons, _ := db.GetAllToons(ctx)
+	if len(toons) != 1 || toons[0].Realm != "Duskwood" {
+		t.Errorf("Want Borvoh added on Duskwood, got %+v", toons)
+	}
+	if realms, _ = db.GetRealms(ctx, "us"); len(realms) != 8 {
+		t.Errorf("The realms should not have been fetched again, got %v", len(realms))
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gopkg.in/resty.v1"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Blizzard API region. Each region has its own OAuth endpoint and API host and a token from one region
+// can't be used in another.
+type Region struct {
+	Name     string
+	OAuthUrl string
+	ApiHost  string
+}
+
+// The regions Blizzard runs. China is completely separate from the rest, with its own hosts and its own
+// developer accounts.
+var regions = map[string]Region{
+	"us": {Name: "us", OAuthUrl: "https://us.battle.net/oauth/token", ApiHost: "us.api.blizzard.com"},
+	"eu": {Name: "eu", OAuthUrl: "https://eu.battle.net/oauth/token", ApiHost: "eu.api.blizzard.com"},
+	"kr": {Name: "kr", OAuthUrl: "https://kr.battle.net/oauth/token", ApiHost: "kr.api.blizzard.com"},
+	"tw": {Name: "tw", OAuthUrl: "https://tw.battle.net/oauth/token", ApiHost: "tw.api.blizzard.com"},
+	"cn": {Name: "cn", OAuthUrl: "https://www.battlenet.com.cn/oauth/token", ApiHost: "gateway.battlenet.com.cn"},
+}
+
+const defaultRegion = "us"
+
+// Returned by GetRegion for a name that isn't one of the regions.
+var ErrUnknownRegion = errors.New("unknown region")
+
+// Look up a region by name, case doesn't matter.
+func GetRegion(name string) (Region, error) {
+	region, ok := regions[strings.ToLower(name)]
+	if !ok {
+		return Region{}, fmt.Errorf("%w %q, allowed values are %s", ErrUnknownRegion, name, strings.Join(RegionNames(), ", "))
+	}
+	return region, nil
+}
+
+// Names of all the regions, sorted.
+func RegionNames() []string {
+	var names []string
+	for name := range regions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Credentials for a region that doesn't use the main clientId and clientSecret, China for instance.
+type RegionConfig struct {
+	ClientId     string
+	ClientSecret string
+}
+
+// Registry of one BlizzardHttp per region. It implements Blizzard by sending each toon to the client for
+// the toon's region. The class and race lists are the same everywhere so those come from the default region.
+// Clients other than the default are created the first time a toon from that region shows up.
+type BlizzardRegions struct {
+	DefaultRegion string
+	ClientId      string
+	ClientSecret  string
+	Locale        string
+	Credentials   map[string]RegionConfig
+	Limiter       *RateLimiter
+	Cache         *ResponseCache
+	Offline       bool
+	Transport     http.RoundTripper
+	clients       map[string]*BlizzardHttp
+	clientsMutex  sync.Mutex
+}
+
+var _ Blizzard = (*BlizzardRegions)(nil)
+
+// Create the registry. The Limiter, Cache, Offline and Transport fields can be set before Connect is called,
+// all the clients share them.
+func NewBlizzardRegions(defaultRegion string, clientId string, clientSecret string, locale string, credentials map[string]RegionConfig) *BlizzardRegions {
+	return &BlizzardRegions{
+		DefaultRegion: strings.ToLower(defaultRegion),
+		ClientId:      clientId,
+		ClientSecret:  clientSecret,
+		Locale:        locale,
+		Credentials:   credentials,
+		clients:       make(map[string]*BlizzardHttp),
+	}
+}
+
+// Create the client for the default region. This gets a token, so bad credentials show up here rather than
+// on the first toon. When offline no tokens are fetched and everything comes from the cache.
+func (r *BlizzardRegions) Connect(ctx context.Context) error {
+	_, err := r.Client(ctx, r.DefaultRegion)
+	return err
+}
+
+// Get the client for a region, creating it if this is the first time the region has been used.
+func (r *BlizzardRegions) Client(ctx context.Context, name string) (*BlizzardHttp, error) {
+	region, err := GetRegion(name)
+	if err != nil {
+		return nil, err
+	}
+
+	r.clientsMutex.Lock()
+	defer r.clientsMutex.Unlock()
+
+	if client, ok := r.clients[region.Name]; ok {
+		return client, nil
+	}
+
+	clientId, clientSecret := r.ClientId, r.ClientSecret
+	if c, ok := r.Credentials[region.Name]; ok {
+		clientId, clientSecret = c.ClientId, c.ClientSecret
+	}
+
+	var httpClient *resty.Client
+	if r.Transport != nil {
+		httpClient = resty.New().SetTransport(r.Transport)
+	}
+
+	var client *BlizzardHttp
+	if r.Offline {
+		client = &BlizzardHttp{Region: region, ClientId: clientId, ClientSecret: clientSecret, Locale: r.Locale, Offline: true}
+	} else {
+		client, err = NewBlizzard(ctx, region, clientId, clientSecret, r.Locale, httpClient)
+		if err != nil {
+			return nil, fmt.Errorf("region %s: %v", region.Name, err)
+		}
+	}
+	client.Limiter = r.Limiter
+	client.Cache = r.Cache
+	r.clients[region.Name] = client
+	return client, nil
+}
+
+func (r *BlizzardRegions) GetToonJson(ctx context.Context, toon Toon) (string, error) {
+	client, err := r.Client(ctx, toon.Region)
+	if err != nil {
+		return "", err
+	}
+	return client.GetToonJson(ctx, toon)
+}
+
+func (r *BlizzardRegions) GetToon(ctx context.Context, toon *ToonDto) error {
+	client, err := r.Client(ctx, toon.Region)
+	if err != nil {
+		return err
+	}
+	return client.GetToon(ctx, toon)
+}
+
+func (r *BlizzardRegions) GetClasses(ctx context.Context) ([]ToonClass, error) {
+	client, err := r.Client(ctx, r.DefaultRegion)
+	if err != nil {
+		return nil, err
+	}
+	return client.GetClasses(ctx)
+}
+
+func (r *BlizzardRegions) GetRaces(ctx context.Context) ([]Race, error) {
+	client, err := r.Client(ctx, r.DefaultRegion)
+	if err != nil {
+		return nil, err
+	}
+	return client.GetRaces(ctx)
+}
+
+func (r *BlizzardRegions) GetAchievements(ctx context.Context, toon Toon) (string, error) {
+	client, err := r.Client(ctx, toon.Region)
+	if err != nil {
+		return "", err
+	}
+	return client.GetAchievements(ctx, toon)
+}
+
+func (r *BlizzardRegions) GetAchievementDefinitions(ctx context.Context) ([]AchievementDefinition, error) {
+	client, err := r.Client(ctx, r.DefaultRegion)
+	if err != nil {
+		return nil, err
+	}
+	return client.GetAchievementDefinitions(ctx)
+}
+
+func (r *BlizzardRegions) GetMythicKeystoneProfile(ctx context.Context, toon Toon) (string, error) {
+	client, err := r.Client(ctx, toon.Region)
+	if err != nil {
+		return "", err
+	}
+	return client.GetMythicKeystoneProfile(ctx, toon)
+}
+
+func (r *BlizzardRegions) GetRaidEncounters(ctx context.Context, toon Toon) (string, error) {
+	client, err := r.Client(ctx, toon.Region)
+	if err != nil {
+		return "", err
+	}
+	return client.GetRaidEncounters(ctx, toon)
+}
+
+func (r *BlizzardRegions) GetMount(ctx context.Context, id int64) (string, error) {
+	client, err := r.Client(ctx, r.DefaultRegion)
+	if err != nil {
+		return "", err
+	}
+	return client.GetMount(ctx, id)
+}
+
+func (r *BlizzardRegions) GetGuildRoster(ctx context.Context, guild Guild) (string, error) {
+	client, err := r.Client(ctx, guild.Region)
+	if err != nil {
+		return "", err
+	}
+	return client.GetGuildRoster(ctx, guild)
+}
+
+func (r *BlizzardRegions) GetRealms(ctx context.Context, region string) ([]Realm, error) {
+	client, err := r.Client(ctx, region)
+	if err != nil {
+		return nil, err
+	}
+	return client.GetRealms(ctx, region)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// A toon's standing with a faction on a day. Tier counts up from Hated at 0 to Exalted at 7, Value and Max
+// are the progress through the current standing and Raw is the total. Factions with renown have a
+// RenownLevel instead of tiers, and Paragon is the progress to the next paragon cache once Exalted.
+type ReputationValue struct {
+	ID           int64
+	ToonID       uint
+	InsertDate   time.Time `gorm:"type:date"`
+	FactionID    int64
+	FactionName  string
+	Tier         int64
+	StandingName string
+	Raw          int64
+	Value        int64
+	Max          int64
+	RenownLevel  int64
+	ParagonRaw   int64
+	ParagonValue int64
+	ParagonMax   int64
+}
+
+// Keep InsertDate to just the day, for the same reason as Stat.
+func (r *ReputationValue) BeforeSave() error {
+	r.InsertDate = truncateToDay(r.InsertDate)
+	return nil
+}
+
+// The progress toward whatever is next, the next standing or the next paragon cache, and what that is.
+// Friendships have their own standings, so the next one isn't known and is left blank. Done is true when
+// there's nothing left to go up to.
+func (r *ReputationValue) progress() (value int64, max int64, next string, done bool) {
+	switch {
+	case r.ParagonMax > 0:
+		return r.ParagonValue, r.ParagonMax, "Paragon", false
+	case r.Max > 0 && r.RenownLevel > 0:
+		return r.Value, r.Max, fmt.Sprintf("Renown %d", r.RenownLevel+1), false
+	case r.Max > 0 && !r.standardTier():
+		return r.Value, r.Max, "", false
+	case r.Max > 0 && int(r.Tier+1) < len(reputationTiers):
+		return r.Value, r.Max, reputationTiers[r.Tier+1], false
+	}
+	return 0, 0, "", true
+}
+
+// Whether the standing is one of reputationTiers rather than a friendship's.
+func (r *ReputationValue) standardTier() bool {
+	return r.Tier >= 0 && int(r.Tier) < len(reputationTiers) && r.StandingName == reputationTiers[r.Tier]
+}
+
+// Everything the faction has given, including paragon, for working out the rate of gain.
+func (r *ReputationValue) total() int64 {
+	return r.Raw + r.ParagonRaw
+}
+
+var reputationTiers = []string{"Hated", "Hostile", "Unfriendly", "Neutral", "Friendly", "Honored", "Revered", "Exalted"}
+
+// How far through a standing a faction has to be to count as approaching the next one.
+const reputationNearFraction = 0.75
+
+// Get the reputations from the Profile API reputations document. The old Community API document doesn't
+// have them.
+func ParseReputations(myJson string) []ReputationValue {
+	var reputations []ReputationValue
+	gjson.Get(myJson, "reputations.reputations").ForEach(func(_, r gjson.Result) bool {
+		reputations = append(reputations, ReputationValue{
+			FactionID:    r.Get("faction.id").Int(),
+			FactionName:  r.Get("faction.name").String(),
+			Tier:         r.Get("standing.tier").Int(),
+			StandingName: r.Get("standing.name").String(),
+			Raw:          r.Get("standing.raw").Int(),
+			Value:        r.Get("standing.value").Int(),
+			Max:          r.Get("standing.max").Int(),
+			RenownLevel:  r.Get("standing.renown_level").Int(),
+			ParagonRaw:   r.Get("paragon.raw").Int(),
+			ParagonValue: r.Get("paragon.value").Int(),
+			ParagonMax:   r.Get("paragon.max").Int(),
+		})
+		return true
+	})
+	return reputations
+}
+
+// Save the reputations in the document for a toon on a day.
+func saveReputations(ctx context.Context, env *Env, toonId uint, day time.Time, myJson string) error {
+	reputations := ParseReputations(myJson)
+	if len(reputations) == 0 {
+		return nil
+	}
+	for i := range reputations {
+		reputations[i].ToonID = toonId
+		reputations[i].InsertDate = day
+	}
+	return env.db.SaveReputations(ctx, toonId, day, reputations)
+}
+
+// A faction's latest standing and how fast it has been going up.
+type ReputationProgress struct {
+	Latest     ReputationValue
+	Gained     int64
+	Days       int
+	PerDay     float64
+	DaysToNext float64
+}
+
+// Whether the faction is far enough through its standing to be approaching the next one.
+func (p *ReputationProgress) Near() bool {
+	value, max, _, done := p.Latest.progress()
+	return !done && float64(value) >= reputationNearFraction*float64(max)
+}
+
+// Work out each faction's progress from a toon's history, which has to be ordered by faction and date. The
+// rate is from the first day in the history to the last one for the faction.
+func reputationProgress(history []ReputationValue) []ReputationProgress {
+	var progress []ReputationProgress
+	for start := 0; start < len(history); {
+		end := start
+		for end < len(history) && history[end].FactionID == history[start].FactionID {
+			end++
+		}
+
+		first, last := history[start], history[end-1]
+		p := ReputationProgress{Latest: last, Gained: last.total() - first.total()}
+		p.Days = int(truncateToDay(last.InsertDate).Sub(truncateToDay(first.InsertDate)).Hours() / 24)
+		if p.Days > 0 {
+			p.PerDay = float64(p.Gained) / float64(p.Days)
+		}
+		if value, max, _, done := last.progress(); !done && p.PerDay > 0 {
+			p.DaysToNext = float64(max-value) / p.PerDay
+		}
+		progress = append(progress, p)
+		start = end
+	}
+	return progress
+}
+
+// Print the factions that are approaching their next standing and the ones that have gone up in the last
+// days days, for one toon.
+func PrintReputations(ctx context.Context, env *Env, toonName string, days int, out io.Writer) error {
+	toon, err := FindToon(ctx, env, toonName)
+	if err != nil {
+		return err
+	}
+	history, err := env.db.GetReputationHistory(ctx, toon.ID, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		return err
+	}
+	progress := reputationProgress(history)
+
+	var near, gaining []ReputationProgress
+	for _, p := range progress {
+		if p.Near() {
+			near = append(near, p)
+		}
+		if p.Gained > 0 {
+			gaining = append(gaining, p)
+		}
+	}
+	sort.Slice(near, func(i, j int) bool {
+		vi, mi, _, _ := near[i].Latest.progress()
+		vj, mj, _, _ := near[j].Latest.progress()
+		return float64(vi)/float64(mi) > float64(vj)/float64(mj)
+	})
+	sort.Slice(gaining, func(i, j int) bool {
+		return gaining[i].PerDay > gaining[j].PerDay
+	})
+
+	_, _ = fmt.Fprintf(out, "%v-%v\n\nApproaching the next standing:\n", toon.Name, toon.Realm)
+	err = printReputationTable(out, near)
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(out, "\nGained in the last %v days:\n", days)
+	return printReputationTable(out, gaining)
+}
+
+func printReputationTable(out io.Writer, progress []ReputationProgress) error {
+	w := tabwriter.NewWriter(out, 5, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "Faction\tStanding\tProgress\tNext\tGained\tPer Day\tDays to Next\t")
+	for _, p := range progress {
+		value, max, next, _ := p.Latest.progress()
+		perDay, daysToNext := "", ""
+		if p.PerDay > 0 {
+			perDay = fmt.Sprintf("%.0f", p.PerDay)
+		}
+		if p.DaysToNext > 0 {
+			daysToNext = fmt.Sprintf("%.1f", p.DaysToNext)
+		}
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v/%v\t%v\t%v\t%v\t%v\t\n", p.Latest.FactionName, p.Latest.StandingName, value, max, next, p.Gained, perDay, daysToNext)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseReputations(t *testing.T) {
+	profile, err := ioutil.ReadFile("test-json-profile.json")
+	if err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	}
+
+	reputations := ParseReputations(string(profile))
+	if len(reputations) != 6 {
+		t.Fatalf("Want 6 reputations, got %v", len(reputations))
+	}
+	admiralty := ReputationValue{FactionID: 2160, FactionName: "Proudmoore Admiralty", Tier: 7, StandingName: "Exalted", Raw: 42999,
+		ParagonRaw: 62450, ParagonValue: 2450, ParagonMax: 10000}
+	if reputations[0] != admiralty {
+		t.Errorf("Reputation incorrect, got %+v want %+v", reputations[0], admiralty)
+	}
+
+	renown := ParseReputations(`{"reputations": {"reputations": [{"faction": {"id": 2407, "name": "The Ascended"},
+		"standing": {"raw": 2500, "value": 1000, "max": 2500, "renown_level": 5, "tier": 0, "name": "Renown 5"}}]}}`)
+	if _, _, next, _ := renown[0].progress(); next != "Renown 6" {
+		t.Errorf("Renown faction should be going to Renown 6, got %v", next)
+	}
+
+	// A friendship's tier isn't one of the usual standings, there's still progress but no name for what's next.
+	friendship := ParseReputations(`{"reputations": {"reputations": [{"faction": {"id": 2135, "name": "Chromie"},
+		"standing": {"raw": 9500, "value": 1000, "max": 1500, "tier": 3, "name": "Whelpling"}}]}}`)
+	if value, max, next, done := friendship[0].progress(); value != 1000 || max != 1500 || next != "" || done {
+		t.Errorf("Friendship progress incorrect, got %v/%v %q %v", value, max, next, done)
+	}
+}
+
+func TestReputationProgress(t *testing.T) {
+	ctx := context.Background()
+	db, env, cleanup := newMigratedEnv(t)
+	defer cleanup()
+
+	toon := insertTestToon(t, db)
+
+	profile, _ := ioutil.ReadFile("test-json-profile.json")
+	earlier := strings.NewReplacer(`"raw": 40210,`, `"raw": 39210,`, `"value": 19210,`, `"value": 18210,`).Replace(string(profile))
+	today := truncateToDay(time.Now())
+	days := []time.Time{today.AddDate(0, 0, -4), today}
+	for i, doc := range []string{earlier, string(profile)} {
+		if err := saveReputations(ctx, env, toon.ID, days[i], doc); err != nil {
+			t.Fatalf("saveReputations failed: %v", err)
+		}
+	}
+	// Saving a day again replaces it rather than adding to it.
+	if err := saveReputations(ctx, env, toon.ID, today, string(profile)); err != nil {
+		t.Fatalf("saveReputations failed: %v", err)
+	}
+
+	history, _ := db.GetReputationHistory(ctx, toon.ID, today.AddDate(0, 0, -30))
+	if len(history) != 12 {
+		t.Fatalf("Want 12 reputation values, got %v", len(history))
+	}
+	for _, p := range reputationProgress(history) {
+		if p.Latest.FactionID == 2161 && (p.Gained != 1000 || p.PerDay != 250 || p.DaysToNext < 7.15 || p.DaysToNext > 7.17 || !p.Near()) {
+			t.Errorf("Order of Embers progress incorrect, got %+v", p)
+		}
+		if p.Latest.FactionID == 72 && (p.Near() || p.Gained != 0) {
+			t.Errorf("Stormwind progress incorrect, got %+v", p)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := PrintReputations(ctx, env, "borvoh", 7, &out); err != nil {
+		t.Fatalf("PrintReputations failed: %v", err)
+	}
+	near := out.String()[:strings.Index(out.String(), "Gained in the last 7 days")]
+	if !strings.Contains(near, "Order of Embers") || !strings.Contains(near, "19210/21000") || strings.Contains(near, "Stormwind") {
+		t.Errorf("PrintReputations incorrect:\n%s", out.String())
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Something that is saved from each day's character document besides the Stat row. Stage names it in errors
+// and in the log.
+type snapshotRecorder struct {
+	stage  string
+	record func(ctx context.Context, env *Env, toonId uint, day time.Time, myJson string) error
+}
+
+var snapshotRecorders = []snapshotRecorder{
+	{"metrics", saveMetricValues},
+	{"statistics", saveStatistics},
+	{"equipment", saveEquipment},
+	{"mounts", saveMounts},
+	{"pets", savePets},
+	{"reputations", saveReputations},
+	{"pvp", savePvp},
+	{"professions", saveProfessions},
+}
+
+// A recorder that failed.
+type SnapshotError struct {
+	Stage string
+	Err   error
+}
+
+func (e *SnapshotError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Stage, e.Err)
+}
+
+// Run every recorder on a toon's document for a day. They all get a chance even if one fails, the errors
+// are returned.
+func recordSnapshot(ctx context.Context, env *Env, toonId uint, day time.Time, myJson string) []*SnapshotError {
+	var errors []*SnapshotError
+	for _, r := range snapshotRecorders {
+		err := r.record(ctx, env, toonId, day, myJson)
+		if err != nil {
+			errors = append(errors, &SnapshotError{Stage: r.stage, Err: err})
+		}
+	}
+	return errors
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// An achievement statistic. ID is Blizzard's and CategoryPath is where it is in the tree, like
+// "Dungeons & Raids/Battle for Azeroth".
+type StatisticDefinition struct {
+	ID           int64 `gorm:"primary_key;auto_increment:false"`
+	Name         string
+	CategoryPath string
+}
+
+// Value of a statistic for a toon on a day.
+type StatisticValue struct {
+	ID          int64
+	ToonID      uint
+	InsertDate  time.Time `gorm:"type:date"`
+	StatisticID int64
+	Quantity    float64
+}
+
+// Keep InsertDate to just the day, for the same reason as Stat.
+func (v *StatisticValue) BeforeSave() error {
+	v.InsertDate = truncateToDay(v.InsertDate)
+	return nil
+}
+
+// Get every statistic in a document along with its definition. Handles the Profile API document and the old
+// Community API one.
+func ParseStatistics(myJson string) ([]StatisticDefinition, []float64) {
+	var definitions []StatisticDefinition
+	var quantities []float64
+
+	var walk func(categories gjson.Result, path string, subKey string)
+	walk = func(categories gjson.Result, path string, subKey string) {
+		categories.ForEach(func(_, category gjson.Result) bool {
+			categoryPath := category.Get("name").String()
+			if path != "" {
+				categoryPath = path + "/" + categoryPath
+			}
+			category.Get("statistics").ForEach(func(_, statistic gjson.Result) bool {
+				definitions = append(definitions, StatisticDefinition{
+					ID:           statistic.Get("id").Int(),
+					Name:         statistic.Get("name").String(),
+					CategoryPath: categoryPath,
+				})
+				quantities = append(quantities, statistic.Get("quantity").Float())
+				return true
+			})
+			walk(category.Get(subKey), categoryPath, subKey)
+			return true
+		})
+	}
+
+	if tree := gjson.Get(myJson, "achievement_statistics.categories"); tree.Exists() {
+		walk(tree, "", "sub_categories")
+	} else {
+		walk(gjson.Get(myJson, "statistics.subCategories"), "", "subCategories")
+	}
+	return definitions, quantities
+}
+
+// Save every statistic in the document for a toon on a day.
+func saveStatistics(ctx context.Context, env *Env, toonId uint, day time.Time, myJson string) error {
+	definitions, quantities := ParseStatistics(myJson)
+	if len(definitions) == 0 {
+		return nil
+	}
+
+	values := make([]StatisticValue, len(definitions))
+	for i, d := range definitions {
+		values[i] = StatisticValue{ToonID: toonId, InsertDate: day, StatisticID: d.ID, Quantity: quantities[i]}
+	}
+	return env.db.SaveStatistics(ctx, definitions, values)
+}
+
+// Print the history of a statistic for a toon. The statistic is an ID or a name, a name has to match only one
+// statistic, exactly or as part of the name.
+func PrintStatisticHistory(ctx context.Context, env *Env, toonName string, statistic string, out io.Writer) error {
+	toon, err := FindToon(ctx, env, toonName)
+	if err != nil {
+		return err
+	}
+
+	definition, err := findStatisticDefinition(ctx, env, statistic)
+	if err != nil {
+		return err
+	}
+
+	values, err := env.db.GetStatisticHistory(ctx, toon.ID, definition.ID)
+	if err != nil {
+		return err
+	}
+
+	_, _ = fmt.Fprintf(out, "%v-%v: %v (%v, id %v)\n\n", toon.Name, toon.Realm, definition.Name, definition.CategoryPath, definition.ID)
+	w := tabwriter.NewWriter(out, 5, 0, 3, ' ', tabwriter.AlignRight)
+	_, _ = fmt.Fprintln(w, "Date\tQuantity\tChange\t")
+	for i, v := range values {
+		change := ""
+		if i > 0 && v.Quantity != values[i-1].Quantity {
+			change = fmt.Sprintf("%+g", v.Quantity-values[i-1].Quantity)
+		}
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t\n", v.InsertDate.Format("2006-01-02"), v.Quantity, change)
+	}
+	return w.Flush()
+}
+
+func findStatisticDefinition(ctx context.Context, env *Env, statistic string) (*StatisticDefinition, error) {
+	if id, err := strconv.ParseInt(statistic, 10, 64); err == nil {
+		definition, err := env.db.GetStatisticDefinition(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("no statistic with id %d: %v", id, err)
+		}
+		return definition, nil
+	}
+
+	matches, err := env.db.FindStatisticDefinitions(ctx, statistic)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range matches {
+		if strings.EqualFold(m.Name, statistic) {
+			return &m, nil
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no statistic matches %q", statistic)
+	case 1:
+		return &matches[0], nil
+	}
+	var names []string
+	for _, m := range matches {
+		names = append(names, fmt.Sprintf("  %v: %v (%v)", m.ID, m.Name, m.CategoryPath))
+	}
+	return nil, fmt.Errorf("%q matches more than one statistic, use the id:\n%s", statistic, strings.Join(names, "\n"))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStatistics(t *testing.T) {
+	for _, file := range []string{"test-json-profile.json", "test-json.json"} {
+		jsonText, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Could not read file: %v", err)
+		}
+
+		definitions, quantities := ParseStatistics(string(jsonText))
+		if len(definitions) != 1400 || len(quantities) != 1400 {
+			t.Errorf("%s: want 1400 statistics, got %v", file, len(definitions))
+		}
+		for i, d := range definitions {
+			if d.ID == 1518 && (d.Name != "Fish caught" || d.CategoryPath != "Skills/Secondary Skills" || quantities[i] != 22306) {
+				t.Errorf("%s: fish caught incorrect, got %+v quantity %v", file, d, quantities[i])
+			}
+		}
+	}
+}
+
+func TestStatisticHistory(t *testing.T) {
+	ctx := context.Background()
+	db, env, cleanup := newMigratedEnv(t)
+	defer cleanup()
+
+	toon := insertTestToon(t, db)
+
+	profile, _ := ioutil.ReadFile("test-json-profile.json")
+	later := strings.Replace(string(profile), `"quantity": 6111.0`, `"quantity": 6115.0`, 1)
+	days := []time.Time{time.Date(2019, 10, 16, 0, 0, 0, 0, time.UTC), time.Date(2019, 10, 17, 0, 0, 0, 0, time.UTC)}
+	for i, doc := range []string{string(profile), later} {
+		if err := saveStatistics(ctx, env, toon.ID, days[i], doc); err != nil {
+			t.Fatalf("saveStatistics failed: %v", err)
+		}
+	}
+	// Saving a day again replaces it rather than adding to it.
+	if err := saveStatistics(ctx, env, toon.ID, days[1], later); err != nil {
+		t.Fatalf("saveStatistics failed: %v", err)
+	}
+
+	for _, statistic := range []string{"60", "total deaths"} {
+		var out bytes.Buffer
+		err := PrintStatisticHistory(ctx, env, "borvoh", statistic, &out)
+		if err != nil {
+			t.Fatalf("PrintStatisticHistory(%q) failed: %v", statistic, err)
+		}
+		if !strings.Contains(out.String(), "Total deaths (Deaths, id 60)") || !strings.Contains(out.String(), "6115") || !strings.Contains(out.String(), "+4") {
+			t.Errorf("PrintStatisticHistory(%q) incorrect:\n%s", statistic, out.String())
+		}
+	}
+
+	var out bytes.Buffer
+	err := PrintStatisticHistory(ctx, env, "borvoh", "deaths", &out)
+	if err == nil || !strings.Contains(err.Error(), "more than one") {
+		t.Errorf("An ambiguous statistic name should fail, got %v", err)
+	}
+}
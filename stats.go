@@ -23,6 +23,8 @@ type Stat struct {
 	PetBattlesPvpWon  int64
 	ItemLevel         int64
 	HonorableKills    int64
+	// Set when Blizzard said the character hadn't changed and this is a copy of the previous day.
+	Unchanged bool
 }
 
 // Get the LastModified field as a human readable format as YYYY-MM-DD HH:MM:SS.
@@ -32,3 +34,15 @@ func (s *Stat) LastModifiedAsDateTime() string {
 	t := time.Unix(s.LastModified/1000, 0)
 	return t.UTC().Format("2006-01-02 15:04:05")
 }
+
+// Keep InsertDate to just the day. Postgres and MySQL do this themselves since the column is a date, SQLite
+// would keep the time too which breaks both the unique index and finding the latest day.
+func (s *Stat) BeforeSave() error {
+	s.InsertDate = truncateToDay(s.InsertDate)
+	return nil
+}
+
+// Midnight UTC of t's date, which is how dates are stored.
+func truncateToDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -1,9 +1,27 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/jinzhu/gorm"
+	"io"
+	"strings"
 )
 
+// Returned by FindToon when no toon or more than one toon has the name.
+var (
+	ErrNoToon        = errors.New("no toon named")
+	ErrAmbiguousToon = errors.New("more than one toon named")
+)
+
+// Returned when adding a character that is already a toon.
+var ErrToonExists = errors.New("already a toon")
+
+// Returned when adding a toon is declined at the confirmation.
+var ErrNotConfirmed = errors.New("not confirmed")
+
 // Database table model
 type Toon struct {
 	gorm.Model
@@ -26,7 +44,6 @@ type ToonDto struct {
 	Region  string
 }
 
-
 // Create a new ToonDto struct
 func NewToon(name string, race int64, class int64, gender int64, realm string, region string) *ToonDto {
 	return &ToonDto{
@@ -38,3 +55,107 @@ func NewToon(name string, race int64, class int64, gender int64, realm string, r
 		Region:  region,
 	}
 }
+
+// Find a toon by "Name" or "Name-Realm", case doesn't matter. Just the name only works if it's unique.
+func FindToon(ctx context.Context, env *Env, name string) (*Toon, error) {
+	toons, err := env.db.GetAllToons(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []Toon
+	for _, t := range toons {
+		if strings.EqualFold(t.Name, name) || strings.EqualFold(t.Name+"-"+t.Realm, name) {
+			matches = append(matches, t)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("%w %q", ErrNoToon, name)
+	case 1:
+		return &matches[0], nil
+	}
+	return nil, fmt.Errorf("%w %q, use Name-Realm", ErrAmbiguousToon, name)
+}
+
+// Whether two toons are the same character: same name, realm and region, case and realm slug differences
+// don't matter.
+func (t *Toon) sameCharacter(other Toon) bool {
+	return strings.EqualFold(t.Name, other.Name) && realmSlug(t.Realm) == realmSlug(other.Realm) &&
+		strings.EqualFold(t.Region, other.Region)
+}
+
+// Look a character up on Blizzard and make the toon that adding it would insert, with its race and class from
+// the database. The name is title cased the way toons have always been stored and the realm is matched to one
+// in the realms table, when the realms can't be fetched it's title cased too. It fails with ErrToonExists when
+// the character is already a toon, other than the one with ID self when renaming.
+func lookupToon(ctx context.Context, env *Env, blizzard Blizzard, name string, realm string, region string, self uint) (*Toon, error) {
+	name = strings.Title(strings.ToLower(strings.TrimSpace(name)))
+	realm = strings.Title(strings.ToLower(strings.TrimSpace(realm)))
+	region = strings.ToLower(strings.TrimSpace(region))
+	if _, err := GetRegion(region); err != nil {
+		return nil, err
+	}
+	known, err := resolveRealm(ctx, env, blizzard, realm, region)
+	if err != nil {
+		return nil, err
+	}
+	if known != nil {
+		realm = known.storedName()
+	}
+
+	toon := Toon{Name: name, Realm: realm, Region: region}
+	toons, err := env.db.GetAllToons(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range toons {
+		if t.ID != self && toon.sameCharacter(t) {
+			return nil, fmt.Errorf("%v-%v %w", t.Name, t.Realm, ErrToonExists)
+		}
+	}
+
+	dto := NewToon(name, 0, 0, 0, realm, region)
+	err = blizzard.GetToon(ctx, dto)
+	if err != nil {
+		return nil, fmt.Errorf("could not find character: %w", err)
+	}
+
+	dbClass, err := env.db.GetToonClassById(ctx, dto.ClassID)
+	if err != nil {
+		return nil, fmt.Errorf("could not get class info from database: %v", err)
+	}
+
+	dbRace, err := env.db.GetRaceById(ctx, dto.RaceID)
+	if err != nil {
+		return nil, fmt.Errorf("could not get race info from database: %v", err)
+	}
+
+	toon.ToonClass = *dbClass
+	toon.ClassID = dbClass.ID
+	toon.Race = *dbRace
+	toon.RaceID = dbRace.ID
+	toon.Gender = dto.Gender
+	return &toon, nil
+}
+
+// Show what was found for a character and ask whether to add it. Anything but y or an empty answer declines,
+// and so does running out of input.
+func confirmToon(scanner *bufio.Scanner, out io.Writer, toon *Toon) error {
+	_, _ = fmt.Fprintln(out, "Found character, please verify:")
+	_, _ = fmt.Fprintf(out, "  Name:  %v\n", toon.Name)
+	_, _ = fmt.Fprintf(out, "  Race:  %v\n", toon.Race.Name)
+	_, _ = fmt.Fprintf(out, "  Class: %v\n", toon.ToonClass.Name)
+	_, _ = fmt.Fprintf(out, "  Realm: %v\n", toon.Realm)
+	_, _ = fmt.Fprint(out, "\nAdd character? ")
+	if !scanner.Scan() {
+		_, _ = fmt.Fprintln(out)
+		return ErrNotConfirmed
+	}
+	answer := strings.ToLower(strings.TrimSpace(scanner.Text()))
+	if answer != "y" && answer != "" {
+		return ErrNotConfirmed
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A recorded request and the response Blizzard gave for it.
+type Fixture struct {
+	Method     string
+	Url        string
+	StatusCode int
+	Header     http.Header
+	Body       string
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// File name for the fixture of a request. The path is in there so a person can find things, the hash of the
+// method and full URL is what makes it unique.
+func fixtureFileName(req *http.Request) string {
+	path := strings.Trim(unsafeFileChars.ReplaceAllString(req.URL.Path, "-"), "-")
+	return fmt.Sprintf("%s-%s-%s.json", req.Method, path, cacheKey(req.Method, req.URL.String())[:12])
+}
+
+// Transport that passes requests on to Next and saves each request and response in Dir, so that they can be
+// played back later with ReplayTransport. Access tokens in responses are replaced so fixtures can be shared.
+type RecordingTransport struct {
+	Dir  string
+	Next http.RoundTripper
+}
+
+func (t *RecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	resp, err := next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	header := resp.Header.Clone()
+	header.Del("Content-Length")
+	fixture := &Fixture{
+		Method:     req.Method,
+		Url:        req.URL.String(),
+		StatusCode: resp.StatusCode,
+		Header:     header,
+		Body:       redactAccessToken(string(body)),
+	}
+
+	err = os.MkdirAll(t.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(t.Dir, fixtureFileName(req)), data, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Replace the access token in an OAuth response. Anything that isn't a token response is left alone.
+func redactAccessToken(body string) string {
+	var token map[string]interface{}
+	if json.Unmarshal([]byte(body), &token) != nil {
+		return body
+	}
+	if _, ok := token["access_token"]; !ok {
+		return body
+	}
+
+	token["access_token"] = "recorded-token"
+	redacted, err := json.Marshal(token)
+	if err != nil {
+		return body
+	}
+	return string(redacted)
+}
+
+// Transport that answers requests from fixtures saved by RecordingTransport. It never goes to the network,
+// a request that wasn't recorded is an error.
+type ReplayTransport struct {
+	Dir string
+}
+
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	data, err := ioutil.ReadFile(filepath.Join(t.Dir, fixtureFileName(req)))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no recorded response for %s %s", req.Method, req.URL)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var fixture Fixture
+	err = json.Unmarshal(data, &fixture)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", fixture.StatusCode, http.StatusText(fixture.StatusCode)),
+		StatusCode:    fixture.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        fixture.Header,
+		Body:          ioutil.NopCloser(strings.NewReader(fixture.Body)),
+		ContentLength: int64(len(fixture.Body)),
+		Request:       req,
+	}, nil
+}
@@ -4,18 +4,22 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/adrg/xdg"
 	"github.com/jessevdk/go-flags"
+	"github.com/jinzhu/gorm"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/tidwall/gjson"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
-	"sync"
+	"syscall"
 	"text/tabwriter"
 	"time"
 )
@@ -31,11 +35,40 @@ import (
 
 // Command line options
 var opts struct {
-	Add          bool `long:"add" description:"Add toon"`
-	Update       bool `long:"update" description:"Update Blizzard databases"`
-	Summary      bool `long:"summary" description:"Show level and ilevel for each toon"`
-	EmailSummary bool `long:"emailsummary" description:"Show level and ilevel for each toon"`
-	Quiet        bool `long:"quiet" description:"Do not print output"`
+	Add          bool   `long:"add" description:"Add toon"`
+	AddGuild     string `long:"add-guild" value-name:"NAME" description:"Track a guild on --realm and add its members as toons"`
+	Realm        string `long:"realm" description:"Realm of the guild for --add-guild"`
+	Region       string `long:"region" description:"Region of the guild for --add-guild, the configured region unless given"`
+	MinLevel     int64  `long:"min-level" default:"0" description:"With --add-guild, only add members of at least this level"`
+	MaxRank      int64  `long:"max-rank" default:"-1" description:"With --add-guild, only add members of this rank or higher, 0 is the guild master"`
+	Guilds       bool   `long:"guilds" description:"Show the tracked guilds and who joined and left over --days"`
+	Update       bool   `long:"update" description:"Update Blizzard databases"`
+	Summary      bool   `long:"summary" description:"Show level and ilevel for each toon"`
+	EmailSummary bool   `long:"emailsummary" description:"Show level and ilevel for each toon"`
+	Quiet        bool   `long:"quiet" description:"Do not print output"`
+	Offline      bool   `long:"offline" description:"Do not call Blizzard, use only cached responses"`
+	Record       string `long:"record" value-name:"DIR" description:"Save every Blizzard request and response to DIR"`
+	Replay       string `long:"replay" value-name:"DIR" description:"Answer Blizzard requests from what was saved to DIR with --record"`
+	Migrate      string `long:"migrate" choice:"status" choice:"up" choice:"down" description:"Show, apply or revert database migrations"`
+	Steps        int    `long:"steps" default:"1" description:"Number of migrations --migrate down reverts"`
+	ImportLegacy bool   `long:"import-legacy" description:"Import toons and stats from the Python and Groovy versions' tables"`
+	Backfill     bool   `long:"backfill" description:"Insert or update stats from the JSON in the archive directory"`
+	DryRun       bool   `long:"dry-run" description:"With --backfill, report what would change without writing anything"`
+	From         string `long:"from" value-name:"YYYY-MM-DD" description:"With --backfill or --achievements, skip what's from before this date"`
+	To           string `long:"to" value-name:"YYYY-MM-DD" description:"With --backfill or --achievements, skip what's from after this date"`
+	Statistic    string `long:"statistic" value-name:"ID|NAME" description:"Show the history of an achievement statistic for --toon"`
+	Mounts       bool   `long:"mounts" description:"Show the mount journal for the account, or for --toon"`
+	Pets         bool   `long:"pets" description:"Show the battle pet roster report"`
+	Reputations  bool   `long:"reputations" description:"Show the factions --toon is close to the next standing with and how fast it is gaining"`
+	Achievements string `long:"achievements" value-name:"NAME[-REALM]" description:"Show the achievements a toon completed and the ones it is closest to completing"`
+	Mythic       string `long:"mythic" value-name:"NAME[-REALM]" description:"Show a toon's Mythic+ rating, best runs and weeks"`
+	Pvp          bool   `long:"pvp" description:"Show each toon's PvP rating in each bracket and how it changed over --days"`
+	Professions  bool   `long:"professions" description:"Show which toons have which professions and the skill and recipes they gained over --days"`
+	Raids        bool   `long:"raids" description:"Show every toon's raid progression, or every raid and boss kill for --toon"`
+	Days         int    `long:"days" default:"7" description:"Number of days --reputations, --pvp, --professions and --guilds look back over"`
+	Toon         string `long:"toon" value-name:"NAME[-REALM]" description:"Toon for --statistic, --mounts, --reputations and --raids"`
+
+	ToonCommand ToonCommand `command:"toon" description:"Add, list, remove, deactivate, rename or import toons"`
 }
 
 type EmailConfig struct {
@@ -45,27 +78,44 @@ type EmailConfig struct {
 }
 
 type Config struct {
-	DbDriver     string
-	DbUrl        string
-	ApiKey       string
-	ArchiveStats bool
-	ArchiveDir   string
-	ClientId     string
-	ClientSecret string
-	LogLevel     string
-	Email        EmailConfig
+	DbDriver          string
+	DbUrl             string
+	ApiKey            string
+	ArchiveStats      bool
+	ArchiveDir        string
+	ClientId          string
+	ClientSecret      string
+	LogLevel          string
+	Locale            string
+	Region            string
+	Regions           map[string]RegionConfig
+	RequestsPerSecond int
+	RequestsPerHour   int
+	Concurrency       int
+	ToonTimeout       time.Duration
+	HttpCache         bool
+	CacheDir          string
+	Email             EmailConfig
+	Legacy            LegacyConfig
+	Metrics           []Metric
 }
 
 type Env struct {
-	db     Datastore
-	config Config
+	db      Datastore
+	config  Config
+	metrics []Metric
 }
 
 func main() {
 	log.Trace("Starting application")
-	_, err := flags.Parse(&opts)
+	parser := flags.NewParser(&opts, flags.Default)
+	parser.SubcommandsOptional = true
+	_, err := parser.Parse()
 	if err != nil {
-		log.Panic(err)
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			os.Exit(0)
+		}
+		os.Exit(exitUsage)
 	}
 
 	_, err = xdg.ConfigFile("wowstats/wowstats.yml")
@@ -82,6 +132,17 @@ func main() {
 	viper.AddConfigPath(".")
 	viper.SetDefault("archiveDir", filepath.Join(xdg.DataHome, "wowstats", "json"))
 	viper.SetDefault("archiveStats", true)
+	viper.SetDefault("locale", defaultLocale)
+	viper.SetDefault("region", defaultRegion)
+	viper.SetDefault("requestsPerSecond", defaultRequestsPerSecond)
+	viper.SetDefault("requestsPerHour", defaultRequestsPerHour)
+	viper.SetDefault("concurrency", defaultConcurrency)
+	viper.SetDefault("toonTimeout", defaultToonTimeout)
+	viper.SetDefault("httpCache", true)
+	viper.SetDefault("cacheDir", filepath.Join(xdg.CacheHome, "wowstats", "http"))
+	viper.SetDefault("legacy.dbDriver", "postgres")
+	viper.SetDefault("legacy.toonTable", defaultLegacyToonTable)
+	viper.SetDefault("legacy.statsTable", defaultLegacyStatsTable)
 
 	err = viper.ReadInConfig()
 	if err != nil {
@@ -110,8 +171,8 @@ func main() {
 		log.Fatalf("Unable to parse configuration: %v", err)
 	}
 
-	if !((config.DbDriver == "postgres") || (config.DbDriver == "mysql")) {
-		log.Fatalf("Allowed database driver values are postgres or mysql")
+	if !((config.DbDriver == "postgres") || (config.DbDriver == "mysql") || (config.DbDriver == "sqlite")) {
+		log.Fatalf("Allowed database driver values are %s", strings.Join(dbDrivers, ", "))
 	}
 
 	if viper.IsSet("logLevel") {
@@ -122,183 +183,431 @@ func main() {
 	}
 
 	db, err := NewDB(config.DbDriver, config.DbUrl)
+	if err != nil {
+		log.Fatalf("Could not connect to database: %v", err)
+	}
 	defer db.Close()
 
+	// Everything hangs off of this context, so a SIGINT or SIGTERM stops the Blizzard calls and database
+	// queries that are in flight rather than killing the process in the middle of them.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cancelOnSignal(cancel)
+
+	if opts.Migrate != "" {
+		err = RunMigrate(ctx, db, opts.Migrate, opts.Steps, os.Stdout)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	env := &Env{db: db, config: config}
-	blizzard, err := NewBlizzard(config.ClientId, config.ClientSecret)
+	limiter := NewRateLimiter(config.RequestsPerSecond, config.RequestsPerHour)
+
+	var cache *ResponseCache
+	if config.HttpCache || opts.Offline {
+		cache, err = NewResponseCache(config.CacheDir)
+		if err != nil {
+			log.Fatalf("Could not create cache directory %s: %v", config.CacheDir, err)
+		}
+	}
 
+	blizzard := NewBlizzardRegions(config.Region, config.ClientId, config.ClientSecret, config.Locale, config.Regions)
+	blizzard.Limiter = limiter
+	blizzard.Cache = cache
+	blizzard.Offline = opts.Offline
+
+	if opts.Record != "" {
+		blizzard.Transport = &RecordingTransport{Dir: opts.Record}
+	}
+	if opts.Replay != "" {
+		blizzard.Transport = &ReplayTransport{Dir: opts.Replay}
+	}
+
+	err = blizzard.Connect(ctx)
 	if err != nil {
 		log.Fatalf("Error in blizzard configuration: %v", err)
 	}
 
-	doDatabaseMigrations(db, env, blizzard)
+	err = doDatabaseMigrations(ctx, db, env, blizzard)
+	if err != nil {
+		log.Fatalf("Could not migrate database: %v", err)
+	}
+
+	env.metrics, err = RegisterMetrics(ctx, env, config.Metrics)
+	if err != nil {
+		log.Fatalf("Invalid metrics: %v", err)
+	}
 
 	if opts.Update {
 		log.Println("Updating info from Blizzard, please wait...")
-		err = UpdateClassesFromBlizzard(env, blizzard)
+		err = UpdateClassesFromBlizzard(ctx, env, blizzard)
 		if err != nil {
 			log.Fatalf("Could not update classes from Blizzard: %v", err)
 		}
-		err = UpdateRacesFromBlizzard(env, blizzard)
+		err = UpdateRacesFromBlizzard(ctx, env, blizzard)
 		if err != nil {
 			log.Fatalf("Could not update races from Blizzard: %v", err)
 		}
+		err = UpdateAchievementsFromBlizzard(ctx, env, blizzard)
+		if err != nil {
+			log.Fatalf("Could not update achievements from Blizzard: %v", err)
+		}
+		regions, err := realmRegions(ctx, env)
+		if err != nil {
+			log.Fatalf("Could not get regions: %v", err)
+		}
+		for _, region := range regions {
+			err = UpdateRealmsFromBlizzard(ctx, env, blizzard, region)
+			if err != nil {
+				log.Fatalf("Could not update %v realms from Blizzard: %v", region, err)
+			}
+		}
+		err = NormalizeRealms(ctx, env, regions)
+		if err != nil {
+			log.Fatalf("Could not normalize realms: %v", err)
+		}
 		log.Println("Done. Exiting.")
 		os.Exit(0)
 	}
 
 	if opts.Add {
-		AddToon(env, blizzard)
+		err = AddToon(ctx, env, blizzard, os.Stdin, os.Stdout)
+		if err != nil {
+			log.Error(err)
+			os.Exit(exitCode(err))
+		}
 		os.Exit(0)
 	}
 
-	if opts.Summary {
-		stats, err := env.db.GetAllToonLatestQuickSummary()
+	if parser.Active != nil && parser.Active.Name == "toon" {
+		err = RunToonCommand(ctx, env, blizzard, &opts.ToonCommand, parser.Active.Active.Name, os.Stdin, os.Stdout)
+		if err != nil {
+			log.Error(err)
+			os.Exit(exitCode(err))
+		}
+		os.Exit(0)
+	}
+
+	if opts.AddGuild != "" {
+		region := opts.Region
+		if region == "" {
+			region = config.Region
+		}
+		guild := Guild{Name: opts.AddGuild, Realm: opts.Realm, Region: strings.ToLower(region), MinLevel: opts.MinLevel, MaxRank: opts.MaxRank}
+		err = AddGuild(ctx, env, blizzard, guild, os.Stdout)
+		if err != nil {
+			log.Error(err)
+			os.Exit(exitCode(err))
+		}
+		os.Exit(0)
+	}
+
+	if opts.ImportLegacy {
+		legacyDb, closeLegacy, err := OpenLegacy(db, config.Legacy)
+		if err != nil {
+			log.Fatalf("Could not open legacy database: %v", err)
+		}
+		results, err := ImportLegacy(ctx, env, blizzard, legacyDb, config.Legacy)
+		_ = closeLegacy()
+		if err != nil {
+			log.Error(err)
+		}
+		err = PrintLegacyReport(results, os.Stdout)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if opts.Backfill {
+		options := BackfillOptions{Dir: config.ArchiveDir, DryRun: opts.DryRun}
+		options.From, err = parseOptionDate(opts.From)
+		if err != nil {
+			log.Fatalf("Invalid --from: %v", err)
+		}
+		options.To, err = parseOptionDate(opts.To)
+		if err != nil {
+			log.Fatalf("Invalid --to: %v", err)
+		}
+
+		results, err := Backfill(ctx, env, options)
+		if err != nil {
+			log.Error(err)
+		}
+		err = PrintBackfillReport(results, options.DryRun, os.Stdout)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if opts.Statistic != "" {
+		err = PrintStatisticHistory(ctx, env, opts.Toon, opts.Statistic, os.Stdout)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if opts.Mounts {
+		err = PrintMounts(ctx, env, opts.Toon, os.Stdout)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if opts.Pets {
+		err = PrintPets(ctx, env, os.Stdout)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if opts.Reputations {
+		err = PrintReputations(ctx, env, opts.Toon, opts.Days, os.Stdout)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if opts.Achievements != "" {
+		from, err := parseOptionDate(opts.From)
+		if err != nil {
+			log.Fatalf("Invalid --from: %v", err)
+		}
+		to, err := parseOptionDate(opts.To)
+		if err != nil {
+			log.Fatalf("Invalid --to: %v", err)
+		}
+		err = PrintAchievements(ctx, env, opts.Achievements, from, to, os.Stdout)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if opts.Mythic != "" {
+		err = PrintMythicKeystone(ctx, env, opts.Mythic, os.Stdout)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if opts.Pvp {
+		err = PrintPvpSummary(ctx, env, opts.Days, os.Stdout)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if opts.Professions {
+		err = PrintProfessions(ctx, env, opts.Days, os.Stdout)
 		if err != nil {
 			log.Error(err)
 			os.Exit(1)
 		}
-		w := tabwriter.NewWriter(os.Stdout, 5, 0, 3, ' ', tabwriter.AlignRight)
-		_, _ = fmt.Fprintln(w, "Name\tLevel\tItem Level\tLast Modified\tDate\t")
-		for _, s := range stats {
-			_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t\n", s.Toon.Name, s.Level, s.ItemLevel, s.LastModifiedAsDateTime(), s.CreatedAt.Format("2006-01-02"))
+		os.Exit(0)
+	}
+
+	if opts.Raids {
+		err = PrintRaidProgress(ctx, env, opts.Toon, os.Stdout)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if opts.Guilds {
+		err = PrintGuilds(ctx, env, opts.Days, os.Stdout)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if opts.Summary {
+		err = PrintSummary(ctx, env, os.Stdout)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
 		}
-		_ = w.Flush()
 		os.Exit(0)
 	}
 
 	if opts.EmailSummary {
-		err = DoEmailSummary(env)
+		err = DoEmailSummary(ctx, env)
 		if err != nil {
 			log.Printf("Error sending email: %v\n", err)
 		}
 		os.Exit(0)
 	}
 
-	// OK, we're going to do the normal get the stats function, we can fork these off to separate processes since
-	// they aren't dependent on each other and the database will handle its own locking.
+	// OK, we're going to do the normal get the stats function. The guild rosters come first so that new
+	// members get fetched on this run and the ones that left don't. The toons aren't dependent on each other so
+	// a pool of workers handles them and the database will handle its own locking.
+	err = SyncGuilds(ctx, env, blizzard)
+	if err != nil {
+		log.Errorf("Could not sync guilds: %v", err)
+	}
+	toons, err := env.db.GetActiveToons(ctx)
+	if err != nil {
+		log.Fatalf("Could not get toons: %v", err)
+	}
 
-	var wg sync.WaitGroup
+	CollectStats(ctx, env, blizzard, toons)
 
-	toons := env.db.GetAllToons()
-	for _, t := range toons {
-		wg.Add(1)
-		go GetAndInsertToonStats(t, env, blizzard, &wg)
+	err = RefreshAchievementDefinitions(ctx, env, blizzard)
+	if err != nil {
+		log.Errorf("Could not update achievements: %v", err)
+	}
+	err = RefreshMountDefinitions(ctx, env, blizzard)
+	if err != nil {
+		log.Errorf("Could not update mounts: %v", err)
 	}
-	wg.Wait()
 	log.Trace("Exiting.")
 }
 
-// Do database migrations.
-// Add additional changes after the AutoMigrate for things that AutoMigrate won't handle.
-func doDatabaseMigrations(db *WowDB, env *Env, blizzard Blizzard) {
+// Cancel the run when the process gets a SIGINT or SIGTERM. A second signal exits right away in case
+// something is stuck.
+func cancelOnSignal(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-signals
+	log.Warnf("Got %v, cancelling", sig)
+	cancel()
+
+	<-signals
+	os.Exit(1)
+}
+
+// Parse a YYYY-MM-DD date from the command line, an empty one is the zero time.
+func parseOptionDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(archiveDateFormat, value)
+}
+
+// Bring the schema up to date. When this creates the tables the classes and races are also loaded from
+// Blizzard, the seeded ones stop at Battle for Azeroth.
+func doDatabaseMigrations(ctx context.Context, db *WowDB, env *Env, blizzard Blizzard) error {
+	applied, err := db.MigrateUp(ctx)
+	if err != nil {
+		return err
+	}
 
-	if ! db.HasTable(&Race{}) {
-		log.Debug("Migrating race")
-		db.AutoMigrate(&Race{})
-		err := UpdateRacesFromBlizzard(env, blizzard)
+	for _, m := range applied {
+		if m.Version != baselineVersion {
+			continue
+		}
+		err = UpdateRacesFromBlizzard(ctx, env, blizzard)
 		if err != nil {
 			log.Errorf("Could not update races: %v", err)
 		}
-	}
-
-	if ! db.HasTable(&ToonClass{}) {
-		log.Println("Migrating classes")
-		db.AutoMigrate(&ToonClass{})
-		err := UpdateClassesFromBlizzard(env, blizzard)
+		err = UpdateClassesFromBlizzard(ctx, env, blizzard)
 		if err != nil {
 			log.Errorf("Could not update classes: %v", err)
 		}
 	}
-
-	db.AutoMigrate(&Stat{})
-	db.AutoMigrate(&Toon{})
-
-	if ! db.HasTable(&ClassColor{}) {
-		db.AutoMigrate(&ClassColor{})
-		db.Model(&ClassColor{}).AddForeignKey("toon_class_id", "toon_classes(id)", "RESTRICT", "RESTRICT")
-		var tColor = ClassColor{ToonClassID: 1, Color: "#C79C63"}
-		db.Create(&tColor)
-		tColor.ID = 0
-		tColor.ToonClassID = 2
-		tColor.Color = "#F58CBA"
-		db.Create(&tColor)
-		tColor.ID = 0
-		tColor.ToonClassID = 3
-		tColor.Color = "#ABD473"
-		db.Create(&tColor)
-		tColor.ID = 0
-		tColor.ToonClassID = 4
-		tColor.Color = "#FFF569"
-		db.Create(&tColor)
-		tColor.ID = 0
-		tColor.ToonClassID = 5
-		tColor.Color = "#F0EBE0"
-		db.Create(&tColor)
-		tColor.ID = 0
-		tColor.ToonClassID = 6
-		tColor.Color = "#C41F3B"
-		db.Create(&tColor)
-		tColor.ID = 0
-		tColor.ToonClassID = 7
-		tColor.Color = "#0070DE"
-		db.Create(&tColor)
-		tColor.ID = 0
-		tColor.ToonClassID = 8
-		tColor.Color = "#69CCF0"
-		db.Create(&tColor)
-		tColor.ID = 0
-		tColor.ToonClassID = 9
-		tColor.Color = "#9482C9"
-		db.Create(&tColor)
-		tColor.ID = 0
-		tColor.ToonClassID = 10
-		tColor.Color = "#00FF96"
-		db.Create(&tColor)
-		tColor.ID = 0
-		tColor.ToonClassID = 11
-		tColor.Color = "#FF7D0A"
-		db.Create(&tColor)
-		tColor.ID = 0
-		tColor.ToonClassID = 12
-		tColor.Color = "#A330C9"
-		db.Create(&tColor)
-	}
-
-	db.Model(&Toon{}).AddForeignKey("race_id", "races(id)", "RESTRICT", "RESTRICT")
-	db.Model(&Toon{}).AddForeignKey("class_id", "toon_classes(id)", "RESTRICT", "RESTRICT")
-	db.Model(&Stat{}).AddForeignKey("toon_id", "toons(id)", "RESTRICT", "RESTRICT")
-	db.Model(&Stat{}).AddUniqueIndex("idx_toon_id_create_date", "toon_id", "insert_date")
+	return nil
 }
 
-// Gets the latest stats for the specified Toon and will then save to the database.
-func GetAndInsertToonStats(t Toon, env *Env, blizzard Blizzard, wg *sync.WaitGroup) {
-	defer wg.Done()
+// Run the migrate command: status lists the migrations, up applies the pending ones and down reverts the
+// last steps of them.
+func RunMigrate(ctx context.Context, db *WowDB, command string, steps int, out io.Writer) error {
+	switch command {
+	case "status":
+		states, err := db.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 5, 0, 3, ' ', 0)
+		_, _ = fmt.Fprintln(w, "Version\tApplied\tDescription\t")
+		for _, s := range states {
+			applied := "pending"
+			if s.Applied {
+				applied = s.AppliedAt.Local().Format("2006-01-02 15:04:05")
+			}
+			_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t\n", s.Version, applied, s.Description)
+		}
+		return w.Flush()
+	case "up":
+		applied, err := db.MigrateUp(ctx)
+		for _, m := range applied {
+			_, _ = fmt.Fprintf(out, "Applied %v: %v\n", m.Version, m.Description)
+		}
+		return err
+	case "down":
+		reverted, err := db.MigrateDown(ctx, steps)
+		for _, m := range reverted {
+			_, _ = fmt.Fprintf(out, "Reverted %v: %v\n", m.Version, m.Description)
+		}
+		return err
+	}
+	return fmt.Errorf("unknown migrate command %q, allowed values are status, up and down", command)
+}
 
-	myJson, err := blizzard.GetToonJson(t)
+// Gets the latest stats for the specified Toon and will then save to the database. When the profile hasn't
+// changed the last stats are copied forward and the document isn't parsed again, so the snapshot recorders are
+// skipped too. The achievements, keystones and raids still get fetched and saved.
+func GetAndInsertToonStats(ctx context.Context, t Toon, env *Env, blizzard Blizzard) {
+	myJson, err := blizzard.GetToonJson(ctx, t)
+	unchanged := false
+	if notModified, ok := err.(*NotModifiedError); ok {
+		// Nothing changed, so copy the last stats forward rather than parse the same thing again. If there
+		// aren't any stats yet go ahead and parse what was cached.
+		myJson, err = notModified.Json, nil
+		unchanged = insertUnchangedStats(ctx, t, env) == nil
+	}
 	if err != nil {
-		log.Printf("Could not get stats for %s: %v\n", t.Name, err)
+		reportToonFailure(t, "fetch", err)
 		return
 	}
 
-	stats := ParseStatsFromJson(myJson)
-	stats.ToonID = t.ID
-	err = env.db.InsertStats(&stats)
-	if err != nil {
-		log.Printf("Error inserting stats for %v: %v\n", t.Name, err)
-		return
-	} else {
-		if !opts.Quiet {
-			log.Printf("Inserted record for %v: Level: [%v] Ilevel: [%v]", t.Name, stats.Level, stats.ItemLevel)
+	if !unchanged {
+		stats := ParseStatsFromJson(myJson)
+		stats.ToonID = t.ID
+		err = env.db.InsertStats(ctx, &stats)
+		if err != nil {
+			reportToonFailure(t, "insert", err)
+			return
+		} else {
+			if !opts.Quiet {
+				log.Printf("Inserted record for %v: Level: [%v] Ilevel: [%v]", t.Name, stats.Level, stats.ItemLevel)
+			}
 		}
+		insertSnapshot(ctx, t, env, myJson)
 	}
+	insertAchievements(ctx, t, env, blizzard)
+	insertMythicKeystone(ctx, t, env, blizzard)
+	insertRaidEncounters(ctx, t, env, blizzard)
 
 	if env.config.ArchiveStats {
 
-		dir := filepath.Join(env.config.ArchiveDir, fmt.Sprintf("%s-%s", t.Name, t.Realm))
+		dir := archiveFolder(env.config.ArchiveDir, t)
 		err = os.MkdirAll(dir, 0755)
 		if err != nil {
-			log.Printf("Could not create directory %s: %v\n", dir, err)
+			reportToonFailure(t, "archive", err)
 			// May as well return now since we can't write to the directory
 			return
 		}
@@ -324,12 +633,101 @@ func GetAndInsertToonStats(t Toon, env *Env, blizzard Blizzard, wg *sync.WaitGro
 
 		err = ioutil.WriteFile(fileName, gzipBuffer.Bytes(), 0644)
 		if err != nil {
-			log.Printf("Could not write file %s: %v\n", fileName, err)
+			reportToonFailure(t, "archive", err)
 		}
 	}
 }
 
+// Insert a copy of the toon's latest stats for today, marked as unchanged. Returns an error only when there
+// are no stats to copy, a failed insert is reported here since parsing the cached JSON wouldn't help.
+func insertUnchangedStats(ctx context.Context, t Toon, env *Env) error {
+	latest, err := env.db.GetLatestStats(ctx, t.ID)
+	if err != nil {
+		return err
+	}
+
+	stats := *latest
+	stats.Model = gorm.Model{}
+	stats.Toon = Toon{}
+	stats.InsertDate = time.Now()
+	stats.Unchanged = true
+	err = env.db.InsertStats(ctx, &stats)
+	if err != nil {
+		reportToonFailure(t, "insert", err)
+		return nil
+	}
+
+	if !opts.Quiet {
+		log.Printf("Inserted unchanged record for %v: Level: [%v] Ilevel: [%v]", t.Name, stats.Level, stats.ItemLevel)
+	}
+	return nil
+}
+
+// Save everything the snapshot recorders keep from today's document for the toon.
+func insertSnapshot(ctx context.Context, t Toon, env *Env, myJson string) {
+	for _, e := range recordSnapshot(ctx, env, t.ID, time.Now(), myJson) {
+		reportToonFailure(t, e.Stage, e.Err)
+	}
+}
+
+// Log why getting stats for a toon failed. The fields make it possible to pick the failures out of the log and
+// tell a missing character from Blizzard being down. Stage is what was being done: fetch, insert, archive
+// or one of the snapshot recorders.
+func reportToonFailure(t Toon, stage string, err error) {
+	fields := log.Fields{
+		"toon":   t.Name,
+		"realm":  t.Realm,
+		"region": t.Region,
+		"stage":  stage,
+	}
+
+	switch e := err.(type) {
+	case *RequestError:
+		fields["url"] = e.Url
+		fields["status"] = e.StatusCode
+		fields["attempts"] = e.Attempts
+	default:
+		if err == ErrNotFound {
+			fields["status"] = 404
+		}
+	}
+
+	log.WithFields(fields).WithError(err).Error("Could not update toon stats")
+}
+
+// Parse the stats from a character document. This handles both the combined Profile API document from
+// GetToonJson and the old Community API document so that the files in the archive directory can still be read.
 func ParseStatsFromJson(myJson string) Stat {
+	if gjson.Get(myJson, "achievement_points").Exists() {
+		return parseProfileStats(myJson)
+	}
+	return parseCommunityStats(myJson)
+}
+
+// Parse the stats from the combined Profile API document. The achievement statistics have the same IDs as
+// they did in the Community API, they just moved to categories and sub_categories. Where each value comes from
+// is in builtinMetrics.
+func parseProfileStats(myJson string) Stat {
+	values := EvaluateMetrics(myJson, builtinMetrics)
+	var stats = new(Stat)
+	stats.Level = int64(values["level"])
+	stats.AchievementPoints = int64(values["achievement_points"])
+	stats.ExaltedReps = int64(values["exalted_reps"])
+	stats.MountsCollected = int64(values["mounts_collected"])
+	stats.QuestsCompleted = int64(values["quests_completed"])
+	stats.FishCaught = int64(values["fish_caught"])
+	stats.PetsCollected = int64(values["pets_collected"])
+	stats.PetBattlesWon = int64(values["pet_battles_won"])
+	stats.PetBattlesPvpWon = int64(values["pet_battles_pvp_won"])
+	stats.ItemLevel = int64(values["item_level"])
+	stats.HonorableKills = int64(values["honorable_kills"])
+	stats.LastModified = gjson.Get(myJson, "last_login_timestamp").Int()
+	stats.InsertDate = time.Now()
+	return *stats
+}
+
+// Parse the stats from the retired Community API document.
+func parseCommunityStats(myJson string) Stat {
 	var stats = new(Stat)
 	//stats.ToonID = toon.ID
 	stats.Level = gjson.Get(myJson, "level").Int()
@@ -348,78 +746,84 @@ func ParseStatsFromJson(myJson string) Stat {
 	return *stats
 }
 
-// Query the user for character to info to add to the database.
-func AddToon(env *Env, blizzard Blizzard) {
-	fmt.Printf("Character name: ")
-	scanner := bufio.NewScanner(os.Stdin)
+// Query the user for character to info to add to the database. The questions go to out and the answers are
+// read from in, which is stdout and stdin when run with --add. The toon add command does the same without
+// asking.
+func AddToon(ctx context.Context, env *Env, blizzard Blizzard, in io.Reader, out io.Writer) error {
+	_, _ = fmt.Fprintf(out, "Character name: ")
+	scanner := bufio.NewScanner(in)
 	scanner.Scan()
-	name := strings.Title(strings.ToLower(scanner.Text()))
-	fmt.Printf("Realm: ")
+	name := scanner.Text()
+	_, _ = fmt.Fprintf(out, "Realm: ")
 	scanner.Scan()
-	realm := strings.Title(strings.ToLower(scanner.Text()))
-	fmt.Printf("Region (us, eu, kr, tw): ")
+	realm := scanner.Text()
+	_, _ = fmt.Fprintf(out, "Region (%s): ", strings.Join(RegionNames(), ", "))
 	scanner.Scan()
 	region := strings.ToLower(scanner.Text())
-	fmt.Printf("Region: [%v]\n", region)
+	_, _ = fmt.Fprintf(out, "Region: [%v]\n", region)
 
-	fmt.Println("Looking up character, please wait...")
-	toon := NewToon(name, 0, 0, 0, realm, region)
-	err := blizzard.GetToon(toon)
+	_, _ = fmt.Fprintln(out, "Looking up character, please wait...")
+	toon, err := lookupToon(ctx, env, blizzard, name, realm, region, 0)
 	if err != nil {
-		fmt.Printf("Could not find character: %v\n", err)
-		os.Exit(0)
+		return err
+	}
+	err = confirmToon(scanner, out, toon)
+	if err != nil {
+		return err
 	}
 
-	dbClass, err := env.db.GetToonClassById(toon.ClassID)
+	_, _ = fmt.Fprintln(out, "Adding character")
+	err = env.db.InsertToon(ctx, toon)
 	if err != nil {
-		fmt.Printf("Could not get class info from database: %v\n", err)
-		os.Exit(0)
+		return fmt.Errorf("could not insert toon into database: %v", err)
 	}
+	return nil
+}
 
-	dbRace, err := env.db.GetRaceById(toon.RaceID)
+// Write the level, item level and Mythic+ rating of each toon from the latest stats as a table, followed by
+// the equipment upgrades from the last few days.
+func PrintSummary(ctx context.Context, env *Env, out io.Writer) error {
+	stats, err := env.db.GetAllToonLatestQuickSummary(ctx)
 	if err != nil {
-		fmt.Printf("Could not get race info from database: %v\n", err)
-		os.Exit(0)
+		return err
+	}
+	ratings, err := latestMythicRatings(ctx, env)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 5, 0, 3, ' ', tabwriter.AlignRight)
+	_, _ = fmt.Fprintln(w, "Name\tLevel\tItem Level\tM+ Rating\tLast Modified\tDate\t")
+	for _, s := range stats {
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t\n", s.Toon.Name, s.Level, s.ItemLevel, ratings[s.ToonID], s.LastModifiedAsDateTime(), s.CreatedAt.Format("2006-01-02"))
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
 	}
 
-	fmt.Println("Found character, please verify:")
-	fmt.Printf("  Name:  %v\n", name)
-	fmt.Printf("  Race:  %v\n", dbRace.Name)
-	fmt.Printf("  Class: %v\n", dbClass.Name)
-	fmt.Printf("  Realm: %v\n", realm)
-	fmt.Print("\nAdd character? ")
-	scanner.Scan()
-	addResp := strings.ToLower(scanner.Text())
-	if addResp == "y" || addResp == "" {
-		fmt.Println("Adding character")
-		var dbToon Toon
-		dbToon.ToonClass = *dbClass
-		dbToon.Race = *dbRace
-		dbToon.Name = name
-		dbToon.Gender = toon.Gender
-		dbToon.Realm = toon.Realm
-		dbToon.Region = toon.Region
-
-		err = env.db.InsertToon(&dbToon)
-		if err != nil {
-			fmt.Printf("Could not insert toon into database: %v\n", err)
-			os.Exit(0)
-		}
+	upgrades, err := recentUpgrades(ctx, env)
+	if err != nil {
+		return err
+	}
+	if len(upgrades) > 0 {
+		_, _ = fmt.Fprintf(out, "\nUpgrades in the last %v days:\n", upgradeReportDays)
+		return PrintUpgrades(upgrades, out)
 	}
+	return nil
 }
 
 // Update the player classes from Blizzard. This will use the API to get the classes and add them to the database. This
 //probably isn't really needed, it's happened exactly twice ever, but you never know.
-func UpdateClassesFromBlizzard(env *Env, blizzard Blizzard) error {
+func UpdateClassesFromBlizzard(ctx context.Context, env *Env, blizzard Blizzard) error {
 	log.Trace("Entering UpdateClassesFromBlizzard")
 
-	classes, err := blizzard.GetClasses()
+	classes, err := blizzard.GetClasses(ctx)
 	if err != nil {
 		return err
 	}
 
 	for _, c := range classes {
-		toonClass, err := env.db.GetToonClassById(c.ID)
+		toonClass, err := env.db.GetToonClassById(ctx, c.ID)
 		//log.Printf("Back from get by id, err: %v\n", err)
 		if err != nil {
 			//log.Printf("Adding class: %v\n", c.Name)
@@ -427,7 +831,7 @@ func UpdateClassesFromBlizzard(env *Env, blizzard Blizzard) error {
 			toonClass.ID = c.ID
 			toonClass.PowerType = c.PowerType
 			toonClass.Mask = c.Mask
-			err = env.db.InsertToonClass(toonClass)
+			err = env.db.InsertToonClass(ctx, toonClass)
 			if err != nil {
 				log.Printf("Could not insert class %s: %v\n", c.Name, err)
 			}
@@ -439,9 +843,9 @@ func UpdateClassesFromBlizzard(env *Env, blizzard Blizzard) error {
 
 // Update the database with the data from Blizzard. We force insert the ID here and use the same ID as
 // Blizzard so that we can map things correctly.
-func UpdateRacesFromBlizzard(env *Env, blizzard Blizzard) error {
+func UpdateRacesFromBlizzard(ctx context.Context, env *Env, blizzard Blizzard) error {
 	log.Trace("Entering UpdateRacesFromBlizzard")
-	races, err := blizzard.GetRaces()
+	races, err := blizzard.GetRaces(ctx)
 
 	if err != nil {
 		return err
@@ -449,7 +853,7 @@ func UpdateRacesFromBlizzard(env *Env, blizzard Blizzard) error {
 
 	for _, r := range races {
 		//log.Printf("Searching for race id: %v\n", r.ID)
-		race, err := env.db.GetRaceById(r.ID)
+		race, err := env.db.GetRaceById(ctx, r.ID)
 		//log.Printf("Back from get by id, err: %v\n", err)
 		if err != nil {
 			//log.Printf("Inserting race: [%v]\n", r.Name)
@@ -457,7 +861,7 @@ func UpdateRacesFromBlizzard(env *Env, blizzard Blizzard) error {
 			race.Name = r.Name
 			race.Mask = r.Mask
 			race.Side = r.Side
-			err = env.db.InsertRace(race)
+			err = env.db.InsertRace(ctx, race)
 			if err != nil {
 				log.Printf("Could not insert race %s: %v\n", r.Name, err)
 			}
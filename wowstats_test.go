@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestParseStatsFromJson(t *testing.T) {
@@ -70,3 +74,144 @@ func TestParseStatsFromJson(t *testing.T) {
 		t.Errorf("LastModified is incorrect, want %v got %v", wanted.LastModified, stats.LastModified)
 	}
 }
+
+func TestParseStatsFromProfileJson(t *testing.T) {
+	jsonText, err := ioutil.ReadFile("test-json-profile.json")
+	if err != nil {
+		t.Error("Could not read file")
+	}
+
+	stats := ParseStatsFromJson(string(jsonText))
+
+	var wanted = new(Stat)
+	wanted.Level = 120
+	wanted.AchievementPoints = 21835
+	wanted.ExaltedReps = 95
+	wanted.PetsCollected = 6
+	wanted.MountsCollected = 4
+	wanted.QuestsCompleted = 21216
+	wanted.FishCaught = 22306
+	wanted.PetBattlesWon = 1318
+	wanted.PetBattlesPvpWon = 34
+	wanted.ItemLevel = 415
+	wanted.HonorableKills = 11425
+	wanted.LastModified = 1571309922000
+
+	if stats.Level != wanted.Level {
+		t.Errorf("Level incorrect, want %v got %v", wanted.Level, stats.Level)
+	}
+
+	if stats.AchievementPoints != wanted.AchievementPoints {
+		t.Errorf("Achievement points incorrect, want %v got %v", wanted.AchievementPoints, stats.AchievementPoints)
+	}
+
+	if stats.ExaltedReps != wanted.ExaltedReps {
+		t.Errorf("ExaltedReps incorrect, want %v got %v", wanted.ExaltedReps, stats.ExaltedReps)
+	}
+
+	if stats.PetsCollected != wanted.PetsCollected {
+		t.Errorf("PetsCollected is incorrect, want %v got %v", wanted.PetsCollected, stats.PetsCollected)
+	}
+
+	if stats.MountsCollected != wanted.MountsCollected {
+		t.Errorf("MountsCollected is incorrect, want %v got %v", wanted.MountsCollected, stats.MountsCollected)
+	}
+
+	if stats.QuestsCompleted != wanted.QuestsCompleted {
+		t.Errorf("QuestsCompleted is incorrect, want %v got %v", wanted.QuestsCompleted, stats.QuestsCompleted)
+	}
+
+	if stats.FishCaught != wanted.FishCaught {
+		t.Errorf("FishCaught is incorrect, want %v got %v", wanted.FishCaught, stats.FishCaught)
+	}
+
+	if stats.PetBattlesWon != wanted.PetBattlesWon {
+		t.Errorf("PetBattlesWon is incorrect, want %v got %v", wanted.PetBattlesWon, stats.PetBattlesWon)
+	}
+
+	if stats.PetBattlesPvpWon != wanted.PetBattlesPvpWon {
+		t.Errorf("PetBattlesPvpWon is incorrect, want %v got %v", wanted.PetBattlesPvpWon, stats.PetBattlesPvpWon)
+	}
+
+	if stats.ItemLevel != wanted.ItemLevel {
+		t.Errorf("ItemLevel is incorrect, want %v got %v", wanted.ItemLevel, stats.ItemLevel)
+	}
+
+	if stats.HonorableKills != wanted.HonorableKills {
+		t.Errorf("HonorableKills is incorrect, want %v got %v", wanted.HonorableKills, stats.HonorableKills)
+	}
+
+	if stats.LastModified != wanted.LastModified {
+		t.Errorf("LastModified is incorrect, want %v got %v", wanted.LastModified, stats.LastModified)
+	}
+}
+
+// A Blizzard whose profiles never change, it answers GetToonJson with the document as a *NotModifiedError.
+type unchangedBlizzard struct {
+	Blizzard
+}
+
+func (b unchangedBlizzard) GetToonJson(ctx context.Context, toon Toon) (string, error) {
+	myJson, err := b.Blizzard.GetToonJson(ctx, toon)
+	if err != nil {
+		return "", err
+	}
+	return "", &NotModifiedError{Json: myJson}
+}
+
+func TestGetAndInsertUnchangedToonStats(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeBlizzard(t)
+	defer fake.Close()
+	blizzard := unchangedBlizzard{newTestBlizzard(t, fake.Transport())}
+	db, env, cleanup := newMigratedEnv(t)
+	defer cleanup()
+	archive, err := ioutil.TempDir("", "wowstats-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(archive)
+	env.config = Config{ArchiveStats: true, ArchiveDir: archive}
+	opts.Quiet = true
+
+	toon := Toon{Name: "Borvoh", RaceID: 1, ClassID: 1, Realm: "Duskwood", Region: "us"}
+	if err := db.InsertToon(ctx, &toon); err != nil {
+		t.Fatal(err)
+	}
+	yesterday := Stat{ToonID: toon.ID, Level: 119, ItemLevel: 400, InsertDate: time.Now().AddDate(0, 0, -1)}
+	if err := db.InsertStats(ctx, &yesterday); err != nil {
+		t.Fatal(err)
+	}
+
+	// The unchanged document shouldn't be parsed again by any of the recorders.
+	recorded := 0
+	recorders := snapshotRecorders
+	snapshotRecorders = []snapshotRecorder{{"count", func(context.Context, *Env, uint, time.Time, string) error {
+		recorded++
+		return nil
+	}}}
+	defer func() { snapshotRecorders = recorders }()
+
+	GetAndInsertToonStats(ctx, toon, env, blizzard)
+
+	if recorded != 0 {
+		t.Errorf("The snapshot recorders should be skipped for an unchanged profile, they ran %v times", recorded)
+	}
+	stats, err := db.GetLatestStats(ctx, toon.ID)
+	if err != nil {
+		t.Fatalf("GetLatestStats failed: %v", err)
+	}
+	if !stats.Unchanged || stats.Level != 119 || stats.ItemLevel != 400 {
+		t.Errorf("Want yesterday's stats copied forward as unchanged, got %+v", stats)
+	}
+	if achievements, _ := db.GetToonAchievements(ctx, toon.ID); len(achievements) == 0 {
+		t.Errorf("Achievements should be saved for an unchanged profile")
+	}
+	if raids, _ := db.GetRaidProgress(ctx); len(raids) == 0 {
+		t.Errorf("Raid progress should be saved for an unchanged profile")
+	}
+	name := "Borvoh-Duskwood-" + time.Now().Local().Format("2006-01-02") + ".json.gz"
+	if _, err := os.Stat(filepath.Join(archive, "Borvoh-Duskwood", name)); err != nil {
+		t.Errorf("The unchanged profile should be archived: %v", err)
+	}
+}